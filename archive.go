@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// archiveExtensions are the archives that -into-archives descends into.
+var archiveExtensions = []string{".zip", ".tar"}
+
+// archives is the set of archives whose members were listed by the walk, for -into-archives.
+// The path of a member is the path of its archive joined with its name in the archive,
+// e.g. "backup.zip/photos/flowers.jpg", which can't be the path of a real file since the archive is a file.
+var archives sync.Map
+
+func isArchive(p string) bool {
+	ext := strings.ToLower(filepath.Ext(p))
+	for _, e := range archiveExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// splitMember splits the path of an archive member into the path of the archive and the member's name.
+// ok is false for paths of real files.
+func splitMember(p string) (archive, name string, ok bool) {
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		if _, found := archives.Load(dir); found {
+			rel, err := filepath.Rel(dir, p)
+			return dir, filepath.ToSlash(rel), err == nil
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return "", "", false
+		}
+	}
+}
+
+// archiveMembers returns a fileResult for every regular file in the archive at p, under root.
+// Nested archives are treated as plain files.
+func archiveMembers(p, root string) ([]fileResult, error) {
+	var members []fileResult
+	add := func(name string, size int64) {
+		// names with ".." could make a member look like a real file outside of the archive
+		if name = path.Clean(name); !filepath.IsLocal(name) {
+			slog.Error("skipping archive member with an unsafe name", "archive", p, "name", name)
+			return
+		}
+		members = append(members, fileResult{path: filepath.Join(p, filepath.FromSlash(name)), size: size, root: root})
+	}
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".zip":
+		r, err := zip.OpenReader(p)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if f.Mode().IsRegular() {
+				add(f.Name, int64(f.UncompressedSize64))
+			}
+		}
+	case ".tar":
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				add(hdr.Name, hdr.Size)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("not an archive: %s", p)
+	}
+	archives.Store(p, true)
+	return members, nil
+}
+
+// openMember opens a file or an archive member by the path given to it by the walk.
+func openMember(p string) (io.ReadCloser, error) {
+	archive, name, ok := splitMember(p)
+	if !ok {
+		return os.Open(p)
+	}
+	switch strings.ToLower(filepath.Ext(archive)) {
+	case ".zip":
+		r, err := zip.OpenReader(archive)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range r.File {
+			if path.Clean(f.Name) == name {
+				rc, err := f.Open()
+				if err != nil {
+					r.Close()
+					return nil, err
+				}
+				return readCloser{rc, func() error { return errors.Join(rc.Close(), r.Close()) }}, nil
+			}
+		}
+		r.Close()
+	case ".tar":
+		f, err := os.Open(archive)
+		if err != nil {
+			return nil, err
+		}
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				f.Close()
+				if err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			if hdr.Typeflag == tar.TypeReg && path.Clean(hdr.Name) == name {
+				return readCloser{tr, f.Close}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", p, os.ErrNotExist)
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error { return r.close() }
+
+// archiveFn wraps compareFn to also compare archive members, for -into-archives.
+// Members can't be removed, so a member is always kept in place of an identical real file,
+// and of two identical members the left one is kept.
+// Pairs of real files are passed to compareFn.
+func archiveFn(compareFn dup.CompareFuncContext[string]) dup.CompareFuncContext[string] {
+	return func(ctx context.Context, left, right string) (dup.Selection, error) {
+		_, _, leftMember := splitMember(left)
+		_, _, rightMember := splitMember(right)
+		if !leftMember && !rightMember {
+			return compareFn(ctx, left, right)
+		}
+		r1, err := openMember(left)
+		if err != nil {
+			return dup.None, &dup.OpenError{Item: dup.Left, Err: err}
+		}
+		defer r1.Close()
+		r2, err := openMember(right)
+		if err != nil {
+			return dup.None, &dup.OpenError{Item: dup.Right, Err: err}
+		}
+		defer r2.Close()
+		offset, err := dup.FirstDifference(ctx, r1, r2)
+		if err != nil || offset >= 0 {
+			return dup.None, err
+		}
+		dup.SetRule(ctx, ruleArchive)
+		if !leftMember {
+			return dup.Left, nil
+		}
+		return dup.Right, nil
+	}
+}
+
+// errInArchive is returned by skipArchived for duplicates that involve an archive member.
+var errInArchive = errors.New("duplicate involves an archive member")
+
+// skipArchived wraps h to refuse every duplicate that is, or is kept in favor of, an archive member:
+// members can't be removed in place, and a real file is only removed in favor of another real file,
+// so duplicates found in archives are only reported.
+func skipArchived(h handler) ruleFunc {
+	return func(file, keep string, rule dup.Rule) error {
+		if _, _, ok := splitMember(file); ok {
+			return errInArchive
+		}
+		if _, _, ok := splitMember(keep); ok {
+			return errInArchive
+		}
+		return handleSelected(h, file, keep, rule)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// inBaseline reports whether path is within the -baseline directory.
+func inBaseline(path string) bool {
+	if config.Baseline == "" {
+		return false
+	}
+	rel, err := filepath.Rel(config.Baseline, path)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// baselineFn wraps compareFn for -baseline: only pairs of one baseline file and one other file are compared,
+// and the baseline file is always kept.
+// Files outside the baseline are never duplicates of each other, and baseline files are never duplicates at all.
+func baselineFn(compareFn dup.CompareFuncContext[string]) dup.CompareFuncContext[string] {
+	return func(ctx context.Context, left, right string) (dup.Selection, error) {
+		leftBase, rightBase := inBaseline(left), inBaseline(right)
+		if leftBase == rightBase {
+			return dup.None, nil
+		}
+		sel, err := compareFn(ctx, left, right)
+		if err != nil || sel == dup.None {
+			return sel, err
+		}
+		dup.SetRule(ctx, ruleBaseline)
+		if leftBase {
+			return dup.Right, nil
+		}
+		return dup.Left, nil
+	}
+}
+
+// baselineLast orders bucket for -baseline so that each other file is compared as the left file
+// and matched at most once, against the first baseline file it duplicates.
+func baselineLast(a, b fileResult) int {
+	switch aBase, bBase := inBaseline(a.path), inBaseline(b.path); {
+	case aBase == bBase:
+		return 0
+	case aBase:
+		return 1
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// bufferCache holds the contents of small files in memory, for -compare-buffer-reuse,
+// so that a file compared with every other file of its bucket is only read once.
+// Buckets are compared one at a time and every file in a bucket has the same size,
+// so the cache only holds files of one size: asking for a file of another size empties it.
+type bufferCache struct {
+	mu sync.Mutex
+	// maxFile is the largest file that is cached, and maxTotal is the most bytes cached at once.
+	maxFile, maxTotal int64
+	size, total       int64
+	contents          map[string][]byte
+}
+
+func newBufferCache(maxFile, maxTotal int64) *bufferCache {
+	return &bufferCache{maxFile: maxFile, maxTotal: maxTotal, contents: make(map[string][]byte)}
+}
+
+// get returns the contents of the file at path, reading them into the cache if needed.
+// It returns false for files that are too large to cache or can't be read,
+// and once the cache is full; those are compared by streaming them as usual.
+func (c *bufferCache) get(path string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.contents[path]; ok {
+		return b, b != nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil, false
+	}
+	if fi.Size() != c.size {
+		clear(c.contents)
+		c.size, c.total = fi.Size(), 0
+	}
+	if fi.Size() > c.maxFile || c.total+fi.Size() > c.maxTotal {
+		// remembered so that the file isn't checked again for the rest of the bucket
+		c.contents[path] = nil
+		return nil, false
+	}
+	b, err := os.ReadFile(path)
+	if err != nil || int64(len(b)) != fi.Size() {
+		// the streaming comparison reports the error, or notices the file changed
+		return nil, false
+	}
+	c.contents[path] = b
+	c.total += int64(len(b))
+	return b, true
+}
+
+// bufferFn wraps compareFn to compare files that fit in cache in memory.
+// Files with different contents are told apart without any system calls once both are cached;
+// equal files are passed to selectFn, which must skip reading contents and only select the duplicate,
+// e.g. dup.NewFilenameFn with Options.AssumeEqual set.
+// If firstBytes is positive, only the first firstBytes bytes of the files are compared, like Options.FirstBytes.
+func bufferFn(compareFn, selectFn dup.CompareFuncContext[string], cache *bufferCache, firstBytes int64) dup.CompareFuncContext[string] {
+	return func(ctx context.Context, left, right string) (dup.Selection, error) {
+		if left == right {
+			return compareFn(ctx, left, right)
+		}
+		b1, ok1 := cache.get(left)
+		b2, ok2 := cache.get(right)
+		if !ok1 || !ok2 {
+			return compareFn(ctx, left, right)
+		}
+		if err := ctx.Err(); err != nil {
+			return dup.None, err
+		}
+		if firstBytes > 0 {
+			b1, b2 = b1[:min(int64(len(b1)), firstBytes)], b2[:min(int64(len(b2)), firstBytes)]
+		}
+		if !bytes.Equal(b1, b2) {
+			slog.Debug("buffered files differ", "left", left, "right", right)
+			return dup.None, nil
+		}
+		return selectFn(ctx, left, right)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// bucketComparisons counts the comparisons made for a single bucket by listComparisons.
+type bucketComparisons struct {
+	size       int64
+	files      int
+	compared   int
+	duplicates int
+}
+
+// possible is the number of comparisons of every pair of files in the bucket,
+// which is what the comparisons would cost without skipping any.
+func (b bucketComparisons) possible() int { return b.files * (b.files - 1) / 2 }
+
+// listComparisons compares the files of each bucket like handleBuckets, for -list-comparisons,
+// but instead of handling the duplicates it prints every comparison to w as it is made,
+// one per line with the result, followed by a line with the counts for the bucket.
+// Pairs that a previous match ruled out are never compared, so they aren't printed,
+// and the difference between the comparisons made and the possible comparisons is the work that was skipped.
+func listComparisons(ctx context.Context, w io.Writer, buckets <-chan []fileResult, compareFn dup.CompareFuncContext[string]) []bucketComparisons {
+	var counts []bucketComparisons
+	for bucket := range buckets {
+		b := bucketComparisons{size: bucket[0].size, files: len(bucket)}
+		cmp := func(ctx context.Context, left, right fileResult) (dup.Selection, error) {
+			b.compared++
+			sel, err := compareFn(ctx, left.path, right.path)
+			err = sizeChanged(left, right, err)
+			result := sel.String()
+			if err != nil {
+				result = "error: " + err.Error()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", left.path, right.path, result)
+			return sel, err
+		}
+		matches, err := dup.MatchesContext(ctx, bucket, cmp)
+		b.duplicates = len(matches)
+		if err != nil {
+			fmt.Fprintf(w, "# %v\n", err)
+		}
+		fmt.Fprintf(w, "# %d files of %s: %d of %d comparisons, %d duplicates\n\n", b.files, formatSize(b.size), b.compared, b.possible(), b.duplicates)
+		counts = append(counts, b)
+	}
+	return counts
+}
+
+// writeComparisonTotals writes the totals of counts to w.
+func writeComparisonTotals(w io.Writer, counts []bucketComparisons) {
+	var total bucketComparisons
+	var possible int
+	for _, b := range counts {
+		total.files += b.files
+		total.compared += b.compared
+		total.duplicates += b.duplicates
+		possible += b.possible()
+	}
+	fmt.Fprintf(w, "%d comparisons of %d possible in %d buckets of %d files; %d duplicates\n", total.compared, possible, len(counts), total.files, total.duplicates)
+}
@@ -0,0 +1,9 @@
+//go:build !(unix || windows)
+
+package main
+
+// isCrossDevice reports whether err is from linking or renaming across filesystems,
+// which can't be told apart from other errors here.
+func isCrossDevice(err error) bool {
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"slices"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// decompressedKey groups compressed files that might have the same contents once decompressed.
+type decompressedKey struct {
+	format string
+	size   int64
+}
+
+// takeCompressed removes every file that dup.Options.Decompress recognizes from buckets,
+// and returns them in new buckets grouped by format and decompressed size, in that order, sorted by path.
+// Files that can't be read are left where they were, to be compared as usual, as is every file once ctx is done.
+func takeCompressed(ctx context.Context, buckets map[int64][]fileResult) [][]fileResult {
+	grouped := make(map[decompressedKey][]fileResult)
+	for size, bucket := range buckets {
+		buckets[size] = slices.DeleteFunc(bucket, func(fr fileResult) bool {
+			format, n, err := dup.DecompressedSize(ctx, fr.path)
+			if ctx.Err() != nil {
+				return false
+			}
+			if err != nil {
+				slog.Error("unable to read compressed file; comparing it as is", "file", fr, "err", err)
+				return false
+			}
+			if format == "" {
+				return false
+			}
+			key := decompressedKey{format, n}
+			grouped[key] = append(grouped[key], fr)
+			return true
+		})
+	}
+	keys := make([]decompressedKey, 0, len(grouped))
+	for key := range grouped {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b decompressedKey) int {
+		if c := cmp.Compare(a.format, b.format); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.size, b.size)
+	})
+	compressed := make([][]fileResult, len(keys))
+	for i, key := range keys {
+		// the files come from buckets of different sizes, so there is no walk order to keep
+		compressed[i] = grouped[key]
+		slices.SortFunc(compressed[i], func(a, b fileResult) int { return cmp.Compare(a.path, b.path) })
+	}
+	return compressed
+}
@@ -0,0 +1,163 @@
+package dup
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+)
+
+// Compressed file formats recognized by Options.Decompress, by their leading bytes.
+const (
+	formatGzip = "gzip"
+	formatZip  = "zip"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// compression returns the compressed format of f, or "" if it isn't one that Options.Decompress recognizes.
+// The file offset is left unchanged.
+func compression(f *os.File) string {
+	head := make([]byte, len(zipMagic))
+	n, _ := f.ReadAt(head, 0)
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return formatGzip
+	case bytes.HasPrefix(head, zipMagic):
+		return formatZip
+	}
+	return ""
+}
+
+// DecompressedSize returns the compressed format of the file at path and the size of its contents once decompressed,
+// for grouping the files that Options.Decompress compares with each other.
+// The format is "gzip" or "zip", or "" with a size of 0 for any other file.
+//
+// A gzip file is decompressed to count its size, since its trailer only records the size of the last stream.
+// The size of a zip file is the total of the sizes its members declare.
+//
+// If ctx is cancelled early then DecompressedSize returns ctx.Err() before decompressing the whole file.
+// The file is closed on cancellation, the same as with FilenameFn.
+func DecompressedSize(ctx context.Context, path string) (format string, size int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	switch format = compression(f); format {
+	case formatGzip:
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return format, 0, err
+		}
+		stop := closeOnDone(ctx, f)
+		size, err = io.Copy(io.Discard, ctxReader{ctx, zr})
+		if !stop() {
+			return format, 0, ctx.Err()
+		}
+		return format, size, err
+	case formatZip:
+		zr, err := openZip(f)
+		if err != nil {
+			return format, 0, err
+		}
+		for _, m := range zr.File {
+			size += int64(m.UncompressedSize64)
+		}
+		return format, size, nil
+	}
+	return "", 0, nil
+}
+
+func openZip(f *os.File) (*zip.Reader, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(f, fi.Size())
+}
+
+// decompressedFn is filenameFn for two files compressed in format, which are compared by their decompressed contents.
+func decompressedFn(ctx context.Context, left, right string, f1, f2 *os.File, format string, opts Options) (Selection, error) {
+	if opts.CompareMode {
+		same, err := sameMode(f1, f2)
+		if !same || err != nil {
+			return None, err
+		}
+	}
+	if !opts.AssumeEqual {
+		stop := closeOnDone(ctx, f1, f2)
+		eq, err := equalDecompressed(ctx, format, f1, f2)
+		if !stop() {
+			return None, ctx.Err()
+		}
+		if !eq || err != nil {
+			return None, err
+		}
+	}
+	return selectEqual(ctx, left, right, f1, f2, opts)
+}
+
+// equalDecompressed reports whether f1 and f2, both compressed in format, have the same decompressed contents.
+// Zip files are equal when they have the same members, with the same names and contents, in the same order.
+func equalDecompressed(ctx context.Context, format string, f1, f2 *os.File) (bool, error) {
+	switch format {
+	case formatGzip:
+		zr1, err := gzip.NewReader(f1)
+		if err != nil {
+			return false, err
+		}
+		zr2, err := gzip.NewReader(f2)
+		if err != nil {
+			return false, err
+		}
+		offset, err := FirstDifference(ctx, zr1, zr2)
+		return offset < 0 && err == nil, err
+	case formatZip:
+		zr1, err := openZip(f1)
+		if err != nil {
+			return false, err
+		}
+		zr2, err := openZip(f2)
+		if err != nil {
+			return false, err
+		}
+		if len(zr1.File) != len(zr2.File) {
+			return false, nil
+		}
+		for i, m1 := range zr1.File {
+			m2 := zr2.File[i]
+			if m1.Name != m2.Name || m1.UncompressedSize64 != m2.UncompressedSize64 {
+				return false, nil
+			}
+			eq, err := equalMembers(ctx, m1, m2)
+			if !eq || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	return false, errors.New("unrecognized compressed format " + format)
+}
+
+func equalMembers(ctx context.Context, m1, m2 *zip.File) (bool, error) {
+	r1, err := m1.Open()
+	if err != nil {
+		return false, err
+	}
+	defer r1.Close()
+	r2, err := m2.Open()
+	if err != nil {
+		return false, err
+	}
+	defer r2.Close()
+	offset, err := FirstDifference(ctx, r1, r2)
+	return offset < 0 && err == nil, err
+}
@@ -0,0 +1,1131 @@
+// Package dup contains functions for finding duplicate files.
+package dup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Travis-Britz/dedup/internal/fileid"
+)
+
+func Indexes[T any](input []T, compareFn CompareFunc[T]) ([]int, error) {
+	fn := func(_ context.Context, left, right T) (Selection, error) {
+		return compareFn(left, right)
+	}
+	return IndexesContext(context.Background(), input, fn)
+}
+
+// SkipRemaining can be returned by a comparison function, or wrapped in its error,
+// to stop comparing the rest of the input, e.g. once a time budget is spent.
+// The pair that returned it counts as not duplicates, and no more pairs are compared.
+// IndexesContext and the Matches functions then return the duplicates found so far along with ErrIncomplete.
+var SkipRemaining = errors.New("skip remaining")
+
+// ErrIncomplete is returned by IndexesContext and the Matches functions when the comparison function
+// returned SkipRemaining before every pair of items was compared.
+var ErrIncomplete = errors.New("not every pair of items was compared")
+
+// IndexesContext returns a slice of indexes from input that contain duplicate items as determined by compareFn.
+// If compareFn returns SkipRemaining, the duplicates found up to then are returned with ErrIncomplete.
+//
+// Results are returned in O(n^2) time
+func IndexesContext[T any](ctx context.Context, input []T, compareFn CompareFuncContext[T]) (duplicates []int, err error) {
+	matches, complete := compareAll(ctx, input, compareFn)
+	return indexesOf(resolveKeep(matches), complete)
+}
+
+// indexesOf returns the Dup of each of matches, and ErrIncomplete if they aren't complete.
+func indexesOf(matches []Match, complete bool) (duplicates []int, err error) {
+	for _, m := range matches {
+		duplicates = append(duplicates, m.Dup)
+	}
+	if !complete {
+		return duplicates, ErrIncomplete
+	}
+	return duplicates, nil
+}
+
+// Match is a duplicate found by MatchesContext.
+// Dup and Keep are indexes into the input slice.
+type Match struct {
+	// Dup is the index of the duplicate item.
+	Dup int
+	// Keep is the index of the item that Dup duplicates.
+	// It is never the Dup of another Match from the same call.
+	Keep int
+	// Rule is the rule that selected Dup as the duplicate in its comparison,
+	// as reported by the comparison function with SetRule, or empty if it reported none.
+	Rule Rule
+}
+
+// DupContext describes a duplicate passed to an OnDuplicate callback.
+type DupContext[T any] struct {
+	// Dup is the duplicate item and Keep is the item kept in its place.
+	Dup, Keep T
+	// Match holds the indexes of Dup and Keep in the input.
+	Match Match
+}
+
+// OnDuplicate is called by MatchesFunc for each duplicate found.
+type OnDuplicate[T any] func(DupContext[T])
+
+// MatchesFunc is like MatchesContext, but passes each duplicate to onDuplicate instead of returning them,
+// so that programs embedding dup can react to duplicates without collecting them first.
+//
+// onDuplicate is called on the calling goroutine, never concurrently,
+// in the same order that MatchesContext would return the matches.
+// Because a kept item may turn out to be a duplicate of a later item,
+// the calls are made once every comparison for input has finished, so that Keep is final.
+//
+// If compareFn returns SkipRemaining, only the duplicates found up to then are passed to onDuplicate,
+// and MatchesFunc returns ErrIncomplete once it has passed them all. Otherwise it returns nil.
+func MatchesFunc[T any](ctx context.Context, input []T, compareFn CompareFuncContext[T], onDuplicate OnDuplicate[T]) error {
+	matches, complete := compareAll(ctx, input, compareFn)
+	for _, m := range resolveKeep(matches) {
+		onDuplicate(DupContext[T]{Dup: input[m.Dup], Keep: input[m.Keep], Match: m})
+	}
+	if !complete {
+		return ErrIncomplete
+	}
+	return nil
+}
+
+// MatchesContext is like IndexesContext, but also reports which item is kept in place of each duplicate.
+//
+// When a duplicate's original is later found to be a duplicate itself,
+// Keep follows the chain to the item that was not selected as a duplicate,
+// so every Match for a set of identical items shares the same Keep.
+//
+// When compareFn returns an *OpenError, the item that couldn't be opened
+// is left out of every remaining comparison.
+// The same goes for an *OpenError wrapping ErrSizeChanged, for an item that changed during the run.
+//
+// If compareFn returns SkipRemaining, the matches found up to then are returned with ErrIncomplete.
+func MatchesContext[T any](ctx context.Context, input []T, compareFn CompareFuncContext[T]) (matches []Match, err error) {
+	err = MatchesFunc(ctx, input, compareFn, func(d DupContext[T]) {
+		matches = append(matches, d.Match)
+	})
+	return matches, err
+}
+
+// Progress is called by MatchesProgress after each comparison with the number of pairs of items done so far,
+// either compared or ruled out by an earlier result, out of the total number of pairs.
+type Progress func(done, total int)
+
+// MatchesProgress is like MatchesContext, but calls progress after each comparison, e.g. to draw a progress bar.
+// progress is called on the calling goroutine, and a final time with done equal to total once every pair is done.
+// If compareFn returns SkipRemaining, there is no final call, since the rest of the pairs are never done,
+// and the matches found up to then are returned with ErrIncomplete.
+func MatchesProgress[T any](ctx context.Context, input []T, compareFn CompareFuncContext[T], progress Progress) ([]Match, error) {
+	n := len(input)
+	total := (n*n - n) / 2
+	// done counts the pairs in the rows before row, which were all compared or ruled out
+	var row, done int
+	matches, complete := matchAll(input, func(r, col int) (outcome, Rule) {
+		for ; row < r; row++ {
+			done += n - 1 - row
+		}
+		o, rule := compareAt(ctx, input, compareFn, r, col)
+		progress(done+col-r, total)
+		return o, rule
+	})
+	if !complete {
+		return resolveKeep(matches), ErrIncomplete
+	}
+	progress(total, total)
+	return resolveKeep(matches), nil
+}
+
+// compareAll compares every pair of items in input, returning each duplicate with the item it was compared against.
+// complete is false if compareFn returned SkipRemaining.
+func compareAll[T any](ctx context.Context, input []T, compareFn CompareFuncContext[T]) (matches []Match, complete bool) {
+	return matchAll(input, func(row, col int) (outcome, Rule) {
+		return compareAt(ctx, input, compareFn, row, col)
+	})
+}
+
+// outcome is the result of comparing two items of the input, as seen by matchAll.
+type outcome uint8
+
+const (
+	notCompared outcome = iota
+	outcomeNone
+	outcomeLeft
+	outcomeRight
+	// outcomeOpenLeft and outcomeOpenRight mean that the left or right item couldn't be opened.
+	outcomeOpenLeft
+	outcomeOpenRight
+	// outcomeFailed is any other comparison error.
+	outcomeFailed
+	// outcomeSkip means that the comparison returned SkipRemaining.
+	outcomeSkip
+)
+
+// compareAt compares input[row] with input[col], logging the result,
+// and returns the rule that compareFn reported for its selection, if any.
+func compareAt[T any](ctx context.Context, input []T, compareFn CompareFuncContext[T], row, col int) (outcome, Rule) {
+	var rule Rule
+	dup, err := compareFn(WithRule(ctx, &rule), input[row], input[col])
+	o := outcomeOf(input, row, col, dup, err)
+	if o != outcomeLeft && o != outcomeRight {
+		rule = ""
+	}
+	return o, rule
+}
+
+// outcomeOf turns the result of comparing input[row] with input[col] into an outcome, logging it.
+func outcomeOf[T any](input []T, row, col int, dup Selection, err error) outcome {
+	if errors.Is(err, SkipRemaining) {
+		slog.Info("skipping remaining comparisons", "left", input[row], "right", input[col])
+		return outcomeSkip
+	}
+	var openErr *OpenError
+	if errors.As(err, &openErr) {
+		i, o := row, outcomeOpenLeft
+		if openErr.Item == Right {
+			i, o = col, outcomeOpenRight
+		}
+		if errors.Is(openErr.Err, ErrSizeChanged) {
+			slog.Warn("changed size during the run; skipping remaining comparisons", "item", input[i])
+			return o
+		}
+		slog.Error("unable to open; skipping remaining comparisons",
+			"item", input[i],
+			"err", openErr.Err,
+		)
+		return o
+	}
+	if err != nil {
+		slog.Error("comparison failure",
+			"left", input[row],
+			"right", input[col],
+			"err", err,
+		)
+		return outcomeFailed
+	}
+	slog.Info("comparison",
+		"left", input[row],
+		"right", input[col],
+		"duplicate", dup.String(),
+	)
+	switch dup {
+	case None:
+		return outcomeNone
+	case Left:
+		return outcomeLeft
+	case Right:
+		return outcomeRight
+	default:
+		panic(fmt.Sprintf("invalid selection option %d", dup))
+	}
+}
+
+// matchAll walks every pair of items in input in order, calling compare with the indexes of each pair
+// that isn't ruled out by an earlier result, and returns each duplicate with the item it was compared against
+// and the rule compare returned for it.
+// It stops early, with complete set to false, when compare returns outcomeSkip.
+func matchAll[T any](input []T, compare func(row, col int) (outcome, Rule)) (matches []Match, complete bool) {
+	n := len(input)
+	size := (n*n - n) / 2
+	skipMatrix := make([]bool, size)
+	unreadable := make([]bool, n)
+
+	for row := 0; row < n-1; row++ {
+		if unreadable[row] {
+			continue
+		}
+		for col := row + 1; col < n; col++ {
+			if unreadable[row] {
+				break
+			}
+			if unreadable[col] {
+				continue
+			}
+			// a previous duplicate match  means we can skip this comparison
+			if skipMatrix[Offset(n, row, col)] {
+				slog.Debug("skipping comparison",
+					"left", input[row],
+					"right", input[col],
+				)
+				continue
+			}
+
+			o, rule := compare(row, col)
+			switch o {
+			case outcomeSkip:
+				return matches, false
+			case outcomeOpenLeft:
+				unreadable[row] = true
+			case outcomeOpenRight:
+				unreadable[col] = true
+			case outcomeLeft: // when the first arg given to selectDup was decided to be the duplicate file
+				for c := col + 1; c < n; c++ {
+					skipMatrix[Offset(n, row, c)] = true
+				}
+				matches = append(matches, Match{Dup: row, Keep: col, Rule: rule})
+			case outcomeRight: // when the second arg given to selectDup was decided to be the duplicate file
+				for r, c := col, col+1; c < n; c++ {
+					skipMatrix[Offset(n, r, c)] = true
+				}
+				matches = append(matches, Match{Dup: col, Keep: row, Rule: rule})
+			}
+		}
+	}
+	return matches, true
+}
+
+// resolveKeep updates the Keep of each match to the end of its chain of duplicates.
+func resolveKeep(matches []Match) []Match {
+	keepOf := make(map[int]int, len(matches))
+	for _, m := range matches {
+		keepOf[m.Dup] = m.Keep
+	}
+	for i, m := range matches {
+		// the step limit guards against a cycle, which comparison errors could theoretically produce
+		for steps := 0; steps < len(matches); steps++ {
+			next, isDup := keepOf[m.Keep]
+			if !isDup {
+				break
+			}
+			m.Keep = next
+		}
+		matches[i] = m
+	}
+	return matches
+}
+
+// OpenError is returned by a comparison function when one of the items could not be opened.
+// Item is Left or Right, matching the argument that failed.
+type OpenError struct {
+	Item Selection
+	Err  error
+}
+
+func (e *OpenError) Error() string { return "open " + e.Item.String() + ": " + e.Err.Error() }
+func (e *OpenError) Unwrap() error { return e.Err }
+
+type CompareFunc[T any] func(T, T) (Selection, error)
+type CompareFuncContext[T any] func(context.Context, T, T) (Selection, error)
+
+type ruleKey struct{}
+
+// WithRule returns a copy of ctx to pass to a comparison function,
+// in which SetRule stores the rule behind the function's selection into *rule.
+// IndexesContext and the Matches functions do this for every comparison to fill in Match.Rule.
+func WithRule(ctx context.Context, rule *Rule) context.Context {
+	return context.WithValue(ctx, ruleKey{}, rule)
+}
+
+// SetRule reports rule as the rule that decided the selection of the comparison function that ctx was passed to.
+// It does nothing unless ctx comes from WithRule.
+//
+// The comparison functions of this package report the rule of their selection heuristics.
+// A function that wraps one of them and overrides its selection should report its own rule afterwards,
+// so that the rule always describes the selection that was returned.
+func SetRule(ctx context.Context, rule Rule) {
+	if r, ok := ctx.Value(ruleKey{}).(*Rule); ok {
+		*r = rule
+	}
+}
+
+// Selection is the result of comparing two items: which of them, if either, is a duplicate of the other.
+type Selection uint8
+
+const (
+	None Selection = iota
+	Left
+	Right
+)
+
+func (s Selection) String() string {
+	switch s {
+	case None:
+		return "None"
+	case Left:
+		return "Left"
+	case Right:
+		return "Right"
+	default:
+		return fmt.Sprintf("invalid selection (%d)", s)
+	}
+}
+
+// FilenameFn is used with IndexesContext to compare two files by their full file path,
+// using os.Open to read and compare the contents of each file.
+//
+// If ctx is cancelled early then comparison will return early with ctx.Err().
+// Both files are closed on cancellation so that a read blocked on a slow disk or pipe returns right away,
+// where the platform allows it; otherwise comparison returns once the current read finishes.
+// More bytes may have been read by the internal buffer than were compared.
+//
+// selection will always be None when err is not nil.
+func FilenameFn(ctx context.Context, left, right string) (selection Selection, err error) {
+	return filenameFn(ctx, left, right, Options{})
+}
+
+// Options changes the behavior of comparison functions created by NewFilenameFn.
+// The zero value behaves the same as FilenameFn.
+type Options struct {
+	// AllowEmpty allows zero-byte files to be selected as duplicates of each other.
+	AllowEmpty bool
+	// Tie decides the selection when no heuristic can tell two identical files apart.
+	Tie Tie
+	// CompareMode requires the permission bits and owner (where the platform has one) of two files to match
+	// for them to be considered duplicates.
+	CompareMode bool
+	// AssumeEqual skips reading file contents and trusts that the files are identical,
+	// e.g. because they were already compared by a previous run.
+	// Only the selection heuristics are applied.
+	AssumeEqual bool
+	// FirstBytes, when positive, compares only the first FirstBytes bytes of each file.
+	// Files of the same size that differ after that are wrongly considered duplicates,
+	// so this is only safe for data where that is known not to happen.
+	FirstBytes int64
+	// KeepPattern, when not nil, is matched against the full path of both files.
+	// If it matches exactly one of them, that file is kept, before any other heuristic is applied.
+	KeepPattern *regexp.Regexp
+	// Keep chooses which file to keep by modification time or path length,
+	// before any heuristic other than KeepPattern is applied.
+	// When it can't tell the files apart, e.g. because their paths are as long as each other, the usual heuristics decide.
+	Keep KeepPolicy
+	// PreferNewest keeps the file with the latest modification time,
+	// before any heuristic other than KeepPattern is applied.
+	PreferNewest bool
+	// PreferCleanName keeps the file whose name has no copy markers, as judged by CleanName,
+	// before any heuristic other than KeepPattern and PreferNewest is applied.
+	// When both or neither of the names are clean, the usual heuristics decide.
+	PreferCleanName bool
+	// PreferSmallAlloc keeps the file with less disk space allocated to it when no other heuristic can tell
+	// two files apart, before Tie applies. On filesystems with compression or shared blocks,
+	// such as Btrfs, ZFS, and APFS, that is the file that is cheaper to keep.
+	// It has no effect on platforms where fileid.Allocated isn't supported.
+	PreferSmallAlloc bool
+	// ModTimeTolerance is how far apart the modification times of two files can be
+	// and still count as the same time, for both PreferNewest and the modification time heuristic,
+	// e.g. to ignore the rounding of copy tools and filesystems with coarse timestamps.
+	ModTimeTolerance time.Duration
+	// Decompress compares two gzip files, or two zip files, by their decompressed contents,
+	// so that copies compressed at different levels are duplicates even though their sizes differ.
+	// Zip files must have the same members in the same order. Any other pair of files is compared as usual.
+	Decompress bool
+	// ReportDifference logs the offset of the first differing byte of files that are not equal,
+	// at info level, to help explain near-duplicates such as logs that share a long prefix.
+	ReportDifference bool
+}
+
+// KeepPolicy is a policy for which of two identical files to keep, for Options.Keep.
+type KeepPolicy uint8
+
+const (
+	// KeepHeuristic leaves the choice to the usual heuristics based on names. This is the default.
+	KeepHeuristic KeepPolicy = iota
+	// KeepOldest keeps the file with the earliest modification time.
+	KeepOldest
+	// KeepNewest keeps the file with the latest modification time, like Options.PreferNewest.
+	KeepNewest
+	// KeepShortestPath keeps the file with the shortest path.
+	KeepShortestPath
+	// KeepLongestPath keeps the file with the longest path.
+	KeepLongestPath
+)
+
+// Tie is a policy for identical files that no selection heuristic can tell apart,
+// e.g. files with the same name structure and modification time.
+type Tie uint8
+
+const (
+	// TieKeepLeft selects the right file as the duplicate. This is the default.
+	TieKeepLeft Tie = iota
+	// TieKeepRight selects the left file as the duplicate.
+	TieKeepRight
+	// TieKeepBoth logs the pair as an ambiguous duplicate and selects neither.
+	TieKeepBoth
+	// TieError selects neither and returns an error wrapping ErrTie.
+	TieError
+)
+
+// ErrTie is returned when no heuristic could choose between two identical files and Options.Tie is TieError.
+var ErrTie = errors.New("identical files could not be told apart")
+
+// errKeepBoth is returned by selectDup for TieKeepBoth so that filenameFn can report the pair.
+var errKeepBoth = errors.New("keep both")
+
+// NewFilenameFn returns a function that compares files the same way as FilenameFn,
+// modified by opts.
+func NewFilenameFn(opts Options) CompareFuncContext[string] {
+	return func(ctx context.Context, left, right string) (Selection, error) {
+		return filenameFn(ctx, left, right, opts)
+	}
+}
+
+// SelectRule applies only the selection heuristics of a function from NewFilenameFn to the files at left and right,
+// as if their contents were equal, and returns the selection along with the rule that made it.
+// File contents are not read.
+func SelectRule(left, right string, opts Options) (Selection, Rule, error) {
+	f1, err := os.Open(left)
+	if err != nil {
+		return None, "", &OpenError{Item: Left, Err: err}
+	}
+	defer f1.Close()
+	f2, err := os.Open(right)
+	if err != nil {
+		return None, "", &OpenError{Item: Right, Err: err}
+	}
+	defer f2.Close()
+
+	sel, rule, err := selectDup(left, right, f1, f2, opts)
+	if errors.Is(err, errKeepBoth) {
+		return None, rule, nil
+	}
+	return sel, rule, err
+}
+
+func filenameFn(ctx context.Context, left, right string, opts Options) (Selection, error) {
+	if left == right {
+		return None, errSameItem
+	}
+
+	f1, err := os.Open(left)
+	if err != nil {
+		return None, &OpenError{Item: Left, Err: err}
+	}
+	defer f1.Close()
+	f2, err := os.Open(right)
+	if err != nil {
+		return None, &OpenError{Item: Right, Err: err}
+	}
+	defer f2.Close()
+
+	// hard links to the same file share their contents, and handling either one reclaims nothing
+	if same, err := sameFile(f1, f2); same || err != nil {
+		if same {
+			slog.Debug("files are already hard links to each other", "left", left, "right", right)
+		}
+		return None, err
+	}
+
+	if opts.Decompress {
+		format1, format2 := compression(f1), compression(f2)
+		if format1 != "" && format2 != "" {
+			if format1 != format2 {
+				return None, nil
+			}
+			return decompressedFn(ctx, left, right, f1, f2, format1, opts)
+		}
+	}
+
+	if changed, err := sizesDiffer(f1, f2); changed || err != nil {
+		if changed {
+			slog.Debug("file size changed before comparison", "left", left, "right", right)
+			err = ErrSizeChanged
+		}
+		return None, err
+	}
+
+	if opts.CompareMode {
+		same, err := sameMode(f1, f2)
+		if !same || err != nil {
+			return None, err
+		}
+	}
+
+	if !opts.AssumeEqual {
+		stop := closeOnDone(ctx, f1, f2)
+		var r1, r2 io.Reader = f1, f2
+		if opts.FirstBytes > 0 {
+			r1, r2 = io.LimitReader(f1, opts.FirstBytes), io.LimitReader(f2, opts.FirstBytes)
+		}
+		if opts.ReportDifference {
+			offset, err := FirstDifference(ctx, r1, r2)
+			if !stop() {
+				return None, ctx.Err()
+			}
+			if err != nil {
+				return None, err
+			}
+			if offset >= 0 {
+				slog.Info("files differ", "left", left, "right", right, "offset", offset)
+				return None, nil
+			}
+		} else {
+			eq, err := equalFile(ctx, r1, r2)
+			if !stop() {
+				return None, ctx.Err()
+			}
+			if !eq || err != nil {
+				return None, err
+			}
+		}
+	}
+
+	return selectEqual(ctx, left, right, f1, f2, opts)
+}
+
+// selectEqual applies selectDup to two files whose contents are equal, logging the result
+// and reporting the rule with SetRule.
+func selectEqual(ctx context.Context, left, right string, f1, f2 fs.File, opts Options) (Selection, error) {
+	sel, rule, err := selectDup(left, right, f1, f2, opts)
+	slog.Debug("selection", "left", left, "right", right, "selection", sel, "rule", rule)
+	SetRule(ctx, rule)
+	if errors.Is(err, errKeepBoth) {
+		slog.Warn("ambiguous duplicate; keeping both", "left", left, "right", right)
+		return None, nil
+	}
+	return sel, err
+}
+
+var errSameItem = errors.New("comparing item with itself")
+
+// ErrSizeChanged is returned by FilenameFn when the two files no longer have the same size,
+// which happens when one of them is written to after the files were grouped by size.
+// The selection is None, and nothing was read.
+var ErrSizeChanged = errors.New("file size changed")
+
+// closeOnDone closes files as soon as ctx is done, which unblocks any read from them that is in progress.
+// stop must be called once the files are no longer being read; it returns false if they were already closed.
+func closeOnDone(ctx context.Context, files ...*os.File) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		for _, f := range files {
+			f.Close()
+		}
+	})
+}
+
+// CompareFile compares the contents of the files at paths a and b.
+// When the contents are equal, keep is whichever of a or b is considered the original
+// by the same heuristics used to select duplicates in FilenameFn.
+//
+// Files of different sizes are simply not equal.
+// err is non-nil when a and b are the same path, when either file cannot be opened
+// (e.g. it does not exist), or when either path is a directory.
+// equal will always be false and keep will always be empty when err is not nil.
+func CompareFile(ctx context.Context, a, b string) (equal bool, keep string, err error) {
+	// FilenameFn expects files of the same size, as in a bucket, but callers of CompareFile don't have to
+	var sizes [2]int64
+	for i, path := range []string{a, b} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return false, "", err
+		}
+		if fi.IsDir() {
+			return false, "", fmt.Errorf("%s is a directory", path)
+		}
+		sizes[i] = fi.Size()
+	}
+	if sizes[0] != sizes[1] {
+		return false, "", nil
+	}
+	sel, err := FilenameFn(ctx, a, b)
+	if err != nil {
+		return false, "", err
+	}
+	switch sel {
+	case Left:
+		return true, b, nil
+	case Right:
+		return true, a, nil
+	default:
+		return false, "", nil
+	}
+}
+
+// bufSize should be large enough to reduce head thrashing on spinning disks,
+// but small enough to exit quickly on comparison failure while keeping memory usage reasonable.
+const bufSize = 4096 * 4000
+
+// chunkSize is how many bytes are compared at a time out of each buffered reader.
+const chunkSize = 4096
+
+// readerPools and chunkPool let comparisons reuse their buffers instead of allocating ~32MB per call.
+// Memory use is bounded by the number of comparisons running at the same time rather than the number of comparisons made,
+// and readerSize shrinks the buffers as that number grows.
+var (
+	readerPool = sync.Pool{New: func() any { return bufio.NewReaderSize(nil, bufSize) }}
+	// readerPools holds a *sync.Pool of *bufio.Reader for each other size returned by readerSize.
+	readerPools sync.Map
+	chunkPool   = sync.Pool{New: func() any { b := make([]byte, chunkSize); return &b }}
+)
+
+type concurrencyKey struct{}
+
+// withConcurrency records in ctx that up to n comparisons run at the same time,
+// so that together they read with about as much buffer memory as a single comparison.
+func withConcurrency(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, concurrencyKey{}, n)
+}
+
+// readerSize returns the size of each of the two buffered readers of a comparison made with ctx:
+// bufSize, split between the comparisons that run at the same time, but never less than chunkSize.
+func readerSize(ctx context.Context) int {
+	n, _ := ctx.Value(concurrencyKey{}).(int)
+	return max(bufSize/max(n, 1), chunkSize)
+}
+
+// pooledReaders returns buffered readers over r1 and r2 from the pool for readerSize(ctx),
+// and a function that returns them to it.
+func pooledReaders(ctx context.Context, r1, r2 io.Reader) (br1, br2 *bufio.Reader, release func()) {
+	pool := &readerPool
+	if size := readerSize(ctx); size != bufSize {
+		p, ok := readerPools.Load(size)
+		if !ok {
+			p, _ = readerPools.LoadOrStore(size, &sync.Pool{New: func() any { return bufio.NewReaderSize(nil, size) }})
+		}
+		pool = p.(*sync.Pool)
+	}
+	br1, br2 = pool.Get().(*bufio.Reader), pool.Get().(*bufio.Reader)
+	br1.Reset(r1)
+	br2.Reset(r2)
+	return br1, br2, func() {
+		// drop the file references so pooled readers don't keep closed files reachable
+		br1.Reset(nil)
+		br2.Reset(nil)
+		pool.Put(br1)
+		pool.Put(br2)
+	}
+}
+
+func equalFile(ctx context.Context, f1, f2 io.Reader) (bool, error) {
+	br1, br2, release := pooledReaders(ctx, f1, f2)
+	defer release()
+
+	b1 := chunkPool.Get().(*[]byte)
+	b2 := chunkPool.Get().(*[]byte)
+	defer chunkPool.Put(b1)
+	defer chunkPool.Put(b2)
+	buf1, buf2 := *b1, *b2
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		default:
+		}
+
+		n1, err1 := br1.Read(buf1)
+
+		n2, err2 := io.ReadFull(br2, buf2[:n1])
+
+		if n1 != n2 {
+			return false, fmt.Errorf("read size mismatch: %w", errors.Join(err1, err2))
+		}
+
+		if !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false, nil
+		}
+
+		// two identical files should reach EOF at the same time
+		if err1 == io.EOF {
+			// io.ReadFull returns 0,nil if length of buf was 0.
+			// length of buf should only be 0 if n1 was 0.
+			if n1 == 0 && n2 == 0 && err2 == nil {
+				return true, nil
+			}
+
+			// I don't think this case would trigger unless the underlying io.Reader returned bytes along with EOF on the last call?
+			if err2 == io.EOF {
+				_, sourceFile, sourceLine, ok := runtime.Caller(0)
+				if ok {
+					slog.Debug("unexpected condition reached", "source_file", sourceFile, "line", sourceLine)
+				} else {
+					slog.Debug("unexpected condition reached", "ctrl_f", "deaedc27-fee9-468f-9d0f-0efff8bee79e")
+				}
+				return true, nil
+			}
+		}
+
+		// any errors that aren't EOF are a comparison failure
+		if err1 != nil || err2 != nil {
+			return false, fmt.Errorf("n1=%d, n2=%d, reader 1 error: %w, reader 2 error: %w; ", n1, n2, err1, err2)
+		}
+	}
+}
+
+// FirstDifference returns the offset of the first byte that differs between r1 and r2,
+// or -1 if they have the same contents.
+// When one is a prefix of the other, the offset is the length of the shorter one.
+//
+// It reads both in chunks the same way as FilenameFn, so finding the offset costs no more than comparing.
+func FirstDifference(ctx context.Context, r1, r2 io.Reader) (int64, error) {
+	br1, br2, release := pooledReaders(ctx, r1, r2)
+	defer release()
+
+	b1 := chunkPool.Get().(*[]byte)
+	b2 := chunkPool.Get().(*[]byte)
+	defer chunkPool.Put(b1)
+	defer chunkPool.Put(b2)
+	buf1, buf2 := *b1, *b2
+
+	var offset int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		n1, err1 := io.ReadFull(br1, buf1)
+		n2, err2 := io.ReadFull(br2, buf2)
+		for i := range min(n1, n2) {
+			if buf1[i] != buf2[i] {
+				return offset + int64(i), nil
+			}
+		}
+		if n1 != n2 {
+			return offset + int64(min(n1, n2)), nil
+		}
+		offset += int64(n1)
+
+		done1 := errors.Is(err1, io.EOF) || errors.Is(err1, io.ErrUnexpectedEOF)
+		done2 := errors.Is(err2, io.EOF) || errors.Is(err2, io.ErrUnexpectedEOF)
+		if err1 != nil && !done1 {
+			return 0, err1
+		}
+		if err2 != nil && !done2 {
+			return 0, err2
+		}
+		if done1 && done2 {
+			return -1, nil
+		}
+		if done1 || done2 {
+			// equal chunks, but only one reader ended
+			return offset, nil
+		}
+	}
+}
+
+// sameMode reports whether f1 and f2 have the same permission bits and owner.
+func sameMode(f1, f2 fs.File) (bool, error) {
+	fi1, err := f1.Stat()
+	if err != nil {
+		return false, err
+	}
+	fi2, err := f2.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi1.Mode().Perm() != fi2.Mode().Perm() {
+		return false, nil
+	}
+	uid1, gid1, ok1 := fileid.Owner(fi1)
+	uid2, gid2, ok2 := fileid.Owner(fi2)
+	if ok1 != ok2 || uid1 != uid2 || gid1 != gid2 {
+		return false, nil
+	}
+	return true, nil
+}
+
+func Offset(n, row, col int) int {
+	// n*row+col
+	return (n*row + col) - (((row+1)*(row+1)-(row+1))/2 + row + 1)
+}
+
+// Rule names the heuristic that decided which of two identical files is the duplicate.
+type Rule string
+
+// The rules are tried in this order until one of them can tell the files apart.
+const (
+	RuleKeepPattern Rule = "keep pattern"
+	RuleOldest      Rule = "oldest"
+	RuleNewest      Rule = "newest"
+	RulePathLength  Rule = "path length"
+	RuleCleanName   Rule = "clean name"
+	RuleCopyCounter Rule = "copy counter"
+	RuleExtension   Rule = "extension"
+	RuleDigits      Rule = "numeric name"
+	RuleModTime     Rule = "modification time"
+	RuleAllocation  Rule = "allocation"
+	RuleTie         Rule = "tie"
+)
+
+// selectDup decides which is considered a duplicate based on a set of heuristics,
+// and reports which rule decided.
+// left and right are the paths f1 and f2 were opened with.
+func selectDup(left, right string, f1, f2 fs.File, opts Options) (Selection, Rule, error) {
+	fi1, err := f1.Stat()
+	if err != nil {
+		return None, "", err
+	}
+	fi2, err := f2.Stat()
+	if err != nil {
+		return None, "", err
+	}
+	if fi1.Size() != fi2.Size() && !opts.Decompress {
+		return None, "", errImpossible{errors.New("comparison on differently sized files")}
+	}
+	if !opts.AllowEmpty && (fi1.Size() == 0 || fi2.Size() == 0) {
+		return None, "", errImpossible{errors.New("duplicate selection on empty files")}
+	}
+	if fi1.IsDir() || fi2.IsDir() {
+		return None, "", errImpossible{errors.New("duplicate comparison contained a directory")}
+	}
+	if isSymlink(fi1) || isSymlink(fi2) {
+		return None, "", errImpossible{errors.New("duplicate comparison contained a symlink")}
+	}
+
+	if opts.KeepPattern != nil {
+		keepLeft, keepRight := opts.KeepPattern.MatchString(left), opts.KeepPattern.MatchString(right)
+		if keepLeft && !keepRight {
+			return Right, RuleKeepPattern, nil
+		}
+		if !keepLeft && keepRight {
+			return Left, RuleKeepPattern, nil
+		}
+	}
+
+	mtime := compareModTime(fi1.ModTime(), fi2.ModTime(), opts.ModTimeTolerance)
+
+	switch opts.Keep {
+	case KeepOldest:
+		if mtime < 0 {
+			return Right, RuleOldest, nil
+		}
+		if mtime > 0 {
+			return Left, RuleOldest, nil
+		}
+	case KeepNewest:
+		if mtime > 0 {
+			return Right, RuleNewest, nil
+		}
+		if mtime < 0 {
+			return Left, RuleNewest, nil
+		}
+	case KeepShortestPath, KeepLongestPath:
+		if d := len(left) - len(right); d != 0 {
+			if (d < 0) == (opts.Keep == KeepShortestPath) {
+				return Right, RulePathLength, nil
+			}
+			return Left, RulePathLength, nil
+		}
+	}
+
+	if opts.PreferNewest {
+		if mtime > 0 {
+			return Right, RuleNewest, nil
+		}
+		if mtime < 0 {
+			return Left, RuleNewest, nil
+		}
+	}
+
+	if opts.PreferCleanName {
+		clean1, clean2 := CleanName(fi1.Name()), CleanName(fi2.Name())
+		if clean1 && !clean2 {
+			return Right, RuleCleanName, nil
+		}
+		if !clean1 && clean2 {
+			return Left, RuleCleanName, nil
+		}
+	}
+
+	f1BaseName, f1Counter, f1Ext := SplitFileBaseName(fi1.Name())
+	f2BaseName, f2Counter, f2Ext := SplitFileBaseName(fi2.Name())
+
+	if f1Counter > f2Counter {
+		return Left, RuleCopyCounter, nil
+	}
+	if f1Counter < f2Counter {
+		return Right, RuleCopyCounter, nil
+	}
+
+	if f1Ext != "" && f2Ext == "" {
+		return Right, RuleExtension, nil
+	}
+	if f1Ext == "" && f2Ext != "" {
+		return Left, RuleExtension, nil
+	}
+
+	if isDigits(f1BaseName) && !isDigits(f2BaseName) {
+		return Left, RuleDigits, nil
+	}
+	if !isDigits(f1BaseName) && isDigits(f2BaseName) {
+		return Right, RuleDigits, nil
+	}
+
+	if mtime < 0 {
+		return Right, RuleModTime, nil
+	}
+	if mtime > 0 {
+		return Left, RuleModTime, nil
+	}
+
+	if opts.PreferSmallAlloc {
+		alloc1, ok1 := fileid.Allocated(fi1)
+		alloc2, ok2 := fileid.Allocated(fi2)
+		if ok1 && ok2 && alloc1 < alloc2 {
+			return Right, RuleAllocation, nil
+		}
+		if ok1 && ok2 && alloc1 > alloc2 {
+			return Left, RuleAllocation, nil
+		}
+	}
+
+	switch opts.Tie {
+	case TieKeepRight:
+		return Left, RuleTie, nil
+	case TieKeepBoth:
+		return None, RuleTie, errKeepBoth
+	case TieError:
+		return None, RuleTie, fmt.Errorf("%s and %s: %w", fi1.Name(), fi2.Name(), ErrTie)
+	default:
+		return Right, RuleTie, nil
+	}
+
+}
+
+// SplitFileBaseName splits a filename like "flowers (1).jpg" into ("flowers", 1, "jpg").
+// counter is determined heuristically to guess how many copies deep the filename is,
+// e.g. "flowers - Copy (3) - Copy - Copy.jpg" is guessed to be the 5th copy, and the macOS Finder copy "flowers copy 2.jpg" the 2nd.
+// prefix is the guessed original name without the extension.
+func SplitFileBaseName(name string) (prefix string, counter int, ext string) {
+	defer func() {
+		// if we were about to return garbage,
+		// just give up and return the original name
+		if prefix == "" && ext == "" {
+			prefix = name
+			counter = 0
+			ext = ""
+		}
+	}()
+	ext = filepath.Ext(name)
+	prefix = name[:len(name)-len(ext)]
+	for {
+		wmatch := windowsPattern.FindStringSubmatch(prefix)
+		if wmatch != nil {
+			prefix = strings.TrimSuffix(prefix, wmatch[0])
+			n, _ := strconv.Atoi(wmatch[1])
+			switch {
+			case n == 0:
+				counter++
+			case n == 1:
+				// special case: windows would skip Copy (1) through ctrl+v
+				counter += 2
+			case n < 0:
+				panic("should not have been able to match a negative number")
+			default:
+				counter += n
+			}
+			continue // prevent the chrome match from running before checking for windows pattern again
+		}
+		cmatch := chromePattern.FindStringSubmatch(prefix)
+		if cmatch != nil {
+			prefix = strings.TrimSuffix(prefix, cmatch[0])
+			n, _ := strconv.Atoi(cmatch[1])
+			switch {
+			case n == 0:
+				counter++
+			case n < 0:
+				panic("should not have been able to match a negative number")
+			default:
+				counter += n
+			}
+		}
+		fmatch := finderPattern.FindStringSubmatch(prefix)
+		if fmatch != nil && slices.Contains(copyNouns, strings.ToLower(fmatch[1])) {
+			// "copy" is part of the name, as in "hard copy.pdf", rather than added by Finder
+			fmatch = nil
+		}
+		if fmatch != nil {
+			prefix = prefix[:len(prefix)-len(fmatch[0])+len(fmatch[1])]
+			n, _ := strconv.Atoi(fmatch[2])
+			switch {
+			case n == 0:
+				// macOS Finder names the first copy "flowers copy.jpg" and the next "flowers copy 2.jpg"
+				counter++
+			case n < 0:
+				panic("should not have been able to match a negative number")
+			default:
+				counter += n
+			}
+		}
+
+		if wmatch == nil && cmatch == nil && fmatch == nil {
+			return
+		}
+	}
+}
+
+// CleanName reports whether name looks like an original rather than a copy:
+// SplitFileBaseName finds no copy counter in it, and it has none of the other common copy markers,
+// such as "flowers copy.jpg", "flowers(1).jpg", "Copy of flowers.jpg", or trailing spaces.
+func CleanName(name string) bool {
+	prefix, counter, _ := SplitFileBaseName(name)
+	return counter == 0 && !copyMarkerPattern.MatchString(prefix)
+}
+
+var copyMarkerPattern = regexp.MustCompile(`(?i)(?:^copy of |[ _-]copy(?:[ _-]?\d+)?$|\(\d+\)$|\s$)`)
+
+var windowsPattern = regexp.MustCompile(` - Copy(?: \((\d+)\))?$`)
+var chromePattern = regexp.MustCompile(` \((\d+)\)$`)
+
+// finderPattern matches the word before a Finder copy marker, and the number of the copy:
+// Finder adds " copy" for the first copy and " copy 2", " copy 3", and so on for the next, never " copy 1".
+var finderPattern = regexp.MustCompile(`(\S+) copy(?: ([2-9]|[1-9]\d+))?$`)
+
+// copyNouns are the words that form a noun with "copy", so that a name ending in one of them followed by " copy"
+// isn't mistaken for a Finder copy.
+var copyNouns = []string{"backup", "carbon", "certified", "clean", "fair", "final", "hard", "master", "print", "review", "soft", "true", "working"}
+
+// compareModTime compares t1 and t2 like time.Time.Compare,
+// except that times no more than tolerance apart are equal.
+func compareModTime(t1, t2 time.Time, tolerance time.Duration) int {
+	if d := t1.Sub(t2).Abs(); d <= tolerance {
+		return 0
+	}
+	return t1.Compare(t2)
+}
+
+func isDigits(s string) bool {
+	if _, err := strconv.Atoi(s); err == nil {
+		return true
+	}
+	return false
+}
+
+// sizesDiffer reports whether f1 and f2 have different sizes.
+func sizesDiffer(f1, f2 fs.File) (bool, error) {
+	fi1, err := f1.Stat()
+	if err != nil {
+		return false, err
+	}
+	fi2, err := f2.Stat()
+	if err != nil {
+		return false, err
+	}
+	return fi1.Size() != fi2.Size(), nil
+}
+
+// sameFile reports whether f1 and f2 are the same file, such as two hard links to it.
+func sameFile(f1, f2 fs.File) (bool, error) {
+	fi1, err := f1.Stat()
+	if err != nil {
+		return false, err
+	}
+	fi2, err := f2.Stat()
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fi1, fi2), nil
+}
+
+func isSymlink(fi fs.FileInfo) bool {
+	return fi.Mode()&fs.ModeSymlink != 0
+}
+
+type errImpossible struct {
+	e error
+}
+
+func (e errImpossible) Unwrap() error { return e.e }
+func (e errImpossible) Error() string { return "error should not be possible: " + e.e.Error() }
@@ -0,0 +1,1125 @@
+package dup_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+func TestOffset(t *testing.T) {
+
+	cases := map[int][]struct{ r, c, i int }{
+		2: {
+			{0, 1, 0},
+		},
+		3: {
+			{0, 1, 0},
+			{0, 2, 1},
+			{1, 2, 2},
+		},
+		4: {
+			{0, 1, 0},
+			{0, 2, 1},
+			{0, 3, 2},
+			{1, 2, 3},
+			{1, 3, 4},
+			{2, 3, 5},
+		},
+		5: {
+			{0, 1, 0},
+			{0, 2, 1},
+			{0, 3, 2},
+			{0, 4, 3},
+			{1, 2, 4},
+			{1, 3, 5},
+			{1, 4, 6},
+			{2, 3, 7},
+			{2, 4, 8},
+			{3, 4, 9},
+		},
+		6: {
+			{0, 1, 0},
+			{0, 2, 1},
+			{1, 2, 5},
+		},
+	}
+
+	for n, tt := range cases {
+		for _, tc := range tt {
+			o := dup.Offset(n, tc.r, tc.c)
+			if tc.i == o {
+				// fmt.Printf("Pass: n=%d, r=%d, c=%d, i=%d\n", n, tc.r, tc.c, tc.i)
+			} else {
+				t.Fatal(fmt.Sprintf("Fail: n=%d, r=%d, c=%d; Expected i=%d, got i=%d\n", n, tc.r, tc.c, tc.i, o))
+			}
+		}
+	}
+
+}
+
+func TestSplitBaseFilename(t *testing.T) {
+	type splitResult struct {
+		name string
+		c    int
+		ext  string
+	}
+	tt := map[string]splitResult{
+		"":                                         {"", 0, ""},
+		"flowers.jpg":                              {"flowers", 0, ".jpg"},
+		"flowers (0).jpg":                          {"flowers", 1, ".jpg"}, // special case
+		"flowers (1).jpg":                          {"flowers", 1, ".jpg"},
+		"flowers (2).jpg":                          {"flowers", 2, ".jpg"},
+		"flowers (3).jpg":                          {"flowers", 3, ".jpg"},
+		"flowers).jpg":                             {"flowers)", 0, ".jpg"},
+		"flowers().jpg":                            {"flowers()", 0, ".jpg"},
+		"flowers(1).jpg":                           {"flowers(1)", 0, ".jpg"},
+		"flowers - Copy.jpg":                       {"flowers", 1, ".jpg"},
+		"flowers - Copy (1).jpg":                   {"flowers", 2, ".jpg"},             //special case
+		"flowers - Copy (-1).jpg":                  {"flowers - Copy (-1)", 0, ".jpg"}, //special case
+		"flowers - Copy (-2).jpg":                  {"flowers - Copy (-2)", 0, ".jpg"}, //special case
+		"flowers - Copy (2).jpg":                   {"flowers", 2, ".jpg"},
+		"flowers - Copy (3).jpg":                   {"flowers", 3, ".jpg"},
+		"flowers - Copy (3) - Copy.jpg":            {"flowers", 4, ".jpg"},
+		"flowers - Copy (4) - Copy.jpg":            {"flowers", 5, ".jpg"},
+		"flowers - Copy (4) - Copy - Copy.jpg":     {"flowers", 6, ".jpg"},
+		"flowers (2) - Copy (4) - Copy - Copy.jpg": {"flowers", 8, ".jpg"},
+		"flowers copy.jpg":                         {"flowers", 1, ".jpg"},
+		"flowers copy 2.jpg":                       {"flowers", 2, ".jpg"},
+		"flowers copy 3 (1).jpg":                   {"flowers", 4, ".jpg"},
+		"flowers - Copy copy.jpg":                  {"flowers", 2, ".jpg"},
+		"flowers copy2.jpg":                        {"flowers copy2", 0, ".jpg"},
+		"flowers Copy.jpg":                         {"flowers Copy", 0, ".jpg"},
+		"flowers copy 1.jpg":                       {"flowers copy 1", 0, ".jpg"}, // Finder starts numbering at 2
+		"flowers copy 02.jpg":                      {"flowers copy 02", 0, ".jpg"},
+		"hard copy.pdf":                            {"hard copy", 0, ".pdf"},
+		"carbon copy.txt":                          {"carbon copy", 0, ".txt"},
+		"Hard Copy 2.pdf":                          {"Hard Copy 2", 0, ".pdf"},
+		"hard copy copy.pdf":                       {"hard copy", 1, ".pdf"},
+		"copy.txt":                                 {"copy", 0, ".txt"},
+		".env":                                     {"", 0, ".env"},
+		"env":                                      {"env", 0, ""},
+		"env.":                                     {"env", 0, "."},
+		" - Copy.env":                              {"", 1, ".env"},
+		"- Copy.env":                               {"- Copy", 0, ".env"}, // special case, a copied windows file would have the leading space so this is fine
+		" (1).foo":                                 {"", 1, ".foo"},
+		" (1)":                                     {" (1)", 0, ""},
+		" - Copy":                                  {" - Copy", 0, ""},
+	}
+
+	for originalName, tc := range tt {
+		var r splitResult
+		r.name, r.c, r.ext = dup.SplitFileBaseName(originalName)
+		if !compareSplit(tc, r) {
+			t.Errorf("%q: expected: %+v; got %+v\n", originalName, tc, r)
+		}
+	}
+}
+func compareSplit(l1, l2 struct {
+	name string
+	c    int
+	ext  string
+}) bool {
+	if l1.name != l2.name {
+		return false
+	}
+	if l1.c != l2.c {
+		return false
+	}
+	if l1.ext != l2.ext {
+		return false
+	}
+	return true
+}
+
+func ExampleCompareFile() {
+	dir, err := os.MkdirTemp("", "dedup")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"weeds.jpg":       "thorns",
+		"leaves.jpg":      "leaf",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			panic(err)
+		}
+	}
+
+	ctx := context.Background()
+	equal, keep, err := dup.CompareFile(ctx, filepath.Join(dir, "flowers (1).jpg"), filepath.Join(dir, "flowers.jpg"))
+	fmt.Println(equal, filepath.Base(keep), err)
+
+	equal, keep, err = dup.CompareFile(ctx, filepath.Join(dir, "flowers.jpg"), filepath.Join(dir, "weeds.jpg"))
+	fmt.Printf("%v %q %v\n", equal, keep, err)
+
+	equal, keep, err = dup.CompareFile(ctx, filepath.Join(dir, "flowers.jpg"), filepath.Join(dir, "leaves.jpg"))
+	fmt.Printf("different sizes: %v %q %v\n", equal, keep, err)
+
+	_, _, err = dup.CompareFile(ctx, filepath.Join(dir, "flowers.jpg"), filepath.Join(dir, "flowers.jpg"))
+	fmt.Println("same file:", err != nil)
+
+	_, _, err = dup.CompareFile(ctx, filepath.Join(dir, "flowers.jpg"), filepath.Join(dir, "missing.jpg"))
+	fmt.Println("missing file:", errors.Is(err, fs.ErrNotExist))
+
+	_, _, err = dup.CompareFile(ctx, filepath.Join(dir, "flowers.jpg"), dir)
+	fmt.Println("directory:", err != nil)
+
+	// Output:
+	// true flowers.jpg <nil>
+	// false "" <nil>
+	// different sizes: false "" <nil>
+	// same file: true
+	// missing file: true
+	// directory: true
+}
+
+func BenchmarkFilenameFn(b *testing.B) {
+	dir := b.TempDir()
+	content := bytes.Repeat([]byte("petals"), 1<<20/6)
+	left := filepath.Join(dir, "flowers.jpg")
+	right := filepath.Join(dir, "flowers (1).jpg")
+	for _, name := range []string{left, right} {
+		if err := os.WriteFile(name, content, 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dup.FilenameFn(ctx, left, right); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestReaderSize(t *testing.T) {
+	single := dup.ReaderSize(1)
+	if got := dup.ReaderSize(0); got != single {
+		t.Errorf("expected no concurrency to read like a single comparison, %d; got %d", single, got)
+	}
+	// the buffers of all comparisons together stay about the size of a single comparison's
+	if got := dup.ReaderSize(8); got != single/8 {
+		t.Errorf("expected 8 comparisons at once to read with %d bytes each; got %d", single/8, got)
+	}
+	if got := dup.ReaderSize(1 << 20); got != 4096 {
+		t.Errorf("expected buffers to stop shrinking at 4096 bytes; got %d", got)
+	}
+}
+
+func TestAllowEmpty(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for _, name := range []string{"a.txt", "a (1).txt", "a (2).txt", "b.txt"} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	ctx := context.Background()
+
+	for _, right := range files[1:] {
+		sel, err := dup.FilenameFn(ctx, files[0], right)
+		if sel != dup.None || err == nil {
+			t.Errorf("default options: expected empty files to be rejected; got %v", sel)
+		}
+	}
+
+	dups, err := dup.IndexesContext(ctx, files, dup.NewFilenameFn(dup.Options{AllowEmpty: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(dups)
+	if want := []int{1, 2, 3}; !slices.Equal(dups, want) {
+		t.Errorf("AllowEmpty: expected duplicates %v; got %v", want, dups)
+	}
+}
+
+func TestMatchesContextResolvesKeep(t *testing.T) {
+	// selecting the left item every time makes each duplicate's original a duplicate of the next item
+	leftIsDup := func(_ context.Context, left, right string) (dup.Selection, error) {
+		if left == right {
+			return dup.Left, nil
+		}
+		return dup.None, nil
+	}
+	input := []string{"a", "b", "a", "a", "b"}
+	got, err := dup.MatchesContext(context.Background(), input, leftIsDup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dup.Match{
+		{Dup: 0, Keep: 3},
+		{Dup: 1, Keep: 4},
+		{Dup: 2, Keep: 3},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %+v; got %+v", want, got)
+	}
+}
+
+// TestCopyCounterDominates guards the order of the selection rules:
+// the copy counter is checked before the extension and digit heuristics,
+// so a name without copy markers is kept even when a later rule would prefer the other file.
+func TestCopyCounterDominates(t *testing.T) {
+	tt := []struct {
+		a, b, keep string
+	}{
+		// the extension rule alone would keep "flowers (1).jpg"
+		{"flowers (1).jpg", "flowers", "flowers"},
+		{"flowers", "flowers (1).jpg", "flowers"},
+		// the digit rule alone would keep "photo - Copy.jpg"
+		{"12345.jpg", "photo - Copy.jpg", "12345.jpg"},
+		{"photo - Copy.jpg", "12345.jpg", "12345.jpg"},
+	}
+	for _, tc := range tt {
+		dir := t.TempDir()
+		for _, name := range []string{tc.a, tc.b} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte("petals"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		equal, keep, err := dup.CompareFile(context.Background(), filepath.Join(dir, tc.a), filepath.Join(dir, tc.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equal || filepath.Base(keep) != tc.keep {
+			t.Errorf("%q vs %q: expected to keep %q; got %q", tc.a, tc.b, tc.keep, filepath.Base(keep))
+		}
+	}
+}
+
+func TestTie(t *testing.T) {
+	dir := t.TempDir()
+	left, right := filepath.Join(dir, "flowers.jpg"), filepath.Join(dir, "roses.jpg")
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{left, right} {
+		if err := os.WriteFile(name, []byte("petals"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt := map[dup.Tie]struct {
+		sel dup.Selection
+		err error
+	}{
+		dup.TieKeepLeft:  {dup.Right, nil},
+		dup.TieKeepRight: {dup.Left, nil},
+		dup.TieKeepBoth:  {dup.None, nil},
+		dup.TieError:     {dup.None, dup.ErrTie},
+	}
+	for tie, want := range tt {
+		sel, err := dup.NewFilenameFn(dup.Options{Tie: tie})(context.Background(), left, right)
+		if sel != want.sel || !errors.Is(err, want.err) {
+			t.Errorf("tie policy %d: expected %v, %v; got %v, %v", tie, want.sel, want.err, sel, err)
+		}
+	}
+}
+
+func TestCompareMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows files don't have unix permission bits")
+	}
+	dir := t.TempDir()
+	left, right := filepath.Join(dir, "flowers.jpg"), filepath.Join(dir, "flowers (1).jpg")
+	for _, name := range []string{left, right} {
+		if err := os.WriteFile(name, []byte("petals"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	compare := dup.NewFilenameFn(dup.Options{CompareMode: true})
+
+	if sel, err := compare(ctx, left, right); sel != dup.Right || err != nil {
+		t.Errorf("same mode: expected %v; got %v, %v", dup.Right, sel, err)
+	}
+
+	if err := os.Chmod(right, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if sel, err := compare(ctx, left, right); sel != dup.None || err != nil {
+		t.Errorf("different permissions: expected %v; got %v, %v", dup.None, sel, err)
+	}
+	if sel, err := dup.FilenameFn(ctx, left, right); sel != dup.Right || err != nil {
+		t.Errorf("different permissions without CompareMode: expected %v; got %v, %v", dup.Right, sel, err)
+	}
+
+	if err := os.Chmod(right, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(right, os.Getuid()+1, os.Getgid()+1); err != nil {
+		t.Skipf("unable to change owner: %v", err)
+	}
+	if sel, err := compare(ctx, left, right); sel != dup.None || err != nil {
+		t.Errorf("different owner: expected %v; got %v, %v", dup.None, sel, err)
+	}
+}
+
+func TestMatchesContextUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"flowers.jpg", "locked.jpg", "flowers (1).jpg", "flowers (2).jpg"}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("petals"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	input := make([]string, len(names))
+	for i, name := range names {
+		input[i] = filepath.Join(dir, name)
+	}
+	// a missing file fails to open the same way as a protected one, even when running as root
+	if err := os.Remove(input[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	var lockedCalls int
+	compareFn := func(ctx context.Context, left, right string) (dup.Selection, error) {
+		if left == input[1] || right == input[1] {
+			lockedCalls++
+		}
+		return dup.FilenameFn(ctx, left, right)
+	}
+	got, err := dup.MatchesContext(context.Background(), input, compareFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dup.Match{
+		{Dup: 2, Keep: 0, Rule: dup.RuleCopyCounter},
+		{Dup: 3, Keep: 0, Rule: dup.RuleCopyCounter},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %+v; got %+v", want, got)
+	}
+	if lockedCalls != 1 {
+		t.Errorf("expected the unreadable file to be compared once; got %d", lockedCalls)
+	}
+}
+
+func TestMatchRule(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{"flowers (1).jpg", "flowers.jpg", "flowers", "thorns.jpg"}
+	input := make([]string, len(names))
+	for i, name := range names {
+		input[i] = filepath.Join(dir, name)
+		if err := os.WriteFile(input[i], []byte("petals"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// thorns.jpg overrides the heuristics and is always kept
+	compareFn := func(ctx context.Context, left, right string) (dup.Selection, error) {
+		sel, err := dup.FilenameFn(ctx, left, right)
+		if sel == dup.None || err != nil {
+			return sel, err
+		}
+		switch {
+		case left == input[3]:
+			sel = dup.Right
+		case right == input[3]:
+			sel = dup.Left
+		default:
+			return sel, nil
+		}
+		dup.SetRule(ctx, "favorite")
+		return sel, nil
+	}
+
+	got, err := dup.MatchesContext(context.Background(), input, compareFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dup.Match{
+		{Dup: 0, Keep: 3, Rule: dup.RuleCopyCounter},
+		{Dup: 2, Keep: 3, Rule: dup.RuleExtension},
+		{Dup: 1, Keep: 3, Rule: "favorite"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %+v; got %+v", want, got)
+	}
+
+	var rule dup.Rule
+	if _, err := dup.FilenameFn(dup.WithRule(context.Background(), &rule), input[0], input[1]); err != nil || rule != dup.RuleCopyCounter {
+		t.Errorf("expected WithRule to receive %q; got %q and %v", dup.RuleCopyCounter, rule, err)
+	}
+}
+
+func TestFirstBytes(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "report.txt"), filepath.Join(dir, "report (1).txt")
+	if err := os.WriteFile(a, []byte("same header, different ending"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte("same header, other ending!!!!"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	tt := map[int64]dup.Selection{
+		0:  dup.None,
+		12: dup.Right,
+		13: dup.Right,
+		14: dup.None,
+	}
+	for n, want := range tt {
+		got, err := dup.NewFilenameFn(dup.Options{FirstBytes: n})(ctx, a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("first %d bytes: expected %v; got %v", n, want, got)
+		}
+	}
+}
+
+func TestSizeChanged(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "notes.txt"), filepath.Join(dir, "notes (1).txt")
+	if err := os.WriteFile(a, []byte("petals"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte("petals, and more written since"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []dup.Options{{}, {AssumeEqual: true}} {
+		sel, err := dup.NewFilenameFn(opts)(context.Background(), a, b)
+		if !errors.Is(err, dup.ErrSizeChanged) {
+			t.Errorf("%+v: expected ErrSizeChanged; got %v", opts, err)
+		}
+		if sel != dup.None {
+			t.Errorf("%+v: expected None; got %v", opts, sel)
+		}
+	}
+}
+
+func TestHardlinked(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "flowers.jpg"), filepath.Join(dir, "flowers (1).jpg")
+	if err := os.WriteFile(a, []byte("petals"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(a, b); err != nil {
+		t.Skip("hard links not supported:", err)
+	}
+	for _, opts := range []dup.Options{{}, {AssumeEqual: true}} {
+		sel, err := dup.NewFilenameFn(opts)(context.Background(), a, b)
+		if sel != dup.None || err != nil {
+			t.Errorf("%+v: expected None for hard links to the same file; got %v, %v", opts, sel, err)
+		}
+	}
+}
+
+func TestPartialHashFn(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("petals "), 100)
+	write := func(name string, at int) string {
+		b := bytes.Clone(content)
+		if at >= 0 {
+			b[at] = '!'
+		}
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	keep := write("flowers.jpg", -1)
+	tt := []struct {
+		name string
+		at   int
+		want dup.Selection
+	}{
+		{"flowers (1).jpg", -1, dup.Right},
+		{"head (1).jpg", 10, dup.None},
+		{"tail (1).jpg", len(content) - 10, dup.None},
+		{"middle (1).jpg", len(content) / 2, dup.None},
+	}
+	compare := dup.NewPartialHashFn(64, 64)
+	ctx := context.Background()
+	for _, tc := range tt {
+		got, err := compare(ctx, keep, write(tc.name, tc.at))
+		if err != nil || got != tc.want {
+			t.Errorf("%s: expected %v; got %v, %v", tc.name, tc.want, got, err)
+		}
+	}
+
+	var openErr *dup.OpenError
+	if _, err := compare(ctx, keep, filepath.Join(dir, "missing.jpg")); !errors.As(err, &openErr) || openErr.Item != dup.Right {
+		t.Errorf("expected an OpenError for the right file; got %v", err)
+	}
+}
+
+func TestMatchesFunc(t *testing.T) {
+	sameIsDup := func(_ context.Context, left, right string) (dup.Selection, error) {
+		if left == right {
+			return dup.Right, nil
+		}
+		return dup.None, nil
+	}
+	input := []string{"a", "b", "a", "c", "a", "b"}
+
+	var calls []dup.DupContext[string]
+	err := dup.MatchesFunc(context.Background(), input, sameIsDup, func(d dup.DupContext[string]) {
+		calls = append(calls, d)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 3 {
+		t.Fatalf("expected 3 calls; got %d: %+v", len(calls), calls)
+	}
+	for _, d := range calls {
+		if d.Dup != input[d.Match.Dup] || d.Keep != input[d.Match.Keep] || d.Dup != d.Keep {
+			t.Errorf("inconsistent duplicate %+v", d)
+		}
+	}
+	want, _ := dup.MatchesContext(context.Background(), input, sameIsDup)
+	for i, d := range calls {
+		if d.Match != want[i] {
+			t.Errorf("call %d: expected %+v in the same order as MatchesContext; got %+v", i, want[i], d.Match)
+		}
+	}
+}
+
+func TestKeepPattern(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string) string {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("petals"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	// without the pattern, the copy counter would keep the file in downloads
+	originals := write(filepath.Join("originals", "flowers (1).jpg"))
+	downloads := write(filepath.Join("downloads", "flowers.jpg"))
+	backup := write(filepath.Join("originals", "backup", "flowers (2).jpg"))
+
+	keepFn := dup.NewFilenameFn(dup.Options{KeepPattern: regexp.MustCompile(`originals`)})
+	ctx := context.Background()
+	tt := []struct {
+		name        string
+		left, right string
+		want        dup.Selection
+	}{
+		{"left matches", originals, downloads, dup.Right},
+		{"right matches", downloads, originals, dup.Left},
+		{"both match", originals, backup, dup.Right},
+		{"both match reversed", backup, originals, dup.Left},
+	}
+	for _, tc := range tt {
+		got, err := keepFn(ctx, tc.left, tc.right)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: expected %v; got %v", tc.name, tc.want, got)
+		}
+	}
+
+	noneFn := dup.NewFilenameFn(dup.Options{KeepPattern: regexp.MustCompile(`^/nowhere/`)})
+	if got, err := noneFn(ctx, originals, downloads); err != nil || got != dup.Left {
+		t.Errorf("no match: expected the usual rules to select %v; got %v, %v", dup.Left, got, err)
+	}
+}
+
+func TestFirstDifference(t *testing.T) {
+	prefix := bytes.Repeat([]byte("log line\n"), 2000)
+	tt := []struct {
+		name   string
+		a, b   []byte
+		offset int64
+	}{
+		{"equal", prefix, prefix, -1},
+		{"empty", nil, nil, -1},
+		{"first byte", []byte("abc"), []byte("xbc"), 0},
+		{"after long prefix", append(slices.Clone(prefix), "tail"...), append(slices.Clone(prefix), "tale"...), int64(len(prefix)) + 2},
+		{"prefix", prefix, append(slices.Clone(prefix), '!'), int64(len(prefix))},
+		{"shorter second", []byte("abcd"), []byte("ab"), 2},
+	}
+	for _, tc := range tt {
+		got, err := dup.FirstDifference(context.Background(), bytes.NewReader(tc.a), bytes.NewReader(tc.b))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got != tc.offset {
+			t.Errorf("%s: expected offset %d; got %d", tc.name, tc.offset, got)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"weeds.jpg":       "petaly",
+		"tall weeds.jpg":  "tall petals",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := func(name string) string { return filepath.Join(dir, name) }
+	ctx := context.Background()
+
+	e, err := dup.Explain(ctx, path("flowers (1).jpg"), path("flowers.jpg"), dup.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Equal || e.Offset != -1 || e.Selection != dup.Left || e.Rule != dup.RuleCopyCounter {
+		t.Errorf("expected equal files decided by the copy counter; got %+v", e)
+	}
+	if want := (dup.Name{Prefix: "flowers", Counter: 1, Ext: ".jpg"}); e.LeftName != want {
+		t.Errorf("expected left name %+v; got %+v", want, e.LeftName)
+	}
+
+	e, err = dup.Explain(ctx, path("flowers.jpg"), path("weeds.jpg"), dup.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Equal || e.Offset != 5 || e.Selection != dup.None {
+		t.Errorf("expected files to differ at byte 5; got %+v", e)
+	}
+
+	e, err = dup.Explain(ctx, path("flowers.jpg"), path("tall weeds.jpg"), dup.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Equal || e.Offset != -1 || e.LeftSize != 6 || e.RightSize != 11 {
+		t.Errorf("expected different sizes to not be compared; got %+v", e)
+	}
+
+	if _, err := dup.Explain(ctx, path("missing.jpg"), path("flowers.jpg"), dup.Options{}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected %v; got %v", fs.ErrNotExist, err)
+	}
+}
+
+func TestModTimeTolerance(t *testing.T) {
+	dir := t.TempDir()
+	older := filepath.Join(dir, "a", "flowers.jpg")
+	newer := filepath.Join(dir, "b", "flowers.jpg")
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, p := range []string{older, newer} {
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("petals"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		// one second apart
+		m := mtime.Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(p, m, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	tt := []struct {
+		tolerance    time.Duration
+		preferNewest bool
+		want         dup.Selection // with older on the left
+		wantTie      bool
+	}{
+		{0, false, dup.Right, false},
+		{500 * time.Millisecond, false, dup.Right, false},
+		{time.Second, false, dup.None, true},
+		{2 * time.Second, false, dup.None, true},
+		{0, true, dup.Left, false},
+		{2 * time.Second, true, dup.None, true},
+	}
+	for _, tc := range tt {
+		compare := dup.NewFilenameFn(dup.Options{ModTimeTolerance: tc.tolerance, PreferNewest: tc.preferNewest, Tie: dup.TieError})
+		got, err := compare(ctx, older, newer)
+		if tc.wantTie {
+			if !errors.Is(err, dup.ErrTie) {
+				t.Errorf("tolerance %v, newest %t: expected %v; got %v, %v", tc.tolerance, tc.preferNewest, dup.ErrTie, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("tolerance %v, newest %t: expected %v; got %v, %v", tc.tolerance, tc.preferNewest, tc.want, got, err)
+		}
+	}
+}
+
+func TestKeepPolicy(t *testing.T) {
+	dir := t.TempDir()
+	left := filepath.Join(dir, "flowers (1).jpg")
+	right := filepath.Join(dir, "archive", "flowers.jpg")
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, p := range []string{left, right} {
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("petals"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		m := mtime.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(p, m, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	// left is older, has the shorter path, and has a copy counter
+	tt := []struct {
+		keep dup.KeepPolicy
+		want dup.Selection
+		rule dup.Rule
+	}{
+		{dup.KeepHeuristic, dup.Left, dup.RuleCopyCounter},
+		{dup.KeepOldest, dup.Right, dup.RuleOldest},
+		{dup.KeepNewest, dup.Left, dup.RuleNewest},
+		{dup.KeepShortestPath, dup.Right, dup.RulePathLength},
+		{dup.KeepLongestPath, dup.Left, dup.RulePathLength},
+	}
+	for _, tc := range tt {
+		e, err := dup.Explain(ctx, left, right, dup.Options{Keep: tc.keep})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Selection != tc.want || e.Rule != tc.rule {
+			t.Errorf("policy %d: expected %v by %q; got %v by %q", tc.keep, tc.want, tc.rule, e.Selection, e.Rule)
+		}
+	}
+
+	// with the same modification time, the heuristics decide
+	if err := os.Chtimes(right, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	e, err := dup.Explain(ctx, left, right, dup.Options{Keep: dup.KeepOldest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Selection != dup.Left || e.Rule != dup.RuleCopyCounter {
+		t.Errorf("expected %v by %q; got %v by %q", dup.Left, dup.RuleCopyCounter, e.Selection, e.Rule)
+	}
+}
+
+func TestIndexesContextParallel(t *testing.T) {
+	// items are equal when they share a remainder, and the selection depends on both items,
+	// so that which items are duplicates depends on the order the comparisons are made in
+	const n = 600
+	input := make([]int, n)
+	for i := range input {
+		input[i] = (i * 7919) % 1000
+	}
+	compareFn := func(_ context.Context, left, right int) (dup.Selection, error) {
+		switch {
+		case left == 13:
+			return dup.None, &dup.OpenError{Item: dup.Left, Err: fs.ErrPermission}
+		case right == 13:
+			return dup.None, &dup.OpenError{Item: dup.Right, Err: fs.ErrPermission}
+		case (left+right)%97 == 0:
+			return dup.None, errors.New("comparison failed")
+		case left%41 != right%41:
+			return dup.None, nil
+		case (left^right)&1 == 0:
+			return dup.Left, nil
+		default:
+			return dup.Right, nil
+		}
+	}
+
+	want, err := dup.IndexesContext(context.Background(), input, compareFn)
+	if len(want) == 0 || err != nil {
+		t.Fatalf("expected the sequential version to find duplicates; got %v", err)
+	}
+	for _, workers := range []int{0, 1, 4, 16} {
+		got, err := dup.IndexesContextParallel(context.Background(), input, compareFn, workers)
+		if err != nil || !slices.Equal(got, want) {
+			t.Errorf("workers=%d: expected the same %d duplicates as IndexesContext; got %d", workers, len(want), len(got))
+		}
+	}
+}
+
+func TestSkipRemaining(t *testing.T) {
+	// items are equal when they are the same number, and the comparison budget runs out after 3 pairs
+	input := []int{1, 1, 2, 2, 3, 3}
+	newCompareFn := func() dup.CompareFuncContext[int] {
+		var mu sync.Mutex
+		var calls int
+		return func(_ context.Context, left, right int) (dup.Selection, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if calls++; calls > 3 {
+				return dup.None, fmt.Errorf("out of time: %w", dup.SkipRemaining)
+			}
+			if left == right {
+				return dup.Right, nil
+			}
+			return dup.None, nil
+		}
+	}
+
+	got, err := dup.IndexesContext(context.Background(), input, newCompareFn())
+	if !errors.Is(err, dup.ErrIncomplete) {
+		t.Errorf("expected %v; got %v", dup.ErrIncomplete, err)
+	}
+	if want := []int{1}; !slices.Equal(got, want) {
+		t.Errorf("expected the duplicates found before skipping %v; got %v", want, got)
+	}
+
+	for _, workers := range []int{1, 4} {
+		got, err := dup.IndexesContextParallel(context.Background(), input, newCompareFn(), workers)
+		if !errors.Is(err, dup.ErrIncomplete) {
+			t.Errorf("workers=%d: expected %v; got %v", workers, dup.ErrIncomplete, err)
+		}
+		if len(got) > 1 {
+			t.Errorf("workers=%d: expected at most one duplicate before skipping; got %v", workers, got)
+		}
+	}
+
+	var calls int
+	err = dup.MatchesFunc(context.Background(), input, newCompareFn(), func(dup.DupContext[int]) { calls++ })
+	if !errors.Is(err, dup.ErrIncomplete) || calls != 1 {
+		t.Errorf("MatchesFunc: expected 1 call and %v; got %d calls and %v", dup.ErrIncomplete, calls, err)
+	}
+	var last [2]int
+	matches, err := dup.MatchesProgress(context.Background(), input, newCompareFn(), func(done, total int) { last = [2]int{done, total} })
+	if !errors.Is(err, dup.ErrIncomplete) || len(matches) != 1 {
+		t.Errorf("MatchesProgress: expected 1 match and %v; got %v and %v", dup.ErrIncomplete, matches, err)
+	}
+	if last[0] == last[1] {
+		t.Errorf("MatchesProgress: expected no final call with every pair done after skipping; got %v", last)
+	}
+}
+
+func TestCleanName(t *testing.T) {
+	tt := []struct {
+		a, b string
+		// keep and cleanKeep are the files kept by the usual rules and with PreferCleanName
+		keep, cleanKeep string
+	}{
+		// no rule can tell these apart, so the tie keeps the left file, copy marker and all
+		{"flowers_copy.jpg", "flowers.jpg", "flowers_copy.jpg", "flowers.jpg"},
+		{"Copy of report.pdf", "report.pdf", "Copy of report.pdf", "report.pdf"},
+		{"flowers(1).jpg", "flowers.jpg", "flowers(1).jpg", "flowers.jpg"},
+		// the copy counter already keeps the clean name
+		{"IMG_1234 (1).jpg", "IMG_1234.jpg", "IMG_1234.jpg", "IMG_1234.jpg"},
+		{"flowers copy.jpg", "flowers.jpg", "flowers.jpg", "flowers.jpg"},
+		// both names have markers, so the copy counter decides either way
+		{"flowers copy.jpg", "flowers (2).jpg", "flowers copy.jpg", "flowers copy.jpg"},
+		{"flowers (2).jpg", "flowers copy.jpg", "flowers copy.jpg", "flowers copy.jpg"},
+	}
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range tt {
+		dir := t.TempDir()
+		left, right := filepath.Join(dir, tc.a), filepath.Join(dir, tc.b)
+		for _, name := range []string{left, right} {
+			if err := os.WriteFile(name, []byte("petals"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(name, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, opts := range []dup.Options{{}, {PreferCleanName: true}} {
+			want := tc.keep
+			if opts.PreferCleanName {
+				want = tc.cleanKeep
+			}
+			sel, rule, err := dup.SelectRule(left, right, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keep := tc.a
+			if sel == dup.Left {
+				keep = tc.b
+			}
+			if keep != want {
+				t.Errorf("%q vs %q with PreferCleanName %v: expected to keep %q; got %q by rule %q", tc.a, tc.b, opts.PreferCleanName, want, keep, rule)
+			}
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	dir := t.TempDir()
+	contents := bytes.Repeat([]byte("the same rows of the same backup\n"), 1000)
+	write := func(name string, compress func(w *bytes.Buffer) error) string {
+		var buf bytes.Buffer
+		if err := compress(&buf); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	gzipped := func(level int, data []byte) func(*bytes.Buffer) error {
+		return func(buf *bytes.Buffer) error {
+			zw, err := gzip.NewWriterLevel(buf, level)
+			if err != nil {
+				return err
+			}
+			zw.Write(data)
+			return zw.Close()
+		}
+	}
+	zipped := func(method uint16, data []byte) func(*bytes.Buffer) error {
+		return func(buf *bytes.Buffer) error {
+			zw := zip.NewWriter(buf)
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: "backup.sql", Method: method})
+			if err != nil {
+				return err
+			}
+			w.Write(data)
+			return zw.Close()
+		}
+	}
+	plain := write("backup.tgz", gzipped(gzip.NoCompression, contents))
+	small := write("backup.tar.gz", gzipped(gzip.BestCompression, contents))
+	other := write("other.tar.gz", gzipped(gzip.BestCompression, append(contents, '!')))
+	stored := write("backup.zip", zipped(zip.Store, contents))
+	deflated := write("backup (1).zip", zipped(zip.Deflate, contents))
+
+	ctx := context.Background()
+	format, size, err := dup.DecompressedSize(ctx, small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "gzip" || size != int64(len(contents)) {
+		t.Errorf("expected gzip of %d bytes; got %q of %d bytes", len(contents), format, size)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err := dup.DecompressedSize(cancelled, small); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled context to stop decompressing; got %v", err)
+	}
+
+	compare := dup.NewFilenameFn(dup.Options{Decompress: true})
+	tt := []struct {
+		left, right string
+		want        dup.Selection
+	}{
+		{plain, small, dup.Right},
+		{small, other, dup.None},
+		{plain, stored, dup.None},
+		{stored, deflated, dup.Right},
+	}
+	for _, tc := range tt {
+		got, err := compare(ctx, tc.left, tc.right)
+		if err != nil {
+			t.Fatalf("%s, %s: %v", filepath.Base(tc.left), filepath.Base(tc.right), err)
+		}
+		if got != tc.want {
+			t.Errorf("%s, %s: expected %v; got %v", filepath.Base(tc.left), filepath.Base(tc.right), tc.want, got)
+		}
+	}
+	if _, err := dup.FilenameFn(ctx, plain, small); !errors.Is(err, dup.ErrSizeChanged) {
+		t.Errorf("expected archives of different sizes to be left alone without Decompress; got %v", err)
+	}
+}
+
+func TestHashIndexes(t *testing.T) {
+	dir := t.TempDir()
+	files := []struct{ name, contents string }{
+		{"flowers.jpg", "petals"},
+		{"thorns.jpg", "thorns"},
+		{"flowers (1).jpg", "petals"},
+		{"missing.jpg", ""},
+		{"thorns (1).jpg", "thorns"},
+		{"leaves.jpg", "leaves"},
+		{"flowers (2).jpg", "petals"},
+	}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = filepath.Join(dir, f.name)
+		if f.contents == "" {
+			continue
+		}
+		if err := os.WriteFile(paths[i], []byte(f.contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := dup.HashIndexes(context.Background(), paths)
+	want := [][]int{{0, 2, 6}, {1, 4}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v; got %v", want, got)
+	}
+}
+
+func TestErrImpossible(t *testing.T) {
+	sentinel := errors.New("comparison on differently sized files")
+	err := dup.NewErrImpossible(sentinel)
+	if want := "error should not be possible: comparison on differently sized files"; err.Error() != want {
+		t.Errorf("expected %q; got %q", want, err.Error())
+	}
+	if errors.Unwrap(err) != sentinel {
+		t.Errorf("expected Unwrap to return the wrapped error; got %v", errors.Unwrap(err))
+	}
+
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "notes.txt"), filepath.Join(dir, "notes (1).txt")
+	if err := os.WriteFile(a, []byte("petals"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b, []byte("petals and stems"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := dup.SelectRule(a, b, dup.Options{}); err == nil || !strings.Contains(err.Error(), "should not be possible") {
+		t.Errorf("expected an impossible error for files of different sizes; got %v", err)
+	}
+}
+
+func TestMatchesProgress(t *testing.T) {
+	input := []string{"a", "b", "a", "c", "a"}
+	compareFn := func(_ context.Context, left, right string) (dup.Selection, error) {
+		if left == right {
+			return dup.Right, nil
+		}
+		return dup.None, nil
+	}
+	var calls [][2]int
+	got, err := dup.MatchesProgress(context.Background(), input, compareFn, func(done, total int) {
+		calls = append(calls, [2]int{done, total})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := dup.MatchesContext(context.Background(), input, compareFn); !slices.Equal(got, want) {
+		t.Errorf("expected the matches of MatchesContext %v; got %v", want, got)
+	}
+	for i, c := range calls {
+		if c[1] != 10 {
+			t.Errorf("expected a total of 10 pairs; got %d", c[1])
+		}
+		if i > 0 && c[0] < calls[i-1][0] {
+			t.Errorf("expected done to never decrease; got %v", calls)
+		}
+	}
+	if last := calls[len(calls)-1]; last != [2]int{10, 10} {
+		t.Errorf("expected a final call with every pair done; got %v", last)
+	}
+}
@@ -0,0 +1,95 @@
+//go:build unix
+
+package dup_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/dedup/dup"
+	"github.com/Travis-Britz/dedup/internal/fileid"
+	"golang.org/x/sys/unix"
+)
+
+// TestFilenameFnCancelBlockedRead compares two named pipes that never receive any data,
+// standing in for a read on a slow disk that doesn't return.
+func TestFilenameFnCancelBlockedRead(t *testing.T) {
+	dir := t.TempDir()
+	left := filepath.Join(dir, "flowers.jpg")
+	right := filepath.Join(dir, "flowers (1).jpg")
+	for _, name := range []string{left, right} {
+		if err := unix.Mkfifo(name, 0o644); err != nil {
+			t.Skip("named pipes unsupported:", err)
+		}
+		// opening a pipe for reading blocks until there is a writer,
+		// and opening it for reading and writing doesn't
+		w, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := dup.FilenameFn(ctx, left, right)
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected %v; got %v", context.Canceled, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("comparison did not return after cancellation")
+	}
+}
+
+// TestPreferSmallAlloc compares a file of zeros with a sparse file of the same size,
+// which has no blocks allocated on most filesystems.
+func TestPreferSmallAlloc(t *testing.T) {
+	dir := t.TempDir()
+	written, sparse := filepath.Join(dir, "written.bin"), filepath.Join(dir, "sparse.bin")
+	if err := os.WriteFile(written, make([]byte, 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(sparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{written, sparse} {
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi1, _ := os.Stat(written)
+	fi2, _ := os.Stat(sparse)
+	alloc1, _ := fileid.Allocated(fi1)
+	alloc2, _ := fileid.Allocated(fi2)
+	if alloc2 >= alloc1 {
+		t.Skipf("the filesystem allocated %d bytes for the sparse file and %d for the written one", alloc2, alloc1)
+	}
+
+	sel, rule, err := dup.SelectRule(written, sparse, dup.Options{})
+	if err != nil || sel != dup.Right || rule != dup.RuleTie {
+		t.Errorf("expected the tie to keep the left file; got %v by %q, %v", sel, rule, err)
+	}
+	sel, rule, err = dup.SelectRule(written, sparse, dup.Options{PreferSmallAlloc: true})
+	if err != nil || sel != dup.Left || rule != dup.RuleAllocation {
+		t.Errorf("expected the sparse file to be kept; got %v by %q, %v", sel, rule, err)
+	}
+}
@@ -0,0 +1,94 @@
+package dup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Name is a file name broken down by SplitFileBaseName.
+type Name struct {
+	Prefix  string
+	Counter int
+	Ext     string
+}
+
+func splitName(path string) Name {
+	prefix, counter, ext := SplitFileBaseName(filepath.Base(path))
+	return Name{Prefix: prefix, Counter: counter, Ext: ext}
+}
+
+// Explanation describes each step of comparing two files the way a function from NewFilenameFn would.
+type Explanation struct {
+	Left, Right         string
+	LeftSize, RightSize int64
+	LeftName, RightName Name
+
+	// Equal reports whether the contents are the same.
+	// Contents are only compared when the sizes are the same.
+	Equal bool
+	// Offset is the first byte that differs, or -1 when the contents were not compared or are equal.
+	Offset int64
+
+	// Selection and Rule are the decision for equal files, and which rule made it.
+	Selection Selection
+	Rule      Rule
+	// Err is the error the comparison would have returned after comparing contents,
+	// e.g. wrapping ErrTie.
+	Err error
+}
+
+// Explain compares the files at left and right and explains the result.
+// Options.CompareMode and Options.AssumeEqual are not applied.
+// err is only set when either file can't be read.
+func Explain(ctx context.Context, left, right string, opts Options) (Explanation, error) {
+	e := Explanation{
+		Left:      left,
+		Right:     right,
+		LeftName:  splitName(left),
+		RightName: splitName(right),
+		Offset:    -1,
+	}
+	f1, err := os.Open(left)
+	if err != nil {
+		return e, err
+	}
+	defer f1.Close()
+	f2, err := os.Open(right)
+	if err != nil {
+		return e, err
+	}
+	defer f2.Close()
+	fi1, err := f1.Stat()
+	if err != nil {
+		return e, err
+	}
+	fi2, err := f2.Stat()
+	if err != nil {
+		return e, err
+	}
+	e.LeftSize, e.RightSize = fi1.Size(), fi2.Size()
+	if e.LeftSize != e.RightSize {
+		return e, nil
+	}
+
+	var r1, r2 io.Reader = f1, f2
+	if opts.FirstBytes > 0 {
+		r1, r2 = io.LimitReader(f1, opts.FirstBytes), io.LimitReader(f2, opts.FirstBytes)
+	}
+	if e.Offset, err = FirstDifference(ctx, r1, r2); err != nil {
+		return e, err
+	}
+	e.Equal = e.Offset < 0
+	if !e.Equal {
+		return e, nil
+	}
+
+	e.Selection, e.Rule, e.Err = selectDup(left, right, f1, f2, opts)
+	if errors.Is(e.Err, errKeepBoth) {
+		e.Err = nil
+	}
+	return e, nil
+}
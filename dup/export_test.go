@@ -0,0 +1,9 @@
+package dup
+
+import "context"
+
+// NewErrImpossible exposes errImpossible to the tests in dup_test.
+func NewErrImpossible(err error) error { return errImpossible{err} }
+
+// ReaderSize exposes the reader buffer size for comparisons running n at a time to the tests in dup_test.
+func ReaderSize(n int) int { return readerSize(withConcurrency(context.Background(), n)) }
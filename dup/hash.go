@@ -0,0 +1,79 @@
+package dup
+
+import (
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// HashFile returns the digest of the contents of the file at path, computed with a hash from newHash.
+//
+// If ctx is cancelled early then HashFile returns ctx.Err() before reading the whole file.
+// The file is closed on cancellation, the same as with FilenameFn.
+func HashFile(ctx context.Context, path string, newHash func() hash.Hash) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stop := closeOnDone(ctx, f)
+	h := newHash()
+	_, err = io.Copy(h, ctxReader{ctx, f})
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// HashIndexes groups the files at paths that have identical contents.
+// Each file is read once to hash it with SHA-256, instead of once for every comparison as with IndexesContext.
+//
+// Each group holds the indexes into paths of two or more files with the same hash, in the order of paths.
+// Files that are unique or can't be read are left out. No file is selected as a duplicate
+// and the files aren't compared byte for byte; both are left to the caller, e.g. by passing each group
+// to IndexesContext with FilenameFn, which also catches a collision without reading any file a third time.
+func HashIndexes(ctx context.Context, paths []string) [][]int {
+	byHash := make(map[string][]int)
+	var sums []string
+	for i, path := range paths {
+		sum, err := HashFile(ctx, path, sha256.New)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			slog.Error("unable to hash file", "file", path, "err", err)
+			continue
+		}
+		if _, ok := byHash[string(sum)]; !ok {
+			sums = append(sums, string(sum))
+		}
+		byHash[string(sum)] = append(byHash[string(sum)], i)
+	}
+	var groups [][]int
+	for _, sum := range sums {
+		if len(byHash[sum]) > 1 {
+			groups = append(groups, byHash[sum])
+		}
+	}
+	return groups
+}
+
+// ctxReader stops reading from r once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,107 @@
+package dup
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// IndexesContextParallel is like IndexesContext, but compares the items on up to workers goroutines at once.
+// A workers value below 1 means runtime.GOMAXPROCS(0).
+// compareFn must be safe for concurrent use.
+//
+// As long as compareFn returns the same result every time it is given the same pair,
+// the result is exactly the result of IndexesContext, in the same order.
+// Comparisons are made in a different order, though, and may be made more than once,
+// since any that a worker skipped but the sequential order needs are made again afterwards.
+// Once compareFn returns SkipRemaining, the workers stop too,
+// and the duplicates found up to that pair in the sequential order are returned with ErrIncomplete.
+func IndexesContextParallel[T any](ctx context.Context, input []T, compareFn CompareFuncContext[T], workers int) (duplicates []int, err error) {
+	matches, complete := compareAllParallel(ctx, input, compareFn, workers)
+	return indexesOf(resolveKeep(matches), complete)
+}
+
+// compareAllParallel is like compareAll, but spreads the rows of comparisons across workers.
+//
+// Each row is compared by a single worker, which records every outcome in its own part of results.
+// Whether a row is needed depends on the rows before it, so the workers can't know for sure;
+// instead, each found duplicate and unreadable item is published in a bitset that every worker checks
+// before its next comparison, which lets them skip most of what the sequential order would skip.
+// Once every row is done, matchAll replays the sequential order over the recorded outcomes,
+// and only compares the pairs that were skipped but turn out to be needed.
+func compareAllParallel[T any](ctx context.Context, input []T, compareFn CompareFuncContext[T], workers int) (matches []Match, complete bool) {
+	n := len(input)
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	ctx = withConcurrency(ctx, min(workers, n))
+	results := make([]outcome, (n*n-n)/2)
+	// rules holds the rule of each duplicate outcome in results, by its offset
+	var rules sync.Map
+	isDup, unreadable := newBitset(n), newBitset(n)
+	var skipped atomic.Bool
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(workers, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for row := int(next.Add(1) - 1); row < n-1; row = int(next.Add(1) - 1) {
+				for col := row + 1; col < n; col++ {
+					if ctx.Err() != nil || skipped.Load() || isDup.has(row) || unreadable.has(row) {
+						break
+					}
+					if unreadable.has(col) {
+						continue
+					}
+					o, rule := compareAt(ctx, input, compareFn, row, col)
+					results[Offset(n, row, col)] = o
+					if rule != "" {
+						rules.Store(Offset(n, row, col), rule)
+					}
+					switch o {
+					case outcomeLeft:
+						isDup.set(row)
+					case outcomeRight:
+						isDup.set(col)
+					case outcomeOpenLeft:
+						unreadable.set(row)
+					case outcomeOpenRight:
+						unreadable.set(col)
+					case outcomeSkip:
+						skipped.Store(true)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return matchAll(input, func(row, col int) (outcome, Rule) {
+		if o := results[Offset(n, row, col)]; o != notCompared {
+			rule, _ := rules.Load(Offset(n, row, col))
+			r, _ := rule.(Rule)
+			return o, r
+		}
+		// pairs after the one that skipped the rest aren't compared, whichever order they are reached in
+		if skipped.Load() {
+			return outcomeSkip, ""
+		}
+		return compareAt(ctx, input, compareFn, row, col)
+	})
+}
+
+// bitset is a set of indexes that is safe for concurrent use.
+type bitset []atomic.Uint64
+
+func newBitset(n int) bitset { return make(bitset, (n+63)/64) }
+
+func (b bitset) set(i int) {
+	w, bit := &b[i/64], uint64(1)<<(i%64)
+	for old := w.Load(); old&bit == 0 && !w.CompareAndSwap(old, old|bit); old = w.Load() {
+	}
+}
+
+func (b bitset) has(i int) bool { return b[i/64].Load()&(uint64(1)<<(i%64)) != 0 }
@@ -0,0 +1,34 @@
+package dup
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"maps"
+)
+
+// XattrFn wraps compareFn so that files with equal contents but different extended attributes
+// (which includes macOS resource forks) are not considered duplicates.
+//
+// Every comparison will return an error on platforms where XattrSupported is false.
+func XattrFn(compareFn CompareFuncContext[string]) CompareFuncContext[string] {
+	return func(ctx context.Context, left, right string) (Selection, error) {
+		sel, err := compareFn(ctx, left, right)
+		if sel == None || err != nil {
+			return sel, err
+		}
+		x1, err := ReadXattrs(left)
+		if err != nil {
+			return None, err
+		}
+		x2, err := ReadXattrs(right)
+		if err != nil {
+			return None, err
+		}
+		if !maps.EqualFunc(x1, x2, bytes.Equal) {
+			slog.Debug("extended attributes differ", "left", left, "right", right)
+			return None, nil
+		}
+		return sel, nil
+	}
+}
@@ -0,0 +1,58 @@
+package dup_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Travis-Britz/dedup/dup"
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrFn(t *testing.T) {
+	dir := t.TempDir()
+	left := filepath.Join(dir, "flowers.jpg")
+	right := filepath.Join(dir, "flowers (1).jpg")
+	for _, name := range []string{left, right} {
+		if err := os.WriteFile(name, []byte("petals"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	compare := dup.XattrFn(dup.FilenameFn)
+	ctx := context.Background()
+
+	sel, err := compare(ctx, left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sel != dup.Right {
+		t.Errorf("files without xattrs: expected %v; got %v", dup.Right, sel)
+	}
+
+	err = unix.Setxattr(left, "user.dedup.test", []byte("left"), 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("filesystem does not support user xattrs")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sel, err := compare(ctx, left, right); err != nil || sel != dup.None {
+		t.Errorf("only one file has xattrs: expected %v; got %v, %v", dup.None, sel, err)
+	}
+
+	if err := unix.Setxattr(right, "user.dedup.test", []byte("right"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if sel, err := compare(ctx, left, right); err != nil || sel != dup.None {
+		t.Errorf("xattr values differ: expected %v; got %v, %v", dup.None, sel, err)
+	}
+
+	if err := unix.Setxattr(right, "user.dedup.test", []byte("left"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if sel, err := compare(ctx, left, right); err != nil || sel != dup.Right {
+		t.Errorf("xattrs match: expected %v; got %v, %v", dup.Right, sel, err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !(darwin || freebsd || linux || netbsd)
+
+package dup
+
+import "errors"
+
+// XattrSupported reports whether XattrFn, ReadXattrs, and SetXattr can use extended attributes on this platform.
+const XattrSupported = false
+
+// ReadXattrs returns errors.ErrUnsupported on this platform.
+func ReadXattrs(path string) (map[string][]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// SetXattr returns errors.ErrUnsupported on this platform.
+func SetXattr(path, name string, value []byte) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,66 @@
+//go:build darwin || freebsd || linux || netbsd
+
+package dup
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// XattrSupported reports whether XattrFn, ReadXattrs, and SetXattr can use extended attributes on this platform.
+const XattrSupported = true
+
+// ReadXattrs returns every extended attribute of the file at path.
+// A filesystem without extended attribute support is treated as a file without any attributes.
+func ReadXattrs(path string) (map[string][]byte, error) {
+	names, err := xattrCall(func(dest []byte) (int, error) { return unix.Listxattr(path, dest) })
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" {
+			continue
+		}
+		v, err := xattrCall(func(dest []byte) (int, error) { return unix.Getxattr(path, name, dest) })
+		if err != nil {
+			return nil, err
+		}
+		attrs[name] = v
+	}
+	return attrs, nil
+}
+
+// xattrCall calls fn once to learn the required buffer size and again to fill the buffer,
+// retrying if the attribute grew in between.
+func xattrCall(fn func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := fn(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := fn(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// SetXattr sets the extended attribute name of the file at path to value.
+func SetXattr(path, name string, value []byte) error {
+	return unix.Setxattr(path, name, value, 0)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// addExclude adds a glob pattern for -exclude, which is checked once so that a bad pattern is reported at startup.
+func addExclude(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return err
+	}
+	config.Exclude = append(config.Exclude, pattern)
+	return nil
+}
+
+// addExcludeRegex compiles a pattern for -exclude-regex.
+func addExcludeRegex(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	config.ExcludeRegex = append(config.ExcludeRegex, re)
+	return nil
+}
+
+// excluded reports whether path matches any of config.Exclude or config.ExcludeRegex.
+// Glob patterns are matched against the whole path,
+// and patterns without a path separator, such as "node_modules" or "*.tmp", against its last element as well.
+func excluded(path string) bool {
+	for _, pattern := range config.Exclude {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+		if !strings.ContainsRune(pattern, filepath.Separator) {
+			if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+				return true
+			}
+		}
+	}
+	for _, re := range config.ExcludeRegex {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedWithin reports whether path, or any directory between it and root, is excluded,
+// as a walk from root would skip it. root itself is never excluded.
+func excludedWithin(root, path string) bool {
+	for p := filepath.Clean(path); p != filepath.Clean(root); p = filepath.Dir(p) {
+		if excluded(p) {
+			return true
+		}
+		if parent := filepath.Dir(p); parent == p {
+			// path isn't under root
+			return false
+		}
+	}
+	return false
+}
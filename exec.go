@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Placeholders that -exec replaces in each argument of the command.
+const (
+	execDup      = "{dup}"
+	execOriginal = "{original}"
+)
+
+// execHandler runs an external command for each duplicate, for -exec.
+// args is the command and its arguments, with placeholders for the duplicate and the file that was kept.
+type execHandler []string
+
+// parseExec splits s into the arguments of an execHandler.
+func parseExec(s string) (execHandler, error) {
+	args, err := splitCommand(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	if !strings.Contains(s, execDup) && !strings.Contains(s, execOriginal) {
+		return nil, fmt.Errorf("command has neither %s nor %s", execDup, execOriginal)
+	}
+	return execHandler(args), nil
+}
+
+// command returns the arguments with the placeholders replaced by file and keep.
+// Each path stays within the argument it was substituted into, whatever characters it contains.
+func (e execHandler) command(file, keep string) []string {
+	r := strings.NewReplacer(execDup, file, execOriginal, keep)
+	args := make([]string, len(e))
+	for i, a := range e {
+		args[i] = r.Replace(a)
+	}
+	return args
+}
+
+func (e execHandler) handle(file, keep string) error {
+	args := e.command(file, keep)
+	slog.Info("running command", "file", file, "keep", keep, "args", args)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	return nil
+}
+
+// String returns the command for file and keep with every argument quoted for the shell, for dry runs.
+func (e execHandler) String(file, keep string) string {
+	args := e.command(file, keep)
+	for i, a := range args {
+		args[i] = shellQuote(a)
+	}
+	return strings.Join(args, " ")
+}
+
+// splitCommand splits s into words the way a shell would, without expanding anything:
+// words are separated by unquoted whitespace,
+// single quotes preserve everything up to the next single quote,
+// and a backslash escapes the next character, except inside single quotes.
+// Within double quotes, a backslash only escapes a double quote or another backslash.
+func splitCommand(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			if quote == '"' && c != '"' && c != '\\' {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// explain prints how the files at a and b are compared and which one would be kept, for "dedup explain A B".
+// Nothing is changed on disk.
+func explain(w io.Writer, a, b string) error {
+	opts, err := compareOptions()
+	if err != nil {
+		return err
+	}
+	e, err := dup.Explain(context.Background(), a, b, opts)
+	if err != nil {
+		return err
+	}
+	writeExplanation(w, e)
+	return nil
+}
+
+func writeExplanation(w io.Writer, e dup.Explanation) {
+	for _, f := range []struct {
+		label string
+		path  string
+		size  int64
+		name  dup.Name
+	}{
+		{"left", e.Left, e.LeftSize, e.LeftName},
+		{"right", e.Right, e.RightSize, e.RightName},
+	} {
+		fmt.Fprintf(w, "%s: %s\n", f.label, f.path)
+		fmt.Fprintf(w, "  size: %s\n", formatSize(f.size))
+		fmt.Fprintf(w, "  name: prefix %q, copy counter %d, extension %q\n", f.name.Prefix, f.name.Counter, f.name.Ext)
+	}
+
+	switch {
+	case e.LeftSize != e.RightSize:
+		fmt.Fprintln(w, "contents: not compared; the sizes differ")
+	case !e.Equal:
+		fmt.Fprintf(w, "contents: differ at byte %d\n", e.Offset)
+	default:
+		fmt.Fprintln(w, "contents: equal")
+	}
+	if !e.Equal {
+		fmt.Fprintln(w, "result: not duplicates")
+		return
+	}
+
+	switch e.Selection {
+	case dup.Left:
+		fmt.Fprintf(w, "result: keep right, left is the duplicate (rule: %s)\n", e.Rule)
+	case dup.Right:
+		fmt.Fprintf(w, "result: keep left, right is the duplicate (rule: %s)\n", e.Rule)
+	default:
+		if e.Err != nil {
+			fmt.Fprintf(w, "result: error (rule: %s): %v\n", e.Rule, e.Err)
+		} else {
+			fmt.Fprintf(w, "result: keep both (rule: %s)\n", e.Rule)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listFiles returns the files to compare: those read from stdin with config.FromStdin,
+// or else every file found by walking roots.
+func listFiles(ctx context.Context, roots []string) <-chan fileResult {
+	if config.FromStdin {
+		sep := byte('\n')
+		if config.NulInput {
+			sep = 0
+		}
+		return readFileList(ctx, os.Stdin, sep)
+	}
+	return compileDirResults(ctx, roots)
+}
+
+// readFileList reads paths separated by sep from r, for -from-stdin, and sends each regular file to the returned channel.
+// A path may be followed by a tab and its size in bytes, e.g. from find -printf '%p\t%s\n',
+// in which case the file isn't stat'ed at all; otherwise its size is read with os.Lstat.
+// Empty entries are ignored, and so are symlinks and anything else that isn't a regular file,
+// the same as in a walk.
+// The returned channel will be closed when r is exhausted.
+func readFileList(ctx context.Context, r io.Reader, sep byte) <-chan fileResult {
+	ch := make(chan fileResult)
+	go func() {
+		defer close(ch)
+		s := bufio.NewScanner(r)
+		s.Buffer(nil, 1<<20)
+		s.Split(splitOn(sep))
+		for s.Scan() {
+			fr, ok := fileListEntry(s.Text(), sep)
+			if !ok {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- fr:
+			}
+		}
+		if err := s.Err(); err != nil {
+			slog.Error("unable to read file list", "err", err)
+		}
+	}()
+	return ch
+}
+
+// fileListEntry parses a single entry of a file list, and reports whether it is a file to compare.
+func fileListEntry(entry string, sep byte) (fileResult, bool) {
+	if sep == '\n' {
+		entry = strings.TrimSuffix(entry, "\r")
+	}
+	if entry == "" {
+		return fileResult{}, false
+	}
+	// with NUL separators the entry is only a path, which may itself end in a tab and digits
+	if i := strings.LastIndexByte(entry, '\t'); i >= 0 && sep == '\n' {
+		if size, err := strconv.ParseInt(entry[i+1:], 10, 64); err == nil && size >= 0 {
+			return listedFile(entry[:i], size)
+		}
+	}
+	fi, err := os.Lstat(entry)
+	if err != nil {
+		slog.Error("unable to access file", "path", entry, "err", err)
+		return fileResult{}, false
+	}
+	if !fi.Mode().IsRegular() {
+		slog.Debug("skipping listed path that isn't a regular file", "path", entry, "mode", fi.Mode())
+		return fileResult{}, false
+	}
+	return listedFile(entry, fi.Size())
+}
+
+// listedFile applies the filters of a walk to the file at path.
+func listedFile(path string, size int64) (fileResult, bool) {
+	path = filepath.Clean(path)
+	if excluded(path) || !hasExtension(path, config.Extensions) {
+		return fileResult{}, false
+	}
+	return fileResult{path: path, size: size, root: rootOf(path)}, true
+}
+
+// splitOn returns a bufio.SplitFunc for entries separated by sep.
+// The last entry doesn't need to be followed by sep.
+func splitOn(sep byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if i := bytes.IndexByte(data, sep); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/Travis-Britz/dedup/internal/fileid"
+)
+
+// freeSpaceCheck measures how much free space a run actually reclaimed on the filesystems containing the roots.
+type freeSpaceCheck struct {
+	// paths holds one root per filesystem, so that a filesystem shared by several roots is only counted once.
+	paths  map[uint64]string
+	before map[uint64]uint64
+}
+
+// startFreeSpaceCheck records the current free space of every filesystem containing one of roots.
+func startFreeSpaceCheck(roots []string) (*freeSpaceCheck, error) {
+	c := &freeSpaceCheck{
+		paths:  make(map[uint64]string),
+		before: make(map[uint64]uint64),
+	}
+	for _, root := range roots {
+		id, err := fileid.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := c.paths[id.Dev]; ok {
+			continue
+		}
+		free, err := freeSpace(root)
+		if err != nil {
+			return nil, fmt.Errorf("free space of %s: %w", root, err)
+		}
+		c.paths[id.Dev] = root
+		c.before[id.Dev] = free
+	}
+	return c, nil
+}
+
+// freed returns how many bytes of free space were gained since startFreeSpaceCheck.
+// Other programs writing to the same filesystems during the run will skew the result.
+func (c *freeSpaceCheck) freed() (int64, error) {
+	var total int64
+	for dev, root := range c.paths {
+		free, err := freeSpace(root)
+		if err != nil {
+			return 0, fmt.Errorf("free space of %s: %w", root, err)
+		}
+		total += int64(free) - int64(c.before[dev])
+	}
+	return total, nil
+}
+
+// freedDiverges reports whether the actual bytes freed differs from the predicted bytes by more than 10%,
+// e.g. because some duplicates were hard links sharing their blocks with another file.
+func freedDiverges(predicted, actual int64) bool {
+	diff := predicted - actual
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff*10 > predicted
+}
+
+// warnIfFreedDiverges logs a warning when the free space reclaimed by a run doesn't match the duplicates handled.
+func warnIfFreedDiverges(predicted, actual int64) {
+	if freedDiverges(predicted, actual) {
+		slog.Warn("freed space differs from the size of the removed duplicates", "predicted_bytes", predicted, "actual_bytes", actual)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !(darwin || freebsd || linux || windows)
+
+package main
+
+import "errors"
+
+// freeSpace returns the number of free bytes on the filesystem containing path.
+func freeSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
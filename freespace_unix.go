@@ -0,0 +1,14 @@
+//go:build darwin || freebsd || linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the number of free bytes on the filesystem containing path.
+func freeSpace(path string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bfree) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+// freeSpace returns the number of free bytes on the volume containing path.
+func freeSpace(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, nil, nil, &free); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
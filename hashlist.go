@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// hashList records each duplicate with a short hash of its contents in place of handling it, for -format hashes.
+// The lines are sorted when written, so that the same files give the same output
+// however the walk happened to find them, e.g. to commit a list of known duplicates and diff it later.
+type hashList struct {
+	ctx     context.Context
+	newHash func() hash.Hash
+	lines   []string
+}
+
+// shortHashLen is the number of hex digits of each hash that is printed,
+// which is plenty to tell apart the sets of identical files of a tree.
+const shortHashLen = 12
+
+func (l *hashList) handle(file, keep string) error {
+	sum, err := dup.HashFile(l.ctx, file, l.newHash)
+	if err != nil {
+		return err
+	}
+	l.lines = append(l.lines, fmt.Sprintf("%s\t%s\t%s", hex.EncodeToString(sum)[:shortHashLen], file, keep))
+	return nil
+}
+
+// write prints a line for each duplicate to w: the short hash, the duplicate, and the file kept in its place,
+// separated by tabs and sorted by hash, then by path.
+// It must not be called until all files have been handled.
+func (l *hashList) write(w io.Writer) error {
+	slices.Sort(l.lines)
+	for _, line := range l.lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
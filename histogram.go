@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// histogramRanges are the lower bounds of the file size ranges in a histogram.
+var histogramRanges = [...]int64{0, 1 << 10, 64 << 10, 1 << 20, 64 << 20, 1 << 30}
+
+// histogram describes the shape of the staged buckets, for -histogram.
+type histogram struct {
+	// belowMin counts files skipped for being smaller than config.MinSize.
+	belowMin int
+	// aboveMax counts files skipped for being larger than config.MaxSize.
+	aboveMax int
+	// byBucketLen counts buckets by how many files they hold: 1, 2, and 3 or more.
+	byBucketLen [3]int
+	// byRange holds the number of files and of possible duplicates (files sharing their size with another)
+	// for each of histogramRanges.
+	byRange [len(histogramRanges)]struct{ files, candidates int }
+}
+
+func newHistogram(buckets map[int64][]fileResult, belowMin, aboveMax int) histogram {
+	h := histogram{belowMin: belowMin, aboveMax: aboveMax}
+	for size, frs := range buckets {
+		h.byBucketLen[min(len(frs), 3)-1]++
+		r := &h.byRange[rangeOf(size)]
+		r.files += len(frs)
+		if len(frs) > 1 {
+			r.candidates += len(frs)
+		}
+	}
+	return h
+}
+
+// rangeOf returns the index of the histogram range that size falls into.
+func rangeOf(size int64) int {
+	for i := len(histogramRanges) - 1; i > 0; i-- {
+		if size >= histogramRanges[i] {
+			return i
+		}
+	}
+	return 0
+}
+
+func (h histogram) write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "files per bucket\tbuckets\t\n")
+	for i, label := range []string{"1", "2", "3+"} {
+		fmt.Fprintf(tw, "%s\t%d\t\n", label, h.byBucketLen[i])
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(tw, "file size\tfiles\tpossible duplicates\t\n")
+	fmt.Fprintf(tw, "< %s (skipped)\t%d\t-\t\n", formatSize(config.MinSize), h.belowMin)
+	for i, lo := range histogramRanges {
+		label := "≥ " + formatSize(lo)
+		if i+1 < len(histogramRanges) {
+			label = formatSize(lo) + " - " + formatSize(histogramRanges[i+1])
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t\n", label, h.byRange[i].files, h.byRange[i].candidates)
+	}
+	if config.MaxSize > 0 {
+		fmt.Fprintf(tw, "> %s (skipped)\t%d\t-\t\n", formatSize(config.MaxSize), h.aboveMax)
+	}
+	return tw.Flush()
+}
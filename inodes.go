@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/Travis-Britz/dedup/internal/fileid"
+)
+
+// inodeGroups returns the files in fileResults that are hard links to the same file, grouped together.
+// Files are identified with fileid.Stat; their contents are never read.
+// Each group's paths are sorted, and groups are sorted by their first path.
+func inodeGroups(fileResults <-chan fileResult) [][]fileResult {
+	type key struct{ dev, ino uint64 }
+	byID := make(map[key][]fileResult)
+	for fr := range fileResults {
+		id, err := fileid.Stat(fr.path)
+		if err != nil {
+			slog.Error("unable to read file id", "file", fr, "err", err)
+			continue
+		}
+		if id.Nlink == 1 {
+			continue
+		}
+		k := key{id.Dev, id.Ino}
+		byID[k] = append(byID[k], fr)
+	}
+
+	var groups [][]fileResult
+	for _, frs := range byID {
+		if len(frs) < 2 {
+			// the other links are outside of the scanned directories
+			continue
+		}
+		slices.SortFunc(frs, func(a, b fileResult) int { return strings.Compare(a.path, b.path) })
+		groups = append(groups, frs)
+	}
+	slices.SortFunc(groups, func(a, b []fileResult) int { return strings.Compare(a[0].path, b[0].path) })
+	return groups
+}
+
+// writeInodeGroups prints the paths of each group to w, one per line, with a blank line between groups,
+// followed by a summary of the space already saved on summaryW.
+func writeInodeGroups(w, summaryW io.Writer, groups [][]fileResult) {
+	var links int
+	var saved int64
+	for i, g := range groups {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		for _, fr := range g {
+			fmt.Fprintln(w, fr.path)
+		}
+		links += len(g)
+		saved += int64(len(g)-1) * g[0].size
+	}
+	slog.Info("hard links", "files", links, "inodes", len(groups), "saved_bytes", saved)
+	fmt.Fprintf(summaryW, "%d files share %d inodes; %s already deduplicated\n", links, len(groups), formatSize(saved))
+}
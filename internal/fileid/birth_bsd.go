@@ -0,0 +1,23 @@
+//go:build darwin || freebsd || netbsd
+
+package fileid
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// BirthTime returns the creation time of the file described by fi.
+// ok is false if the platform or filesystem does not record it.
+func BirthTime(fi fs.FileInfo) (t time.Time, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	sec, nsec := st.Birthtimespec.Unix()
+	if sec == 0 && nsec == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, nsec), true
+}
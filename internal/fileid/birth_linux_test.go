@@ -0,0 +1,23 @@
+package fileid_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Travis-Britz/dedup/internal/fileid"
+)
+
+func TestBirthTime(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "flowers.jpg")
+	if err := os.WriteFile(name, []byte("petals"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fileid.BirthTime(fi); ok {
+		t.Error("expected no birth time from stat(2) on linux")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !(darwin || freebsd || netbsd || windows)
+
+package fileid
+
+import (
+	"io/fs"
+	"time"
+)
+
+// BirthTime returns the creation time of the file described by fi.
+// ok is false if the platform or filesystem does not record it.
+//
+// stat(2) on this platform does not report creation time, so ok is always false.
+func BirthTime(fi fs.FileInfo) (t time.Time, ok bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,29 @@
+package fileid_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/dedup/internal/fileid"
+)
+
+func TestBirthTime(t *testing.T) {
+	before := time.Now().Add(-time.Second)
+	name := filepath.Join(t.TempDir(), "flowers.jpg")
+	if err := os.WriteFile(name, []byte("petals"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt, ok := fileid.BirthTime(fi)
+	if !ok {
+		t.Fatal("expected NTFS to record creation time")
+	}
+	if bt.Before(before) {
+		t.Errorf("expected birth time after %v; got %v", before, bt)
+	}
+}
@@ -0,0 +1,27 @@
+// Package fileid reads the platform-specific identity of files,
+// such as device and inode numbers, in a portable form.
+package fileid
+
+import (
+	"errors"
+)
+
+// FileID identifies a file on the system.
+// Two paths with equal Dev and Ino refer to the same underlying file.
+type FileID struct {
+	// Dev identifies the device or volume containing the file.
+	Dev uint64
+	// Ino identifies the file within its device.
+	Ino uint64
+	// Nlink is the number of hard links to the file.
+	Nlink uint64
+}
+
+// SameFile reports whether id and other refer to the same underlying file.
+// Nlink is not compared.
+func (id FileID) SameFile(other FileID) bool {
+	return id.Dev == other.Dev && id.Ino == other.Ino
+}
+
+// ErrUnsupported is returned on platforms where file identity can't be read.
+var ErrUnsupported = errors.ErrUnsupported
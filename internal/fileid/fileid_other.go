@@ -0,0 +1,35 @@
+//go:build !unix && !windows
+
+package fileid
+
+import (
+	"io/fs"
+)
+
+// Stat returns the FileID of the file at path, following symlinks.
+//
+// File identity is not available on this platform, so Stat always returns ErrUnsupported.
+func Stat(path string) (FileID, error) {
+	return FileID{}, ErrUnsupported
+}
+
+// FromInfo returns the FileID recorded in fi without another system call.
+//
+// File identity is not available on this platform, so ok is always false.
+func FromInfo(fi fs.FileInfo) (id FileID, ok bool) {
+	return FileID{}, false
+}
+
+// Owner returns the user and group IDs recorded in fi.
+//
+// Files on this platform don't have numeric owners, so ok is always false.
+func Owner(fi fs.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
+
+// Allocated returns the number of bytes of disk space allocated to the file described by fi.
+//
+// The allocation isn't part of the file information on this platform, so ok is always false.
+func Allocated(fi fs.FileInfo) (n int64, ok bool) {
+	return 0, false
+}
@@ -0,0 +1,48 @@
+//go:build unix || windows
+
+package fileid_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Travis-Britz/dedup/internal/fileid"
+)
+
+func TestStat(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "flowers.jpg")
+	link := filepath.Join(dir, "flowers (1).jpg")
+	copied := filepath.Join(dir, "flowers (2).jpg")
+	for _, name := range []string{original, copied} {
+		if err := os.WriteFile(name, []byte("petals"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(original, link); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]fileid.FileID)
+	for _, name := range []string{original, link, copied} {
+		id, err := fileid.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = id
+	}
+
+	if !ids[original].SameFile(ids[link]) {
+		t.Errorf("expected hard links to share an id; got %+v and %+v", ids[original], ids[link])
+	}
+	if ids[original].SameFile(ids[copied]) {
+		t.Errorf("expected copies to have different ids; both got %+v", ids[original])
+	}
+	if ids[original].Nlink != 2 {
+		t.Errorf("expected Nlink 2 for a linked file; got %d", ids[original].Nlink)
+	}
+	if ids[copied].Nlink != 1 {
+		t.Errorf("expected Nlink 1 for an unlinked file; got %d", ids[copied].Nlink)
+	}
+}
@@ -0,0 +1,59 @@
+//go:build unix
+
+package fileid
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// Stat returns the FileID of the file at path, following symlinks.
+func Stat(path string) (FileID, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return FileID{}, err
+	}
+	id, ok := FromInfo(fi)
+	if !ok {
+		return FileID{}, fmt.Errorf("fileid: no stat information for %s", path)
+	}
+	return id, nil
+}
+
+// FromInfo returns the FileID recorded in fi without another system call.
+// ok is false if fi did not come from the operating system, e.g. from an in-memory fs.FS.
+func FromInfo(fi fs.FileInfo) (id FileID, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileID{}, false
+	}
+	return FileID{
+		Dev:   uint64(st.Dev),
+		Ino:   uint64(st.Ino),
+		Nlink: uint64(st.Nlink),
+	}, true
+}
+
+// Owner returns the user and group IDs recorded in fi.
+// ok is false if fi did not come from the operating system.
+func Owner(fi fs.FileInfo) (uid, gid uint32, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return st.Uid, st.Gid, true
+}
+
+// Allocated returns the number of bytes of disk space allocated to the file described by fi,
+// which is smaller than its size for sparse and compressed files, and includes blocks shared with other files.
+// ok is false if fi did not come from the operating system.
+func Allocated(fi fs.FileInfo) (n int64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	// st_blocks is in units of 512 bytes on every unix, whatever the block size of the filesystem
+	return int64(st.Blocks) * 512, true
+}
@@ -0,0 +1,43 @@
+//go:build unix
+
+package fileid_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/Travis-Britz/dedup/internal/fileid"
+)
+
+func TestFromInfo(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "flowers.jpg")
+	if err := os.WriteFile(name, []byte("petals"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromInfo, ok := fileid.FromInfo(fi)
+	if !ok {
+		t.Fatal("expected FromInfo to read os.Stat results")
+	}
+	fromStat, err := fileid.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromInfo != fromStat {
+		t.Errorf("expected FromInfo and Stat to agree; got %+v and %+v", fromInfo, fromStat)
+	}
+
+	memFS := fstest.MapFS{"flowers.jpg": {Data: []byte("petals")}}
+	mfi, err := memFS.Stat("flowers.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fileid.FromInfo(mfi); ok {
+		t.Error("expected FromInfo to reject an in-memory file")
+	}
+}
@@ -0,0 +1,57 @@
+package fileid
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Stat returns the FileID of the file at path, following symlinks.
+func Stat(path string) (FileID, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileID{}, err
+	}
+	defer f.Close()
+	var d syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(f.Fd()), &d); err != nil {
+		return FileID{}, &os.PathError{Op: "GetFileInformationByHandle", Path: path, Err: err}
+	}
+	return FileID{
+		Dev:   uint64(d.VolumeSerialNumber),
+		Ino:   uint64(d.FileIndexHigh)<<32 | uint64(d.FileIndexLow),
+		Nlink: uint64(d.NumberOfLinks),
+	}, nil
+}
+
+// FromInfo returns the FileID recorded in fi without another system call.
+//
+// Windows does not include the file index in directory listings, so ok is always false; use Stat instead.
+func FromInfo(fi fs.FileInfo) (id FileID, ok bool) {
+	return FileID{}, false
+}
+
+// BirthTime returns the creation time of the file described by fi.
+// ok is false if the platform or filesystem does not record it.
+func BirthTime(fi fs.FileInfo) (t time.Time, ok bool) {
+	d, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, d.CreationTime.Nanoseconds()), true
+}
+
+// Owner returns the user and group IDs recorded in fi.
+//
+// Files on this platform don't have numeric owners, so ok is always false.
+func Owner(fi fs.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
+
+// Allocated returns the number of bytes of disk space allocated to the file described by fi.
+//
+// The allocation isn't part of the file information on this platform, so ok is always false.
+func Allocated(fi fs.FileInfo) (n int64, ok bool) {
+	return 0, false
+}
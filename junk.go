@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// builtinJunk is the list of fingerprints that -skip-known-junk starts with.
+//
+//go:embed junk.txt
+var builtinJunk string
+
+// junkSet holds the sha256 digests of known junk files by size.
+type junkSet map[int64]map[string]bool
+
+// knownJunk is the built-in list, extended by -junk-list.
+var knownJunk = mustParseJunk(builtinJunk)
+
+func mustParseJunk(s string) junkSet {
+	j := make(junkSet)
+	if err := j.read(strings.NewReader(s)); err != nil {
+		panic(err)
+	}
+	return j
+}
+
+// read adds the fingerprints listed in r: one per line, a size in bytes and a hex sha256 digest,
+// optionally followed by a description. Blank lines and lines starting with # are ignored.
+func (j junkSet) read(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("line %d: expected a size and a sha256 digest", n)
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("line %d: invalid size %q", n, fields[0])
+		}
+		digest, err := hex.DecodeString(fields[1])
+		if err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("line %d: invalid sha256 digest %q", n, fields[1])
+		}
+		if j[size] == nil {
+			j[size] = make(map[string]bool)
+		}
+		j[size][hex.EncodeToString(digest)] = true
+	}
+	return sc.Err()
+}
+
+// readFile adds the fingerprints listed in the file at path, for -junk-list.
+func (j junkSet) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := j.read(f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// filter returns the files of bucket that don't match a fingerprint.
+// Only files with the size of a known fingerprint are read.
+func (j junkSet) filter(ctx context.Context, bucket []fileResult) []fileResult {
+	var kept []fileResult
+	for _, fr := range bucket {
+		digests := j[fr.size]
+		if digests == nil {
+			kept = append(kept, fr)
+			continue
+		}
+		sum, err := dup.HashFile(ctx, fr.path, sha256.New)
+		if err != nil {
+			// leave it to the comparison to report
+			kept = append(kept, fr)
+			continue
+		}
+		if digests[hex.EncodeToString(sum)] {
+			slog.Debug("skipping known junk file", "file", fr)
+			continue
+		}
+		kept = append(kept, fr)
+	}
+	return kept
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// keptList tracks every file seen during a run and which of them were handled as duplicates,
+// so that the remaining (kept) files can be printed with -print-kept.
+type keptList struct {
+	all     []string
+	handled map[string]bool
+}
+
+func newKeptList() *keptList {
+	return &keptList{handled: make(map[string]bool)}
+}
+
+// files passes every fileResult from in through to the returned channel, remembering each path.
+// The returned channel will be closed after in is closed.
+func (k *keptList) files(in <-chan fileResult) <-chan fileResult {
+	out := make(chan fileResult)
+	go func() {
+		defer close(out)
+		for fr := range in {
+			k.all = append(k.all, fr.path)
+			out <- fr
+		}
+	}()
+	return out
+}
+
+// record wraps h to remember every file that h handled without error.
+// A file that h failed to handle is still on disk, so it is kept.
+func (k *keptList) record(h handler) handlerFunc {
+	return func(file, keep string) error {
+		if err := h.handle(file, keep); err != nil {
+			return err
+		}
+		k.handled[file] = true
+		return nil
+	}
+}
+
+// print writes every kept file to w, one per line, in the order they were found.
+// It must not be called until all files have been handled.
+func (k *keptList) print(w io.Writer) {
+	printed := make(map[string]bool, len(k.all))
+	for _, p := range k.all {
+		// a path is listed twice when one directory argument is inside another
+		if k.handled[p] || printed[p] {
+			continue
+		}
+		printed[p] = true
+		fmt.Fprintln(w, p)
+	}
+}
@@ -8,13 +8,20 @@ import (
 	"io/fs"
 	"log"
 	"log/slog"
+	"math/rand"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/Travis-Britz/dedup/internal/dup"
+	"github.com/Travis-Britz/dedup/dup"
+	"github.com/Travis-Britz/dedup/internal/fileid"
 )
 
 var config = struct {
@@ -23,22 +30,382 @@ var config = struct {
 	Debug   bool
 	Verbose bool
 	Execute bool
-	H       handler
+	OnError string
+
+	LargestFirst bool
+	Fsync        bool
+	CompareXattr bool
+	CountOnly    bool
+	AllowEmpty   bool
+	Action       string
+	VerifyLink   string
+	PrintKept    bool
+	Tie          string
+	Watch        bool
+	WatchSettle  time.Duration
+	CompareMode  bool
+	CheckFreed   bool
+	Report       string
+	FromJSON     string
+	Verify       bool
+	Histogram    bool
+	Promote      bool
+	Inodes       bool
+	MaxClusters  int
+	Hash         string
+	Extensions   []string
+	Seed         int64
+	FirstBytes   int64
+	AcceptRisk   bool
+	KeepRegex    string
+	MaxMem       int64
+	Format       string
+	WalkOrder    string
+	TouchKept    string
+	DiffOffset   bool
+	ListRoots    bool
+	WithinDir    bool
+	PreferNewest bool
+	MatchNames   bool
+	SkipLinked   bool
+	MergeMeta    []string
+	BucketBy     string
+	Prefilter    int64
+	ReportAppend bool
+	SkipJunk     bool
+	Units        string
+	AllowDanger  bool
+	CompareOrder string
+	Exec         execHandler
+	MtimeWindow  time.Duration
+	ApplyReasons []string
+	ScanTimeout  time.Duration
+	MinGroup     int64
+	Baseline     string
+	KeepLinked   bool
+	Mode         string
+	PhashDist    int
+	ListCompare  bool
+	Keep         string
+	Estimate     bool
+	Invert       bool
+	BufferFiles  int64
+	BufferTotal  int64
+	ReportBase   string
+	IntoArchive  bool
+	SmallAlloc   bool
+	ShutdownWait time.Duration
+	VerifyShare  float64
+	TagKept      bool
+	FlushAt      int
+	Pretty       bool
+	Decompress   bool
+	MaxFiles     int
+	Trash        string
+	HashAt       int
+	Progress     bool
+	MaxSize      int64
+	Exclude      []string
+	ExcludeRegex []*regexp.Regexp
+	FollowLinks  bool
+	FromStdin    bool
+	NulInput     bool
+	State        string
+	Explain      bool
+
+	H handler
 }{
 	Dirs:    []string{"."},
 	MinSize: 2048,
 	Debug:   false,
 	Verbose: false,
 	Execute: false,
-	H:       deleteHandler,
+	OnError: onErrorContinue,
+
+	LargestFirst: false,
+	Fsync:        false,
+	CompareXattr: false,
+	CountOnly:    false,
+	AllowEmpty:   false,
+	Action:       actionDelete,
+	VerifyLink:   verifyLinkOff,
+	PrintKept:    false,
+	Tie:          "keep-left",
+	Watch:        false,
+	WatchSettle:  2 * time.Second,
+	CompareMode:  false,
+	CheckFreed:   false,
+	Report:       "",
+	FromJSON:     "",
+	Verify:       false,
+	Histogram:    false,
+	Promote:      false,
+	Inodes:       false,
+	MaxClusters:  0,
+	Hash:         "",
+	Extensions:   nil,
+	Seed:         0,
+	FirstBytes:   0,
+	AcceptRisk:   false,
+	KeepRegex:    "",
+	MaxMem:       0,
+	Format:       formatText,
+	WalkOrder:    walkOrderParallel,
+	TouchKept:    "",
+	DiffOffset:   false,
+	ListRoots:    false,
+	WithinDir:    false,
+	PreferNewest: false,
+	MatchNames:   false,
+	SkipLinked:   false,
+	MergeMeta:    nil,
+	BucketBy:     bucketBySize,
+	Prefilter:    0,
+	ReportAppend: false,
+	SkipJunk:     false,
+	Units:        unitsIEC,
+	AllowDanger:  false,
+	CompareOrder: compareOrderWalk,
+	Exec:         nil,
+	MtimeWindow:  0,
+	ApplyReasons: nil,
+	ScanTimeout:  0,
+	MinGroup:     0,
+	Baseline:     "",
+	KeepLinked:   false,
+	Mode:         modeExact,
+	PhashDist:    10,
+	ListCompare:  false,
+	Keep:         keepDefault,
+	Estimate:     false,
+	Invert:       false,
+	BufferFiles:  0,
+	BufferTotal:  64 << 20,
+	ReportBase:   "",
+	IntoArchive:  false,
+	SmallAlloc:   false,
+	ShutdownWait: 0,
+	VerifyShare:  0,
+	TagKept:      false,
+	FlushAt:      0,
+	Pretty:       false,
+	Decompress:   false,
+	MaxFiles:     0,
+	Trash:        "",
+	HashAt:       0,
+	Progress:     false,
+	MaxSize:      0,
+	Exclude:      nil,
+	ExcludeRegex: nil,
+	FollowLinks:  false,
+	FromStdin:    false,
+	NulInput:     false,
+	State:        "",
+	Explain:      false,
+}
+
+const (
+	onErrorContinue = "continue"
+	onErrorStop     = "stop"
+)
+
+var tiePolicies = map[string]dup.Tie{
+	"keep-left":  dup.TieKeepLeft,
+	"keep-right": dup.TieKeepRight,
+	"keep-both":  dup.TieKeepBoth,
+	"error":      dup.TieError,
 }
 
+const (
+	actionDelete   = "delete"
+	actionHardlink = "hardlink"
+	actionSymlink  = "symlink"
+	actionMove     = "move"
+)
+
+const (
+	verifyLinkOff      = "off"
+	verifyLinkWarn     = "warn"
+	verifyLinkRollback = "rollback"
+)
+
+const (
+	formatText   = "text"
+	formatScript = "script"
+	formatHashes = "hashes"
+	formatJSON   = "json"
+)
+
+const (
+	walkOrderParallel = "parallel"
+	walkOrderArgs     = "args"
+)
+
+const (
+	compareOrderWalk  = "walk"
+	compareOrderPath  = "path"
+	compareOrderMtime = "mtime"
+)
+
+const (
+	keepDefault      = "default"
+	keepHeuristic    = "heuristic"
+	keepCleanestName = "cleanest-name"
+)
+
+// keepPolicies maps the values of -keep to the policy they set, if any.
+var keepPolicies = map[string]dup.KeepPolicy{
+	keepDefault:      dup.KeepHeuristic,
+	keepHeuristic:    dup.KeepHeuristic,
+	keepCleanestName: dup.KeepHeuristic,
+	"oldest":         dup.KeepOldest,
+	"newest":         dup.KeepNewest,
+	"shortest-path":  dup.KeepShortestPath,
+	"longest-path":   dup.KeepLongestPath,
+}
+
+const (
+	bucketBySize    = "size"
+	bucketBySizeExt = "size+ext"
+)
+
 func main() {
 
 	flag.BoolVar(&config.Verbose, "v", config.Verbose, "Enable verbose logging")
 	flag.BoolVar(&config.Debug, "vvv", config.Debug, "Enable debug-level logging")
 	flag.BoolVar(&config.Execute, "x", config.Execute, "Execute. The default is dry-run, which prints every duplicate file to stdout.")
+	flag.BoolVar(&config.LargestFirst, "largest-first", config.LargestFirst, "Compare the largest files first, so the biggest space savings happen early if the run is interrupted.")
+	flag.BoolVar(&config.AllowEmpty, "allow-empty", config.AllowEmpty, "Consider zero-byte files duplicates of each other. They are otherwise always skipped.")
+	flag.BoolVar(&config.CheckFreed, "check-freed", config.CheckFreed, "With -x, measure the free space actually reclaimed on each filesystem and warn if it differs from the size of the handled duplicates.")
+	flag.BoolVar(&config.CompareMode, "compare-mode", config.CompareMode, "Only consider files duplicates if their permission bits and owner also match.")
+	flag.BoolVar(&config.CompareXattr, "compare-xattr", config.CompareXattr, "Only consider files duplicates if their extended attributes (including macOS resource forks) also match.")
+	flag.BoolVar(&config.CountOnly, "count-only", config.CountOnly, "Print only the number of duplicates and exit with that number (capped at 254) as the status code, or 255 on an error. Never deletes anything.")
+	flag.BoolVar(&config.PrintKept, "print-kept", config.PrintKept, "Print every file that is kept instead of the duplicates, including files that have no duplicates.")
+	flag.BoolVar(&config.Fsync, "fsync", config.Fsync, "Sync the parent directory after each file operation so it survives a crash or power loss. This can be much slower when many files are removed.")
+	flag.StringVar(&config.Action, "action", config.Action, "What to do with each duplicate when executing: \"delete\" removes it; \"hardlink\" replaces it with a hard link to the file that was kept; \"symlink\" replaces it with a symbolic link to the absolute path of the file that was kept; \"move\" moves it into the -trash directory.")
+	flag.StringVar(&config.VerifyLink, "verify-link", config.VerifyLink, "Check that each new hard link shares an inode with the kept file: \"off\"; \"warn\" logs a warning on failure; \"rollback\" also leaves the duplicate untouched.")
+	flag.StringVar(&config.Tie, "tie", config.Tie, "What to do with identical files that no rule can tell apart (same name structure and modification time): \"keep-left\", \"keep-right\", \"keep-both\" reports them without acting, or \"error\".")
+	flag.BoolVar(&config.Watch, "watch", config.Watch, "After the initial run, keep watching the directories and compare new files against the existing ones once they stop changing. Runs until interrupted. Can't be combined with the options that act on whole groups of identical files, such as -invert, -merge-meta, -touch-kept, -tag-kept, or -group-threshold-bytes.")
+	flag.DurationVar(&config.WatchSettle, "watch-settle", config.WatchSettle, "How long a new file's size must stay the same before -watch compares it.")
+	flag.StringVar(&config.Report, "report", config.Report, "Write every group of identical files, and which file of each group was kept, to this file as JSON.")
+	flag.StringVar(&config.FromJSON, "from-json", config.FromJSON, "Read groups of identical files from a -report file instead of scanning directories, and select and handle duplicates again without reading file contents.")
+	flag.BoolVar(&config.Verify, "verify", config.Verify, "With -from-json, compare file contents again before handling duplicates.")
+	flag.BoolVar(&config.Histogram, "histogram", config.Histogram, "Print the number of files per size bucket and per file size range to stderr before comparing, to help explain how many duplicates were found.")
+	flag.BoolVar(&config.Promote, "promote", config.Promote, "After deleting duplicates, rename each kept file to the cleanest name among its deleted copies in the same directory, e.g. \"flowers (3).jpg\" becomes \"flowers.jpg\". Only applies to -action delete.")
+	flag.BoolVar(&config.Inodes, "inodes", config.Inodes, "Only report groups of files that are already hard links to each other, one path per line with a blank line between groups. File contents are not read.")
+	flag.IntVar(&config.MaxClusters, "max-clusters", config.MaxClusters, "Stop after this many groups of identical files have been found, for a quick sample of a large tree. The results are partial. 0 means no limit.")
+	flag.StringVar(&config.Hash, "hash", config.Hash, "Hash algorithm for file content hashes: \"sha1\", \"sha256\", or \"sha512\". With -report, the hash of every file is included so the report can be verified later.")
+	flag.Func("ext", "Only consider files with one of these comma-separated extensions, e.g. \"jpg,png,mp4\" or \"tar.gz\". Matching ignores case and a leading dot.", func(s string) error {
+		config.Extensions = parseExtensions(s)
+		return nil
+	})
+	flag.Int64Var(&config.Seed, "seed", config.Seed, "Compare size buckets in a shuffled order that is the same for every run with the same seed, so that samples taken with -max-clusters are reproducible. 0 leaves the order unspecified.")
+	sizeVar(&config.FirstBytes, "first-bytes", "Only compare the first `N` bytes of files that have the same size. Files that differ after N bytes will be treated as duplicates! Requires -i-understand-the-risk.")
+	flag.BoolVar(&config.AcceptRisk, "i-understand-the-risk", config.AcceptRisk, "Confirm that -first-bytes may delete files that are not duplicates, or that -invert -x handles the files that the rules chose to keep.")
+	flag.StringVar(&config.KeepRegex, "keep-regex", config.KeepRegex, "Prefer to keep files whose full path matches this regular expression, e.g. \"/originals/\". When both or neither of two identical files match, the usual rules decide.")
+	sizeVar(&config.MaxMem, "max-mem", "Soft limit for the heap `size`, e.g. \"512MiB\". While it is exceeded, no new size buckets are compared until the current ones finish. 0 means no limit.")
+	flag.StringVar(&config.Format, "format", config.Format, "Dry-run output format: \"text\" prints each duplicate; \"script\" prints a bash script of the commands that -x would run, to review and run later; \"hashes\" prints the start of the -hash (sha256 by default) of each duplicate, the duplicate, and the file kept in its place, sorted so that the same files always give the same output, e.g. to keep a list of known duplicates in version control. \"hashes\" implies -comparison-order path. \"json\" prints a line of JSON for each duplicate as soon as it is found, with the file kept in its place, their size, and the rule that chose which to keep.")
+	flag.StringVar(&config.WalkOrder, "walk-order", config.WalkOrder, "Order of files from different directory arguments: \"parallel\" leaves it to whichever walk finds them first; \"args\" orders them like the arguments, so identical files that no other rule can tell apart are kept from the earliest directory given.")
+	flag.StringVar(&config.TouchKept, "touch-kept", config.TouchKept, "After handling duplicates, set the modification time of each kept file so backup tools notice the change: \"now\", or the \"oldest\" or \"newest\" time among the identical files.")
+	flag.BoolVar(&config.DiffOffset, "diff-offset", config.DiffOffset, "With -v, log the offset of the first differing byte of same-sized files that are not duplicates, to help explain near-duplicates.")
+	flag.BoolVar(&config.ListRoots, "list-roots", config.ListRoots, "Before scanning, print whether each directory argument exists and is readable, its device, and how many entries it has at the top level. The run stops if any of them can't be read.")
+	flag.BoolVar(&config.WithinDir, "within-only", config.WithinDir, "Only compare files that are in the same directory.")
+	flag.BoolVar(&config.PreferNewest, "keep-newest", config.PreferNewest, "Keep the identical file with the latest modification time, before the usual rules based on names.")
+	flag.BoolFunc("retain-newest-in-each-dir", "Preset for -within-only -keep-newest: in each directory, keep only the newest of each set of identical files.", func(s string) error {
+		on, err := strconv.ParseBool(s)
+		config.WithinDir = config.WithinDir || on
+		config.PreferNewest = config.PreferNewest || on
+		return err
+	})
+	flag.BoolVar(&config.MatchNames, "match-names", config.MatchNames, "Only compare files with the same name once copy suffixes are removed, e.g. \"flowers.jpg\" and \"flowers (1).jpg\", such as when merging two libraries.")
+	flag.BoolVar(&config.SkipLinked, "skip-hardlinked", config.SkipLinked, "Never handle a duplicate that has more than one hard link, since removing it reclaims no space and may break a link you rely on. Skipped files are counted separately.")
+	flag.Func("merge-meta", "Before handling duplicates, copy their metadata onto the kept file so none is lost: comma-separated \"mtime\" (the oldest modification time) and \"xattrs\" (extended attributes the kept file doesn't have).", func(s string) error {
+		kinds, err := parseMergeMeta(s)
+		config.MergeMeta = kinds
+		return err
+	})
+	flag.StringVar(&config.BucketBy, "bucket-by", config.BucketBy, "Which files are compared with each other: \"size\" compares all files of the same size; \"size+ext\" only compares files of the same size that also have the same extension (ignoring case), e.g. so a .jpg is never a duplicate of a .bak.")
+	sizeVar(&config.Prefilter, "prefilter-partial-hash-bytes", "Before comparing files of the same size, hash the first and last `N` bytes of each, e.g. \"64KiB\", and only compare files whose hashes match. Larger samples rule out more files that differ, but every file costs up to 2N more bytes read, even ones with a single possible duplicate. 0 disables the prefilter.")
+	flag.BoolVar(&config.ReportAppend, "report-append", config.ReportAppend, "Merge the groups found into an existing -report file instead of replacing it, to build one report from runs over different directories. Earlier entries for files under the scanned directories are replaced. Only one run may write to the file at a time.")
+	flag.BoolVar(&config.SkipJunk, "skip-known-junk", config.SkipJunk, "Never report files that match a fingerprint of common junk, such as empty placeholder files, even when they are identical. See junk.txt for the built-in list.")
+	flag.Func("junk-list", "Add the fingerprints in this file to the list used by -skip-known-junk: one per line, a size in bytes and a sha256 digest, e.g. the output of \"stat -c %s\" and \"sha256sum\". Implies -skip-known-junk.", func(path string) error {
+		config.SkipJunk = true
+		return knownJunk.readFile(path)
+	})
+	flag.StringVar(&config.Units, "units", config.Units, "Units for sizes, both printed and given to flags such as -max-mem: \"iec\" for powers of 1024 (KiB, MiB, GiB; \"M\" means MiB) or \"si\" for powers of 1000 (kB, MB, GB; \"M\" means MB). \"Mi\" and the like always mean powers of 1024.")
+	flag.BoolVar(&config.AllowDanger, "allow-dangerous-roots", config.AllowDanger, "Allow -x when a directory argument is the root of a filesystem, such as / or C:\\, or your home directory. Such runs are refused otherwise, since a mistake there can remove files anywhere.")
+	flag.StringVar(&config.CompareOrder, "comparison-order", config.CompareOrder, "Order of the files of the same size before they are compared, which decides which file of a tie is kept: \"walk\" leaves them in the order they were found; \"path\" sorts them by path; \"mtime\" sorts them by modification time, oldest first. -walk-order args still takes precedence.")
+	flag.Func("exec", "Run this command for each duplicate instead of the -action, like find -exec, e.g. \"mv -n {dup} /archive/\". {dup} is replaced by the duplicate and {original} by the file that was kept; each stays a single argument. Quote arguments as in a shell, but nothing else is expanded. Without -x, the commands are only printed.", func(s string) error {
+		e, err := parseExec(s)
+		config.Exec = e
+		return err
+	})
+	flag.DurationVar(&config.MtimeWindow, "mtime-tolerance", config.MtimeWindow, "Treat modification times this close together as the same when choosing which file to keep, e.g. 2s, so copies made in quick succession or by tools that round timestamps fall through to the next rule.")
+	flag.Func("apply-reasons", "Only handle duplicates whose kept file was chosen by one of these comma-separated rules, as named in -report reasons, e.g. \"copy-counter,extension\". The rest are counted and left for review.", func(s string) error {
+		reasons, err := parseReasons(s)
+		config.ApplyReasons = reasons
+		return err
+	})
+	flag.DurationVar(&config.ScanTimeout, "scan-timeout-per-dir", config.ScanTimeout, "Give up on walking a directory argument that takes longer than this, e.g. an unresponsive network mount, and carry on with the others. The files it found so far are still compared. 0 means no limit.")
+	sizeVar(&config.MinGroup, "group-threshold-bytes", "Only report groups of identical files that are at least this `size` each, e.g. \"1GiB\", to review the biggest wins first. Smaller groups are counted but not listed or handled, so this can't be combined with -x. 0 reports every group.")
+	flag.StringVar(&config.Baseline, "baseline", config.Baseline, "A master directory to check the directory arguments against: files that duplicate a file in it are handled, but its own files are never touched, and other files are never handled as duplicates of each other.")
+	flag.BoolVar(&config.KeepLinked, "preserve-symlinks-as-originals", config.KeepLinked, "Never remove a file that a symlink found in the scan points to, so that no symlink is broken; identical files are handled as duplicates of it instead.")
+	flag.StringVar(&config.Mode, "mode", config.Mode, "How files are matched: \"exact\" finds files with identical contents; \"phash\" only reports groups of similar images (jpeg, png, and gif), such as scaled copies, by perceptual hash, one image per line after its resolution, with the highest resolution first. Similar images are never identical, so they are never handled.")
+	flag.IntVar(&config.PhashDist, "phash-distance", config.PhashDist, "For -mode phash, the number of bits out of 64 that the perceptual hashes of two similar images may differ by.")
+	flag.BoolVar(&config.ListCompare, "list-comparisons", config.ListCompare, "Instead of handling duplicates, print every comparison as it is made, one pair per line with the result, followed by the number of comparisons made for each bucket of same-sized files out of the number possible. Comparisons that an earlier match makes unnecessary are skipped and not printed.")
+	flag.StringVar(&config.Keep, "keep", config.Keep, "Which of two identical files to keep: \"default\" or \"heuristic\" applies the usual rules; \"oldest\" or \"newest\" keeps the file with the earliest or latest modification time; \"shortest-path\" or \"longest-path\" keeps the file with the shorter or longer path; \"cleanest-name\" first keeps the file whose name has no copy markers such as \"(1)\", \" - Copy\", \" copy\", or \"Copy of\", and only applies the usual rules when both or neither name has them.")
+	flag.BoolVar(&config.Estimate, "estimate", config.Estimate, "Count the files in the directories before the run, then print the share of files walked and bytes compared, with the time left, to stderr every second. Counting walks every directory an extra time.")
+	flag.BoolVar(&config.Invert, "invert", config.Invert, "Expert option: handle the file that the rules chose to keep instead of its duplicates, keeping the first duplicate in its place, e.g. to test the rules or for data where they choose backwards. Requires -i-understand-the-risk with -x. Can't be combined with -promote, -baseline, or -preserve-symlinks-as-originals.")
+	sizeVar(&config.BufferFiles, "compare-buffer-reuse", "Read files of up to `size` into memory once per bucket of same-sized files and compare them there, instead of reading both files again for every comparison. Uses more memory, bounded by -compare-buffer-total, for far fewer reads on buckets of many small files. 0 disables it.")
+	sizeVar(&config.BufferTotal, "compare-buffer-total", "The most memory, as a `size`, used by -compare-buffer-reuse at once. Files that don't fit are compared by reading them as usual.")
+	flag.StringVar(&config.ReportBase, "report-relative-to", config.ReportBase, "Write the paths in -report relative to this directory, so the report can be applied after moving the files or on another machine. With -from-json, resolve relative paths in the report against this directory instead, which may be a different location than the report was written with.")
+	flag.BoolVar(&config.IntoArchive, "into-archives", config.IntoArchive, "Also compare the files inside zip and tar archives with every other file, by paths such as \"backup.zip/photos/flowers.jpg\". Files in archives can't be removed in place, so duplicates that involve them are only reported, never handled. Can't be combined with -format json or hashes.")
+	flag.BoolVar(&config.SmallAlloc, "keep-smallest-allocation", config.SmallAlloc, "When no other rule can tell two identical files apart, keep the one with less disk space allocated to it, before -tie applies. On filesystems with compression or shared blocks, such as Btrfs, ZFS, and APFS, that file is cheaper to keep. Not supported on Windows.")
+	flag.DurationVar(&config.ShutdownWait, "shutdown-timeout", config.ShutdownWait, "After the first interrupt, wait this long for the current operation to finish before forcing an exit, e.g. \"5s\". A second interrupt always exits right away. 0 waits until the run stops or a second interrupt.")
+	flag.Func("verify-sample", "With -from-json, compare the contents of this percentage of the groups, chosen at random with -seed, e.g. \"10%\", and trust the rest. Groups that fail are reported and left alone.", func(s string) error {
+		var err error
+		config.VerifyShare, err = parsePercent(s)
+		return err
+	})
+	flag.BoolVar(&config.TagKept, "tag-kept", config.TagKept, "After handling duplicates, record on each kept file how many duplicates it absorbed and when, in the extended attributes user.dedup.merged_count and user.dedup.timestamp. Counts from earlier runs are added to. Without -x, the tags are only printed.")
+	flag.IntVar(&config.FlushAt, "partial-bucket-flush", config.FlushAt, "Start comparing files of one size as soon as this many have been found, instead of waiting for the walk to finish, so results arrive sooner on large trees. Files of that size found later are compared once the walk finishes, against the earlier ones that weren't duplicates. 0 waits for the walk. Can't be combined with -preserve-symlinks-as-originals.")
+	flag.BoolVar(&config.Pretty, "pretty", config.Pretty, "Indent the JSON written by -report so it is easier to read. It is compact by default, and either form can be read back with -from-json.")
+	flag.BoolVar(&config.Decompress, "compare-decompressed", config.Decompress, "Compare gzip and zip files by their contents once decompressed, so copies compressed at different levels, e.g. backup.tar.gz and backup.tgz, are found even though their sizes differ. A gzip file is only compared with other gzip files, and a zip file with other zip files with the same members in the same order.")
+	flag.IntVar(&config.MaxFiles, "max-files", config.MaxFiles, "Abort the run with an error, before comparing or handling anything, if the walk finds more than this many files, e.g. in case a directory argument is much larger than intended. It is a safety check, not a limit on the work done: nothing is reported for a run that is aborted. 0 means no limit.")
+	flag.StringVar(&config.Trash, "trash", config.Trash, "For -action move, the directory to move duplicates into, at the same path relative to it as they had relative to their directory argument, so they can be reviewed and restored. A number is added to the name of a file that is already there. It must not be inside a directory argument.")
+	flag.IntVar(&config.HashAt, "hash-buckets", config.HashAt, "Hash the whole contents of every file of a size shared by at least this many files, and only compare files with the same hash, so each file in a large group of the same size is read a few times instead of once for every other file. Smaller groups are compared as usual. 0 never hashes.")
+	flag.BoolVar(&config.Progress, "progress", config.Progress, "Print a status line to stderr every second with the number of files walked, the number of buckets of same-sized files to compare, and the number of comparisons made. -estimate prints an estimate of the time left instead.")
+	sizeVar(&config.MinSize, "min-size", "Skip files smaller than `size`, e.g. \"1MB\". Empty files are still compared with -allow-empty.")
+	sizeVar(&config.MaxSize, "max-size", "Skip files larger than `size`, e.g. \"50MB\", such as large videos that are known to be unique. 0 means no limit.")
+	flag.Func("exclude", "Skip files and directories whose path matches this glob `pattern`, e.g. \"node_modules\" or \"/data/tmp/*\". A pattern without a path separator also matches the last element of the path. Can be repeated.", addExclude)
+	flag.Func("exclude-regex", "Skip files and directories whose path matches this regular `expression`, e.g. \"/\\.git$\". Can be repeated.", addExcludeRegex)
+	flag.BoolVar(&config.FollowLinks, "follow-symlinks", config.FollowLinks, "Walk into directories that symlinks point to, as if they were in the tree. Each directory is walked at most once, so symlinks back up the tree don't loop. Symlinks to files are still skipped.")
+	flag.BoolVar(&config.FromStdin, "from-stdin", config.FromStdin, "Read the paths of the files to compare from stdin, one per line, instead of walking directories, e.g. from find or fd. A path may be followed by a tab and its size in bytes, as from find -printf '%p\\t%s\\n', to skip reading its size from the filesystem. Directory arguments are not walked.")
+	flag.BoolFunc("0", "Like -from-stdin, but paths are separated by NUL bytes, as from find -print0. Sizes can't be given after a tab, since the tab may be part of the path.", func(s string) error {
+		v, err := strconv.ParseBool(s)
+		if v {
+			config.FromStdin, config.NulInput = true, true
+		}
+		return err
+	})
+	flag.StringVar(&config.State, "state", config.State, "Keep the SHA-256 digest of every hashed file in this SQLite database `file` between runs, and hash every group of same-sized files as with -hash-buckets, so that files with the same size and modification time as in an earlier run aren't read again to hash them. Only files with the same digest are compared. The file is created if it doesn't exist.")
+	flag.BoolVar(&config.Explain, "explain", config.Explain, "Instead of searching directories, take two files as arguments and print why one of them would be kept over the other: their sizes and name breakdowns, whether their contents match, and which rule decided. Nothing is changed on disk.")
+	flag.StringVar(&config.OnError, "on-error", config.OnError, "Walk error policy: \"continue\" logs unreadable files and directories and keeps walking; \"stop\" aborts the walk of that directory argument.")
 	flag.Parse()
+	if err := resolveSizes(); err != nil {
+		fatal(err)
+	}
+
+	if config.Explain {
+		// a flag rather than an "explain" argument, which couldn't be told apart from a directory of that name
+		if flag.NArg() != 2 {
+			log.Fatal("-explain takes exactly two files")
+		}
+		if err := explain(os.Stdout, flag.Arg(0), flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	if len(flag.Args()) > 0 {
 		config.Dirs = flag.Args()
@@ -46,6 +413,9 @@ func main() {
 	for i, d := range config.Dirs {
 		config.Dirs[i] = filepath.Clean(d)
 	}
+	if config.Baseline != "" {
+		config.Baseline = filepath.Clean(config.Baseline)
+	}
 
 	slog.SetLogLoggerLevel(slog.LevelError)
 	if config.Verbose {
@@ -55,12 +425,38 @@ func main() {
 		slog.SetLogLoggerLevel(slog.LevelDebug)
 	}
 
+	// the handlers read config, so they can't be part of the config initializer
+	switch config.Action {
+	case actionDelete:
+		config.H = deleteHandler
+	case actionHardlink:
+		config.H = linkHandler
+	case actionSymlink:
+		config.H = symlinkHandler
+	case actionMove:
+		config.H = moveHandler
+	}
+	if config.Exec != nil {
+		config.H = config.Exec
+	}
 	if !config.Execute {
 		config.H = dryRun(config.H)
+		if config.PrintKept {
+			config.H = noopHandler
+		}
+	}
+	counter := &countHandler{}
+	if config.CountOnly {
+		config.H = counter
 	}
 
 	if err := run(); err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	if config.CountOnly {
+		fmt.Println(counter.n)
+		os.Exit(countExitCode(counter.n))
 	}
 }
 
@@ -73,87 +469,785 @@ func run() error {
 		return fmt.Errorf("config error: %w", err)
 	}
 
+	if config.ListRoots && config.FromJSON == "" {
+		if !listRoots(os.Stderr, config.Dirs) {
+			return errors.New("not every directory argument is readable")
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		<-c
-		slog.Info("received interrupt")
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	done := make(chan struct{})
+	defer close(done)
+	go watchInterrupts(interrupts, done, cancel, config.ShutdownWait, os.Exit)
+
+	if config.Mode == modePhash {
+		writeSimilarImages(os.Stdout, os.Stderr, similarImages(ctx, listFiles(ctx, config.Dirs), config.PhashDist))
+		return nil
+	}
+	if config.Inodes {
+		writeInodeGroups(os.Stdout, os.Stderr, inodeGroups(listFiles(ctx, config.Dirs)))
+		return nil
+	}
+
+	opts, err := compareOptions()
+	if err != nil {
+		return err
+	}
+	compareFn := dup.NewFilenameFn(opts)
+	if config.BufferFiles > 0 && !opts.ReportDifference && !opts.AssumeEqual {
+		selectOpts := opts
+		selectOpts.AssumeEqual = true
+		compareFn = bufferFn(compareFn, dup.NewFilenameFn(selectOpts), newBufferCache(config.BufferFiles, config.BufferTotal), opts.FirstBytes)
+	}
+	if config.FirstBytes > 0 {
+		fmt.Fprintf(os.Stderr, "warning: only comparing the first %s of each file; files that differ after that will be treated as duplicates\n", formatSize(config.FirstBytes))
+	}
+	if config.CompareXattr {
+		compareFn = dup.XattrFn(compareFn)
+	}
+	if config.Baseline != "" {
+		compareFn = baselineFn(compareFn)
+	}
+	if config.KeepLinked {
+		compareFn = linkTargetFn(compareFn, symlinkTargets)
+	}
+	if config.IntoArchive {
+		compareFn = archiveFn(compareFn)
+	}
+	roots := config.Dirs
+	if config.Baseline != "" {
+		roots = append(slices.Clone(roots), config.Baseline)
+	}
+	if config.ListCompare {
+		counts := listComparisons(ctx, os.Stdout, stageBuckets(ctx, listFiles(ctx, roots), newSummary(config.Dirs)), compareFn)
+		writeComparisonTotals(os.Stderr, counts)
+		return nil
+	}
+
+	var kept *keptList
+	if config.PrintKept {
+		kept = newKeptList()
+		config.H = kept.record(config.H)
+	}
+	var script *shellScript
+	if config.Format == formatScript {
+		script = &shellScript{}
+		config.H = script
+	}
+	var hashes *hashList
+	if config.Format == formatHashes {
+		newHash := hashAlgorithms["sha256"]
+		if config.Hash != "" {
+			newHash = hashAlgorithms[config.Hash]
+		}
+		hashes = &hashList{ctx: ctx, newHash: newHash}
+		config.H = hashes
+		// without a fixed order, which of two files that no rule can tell apart is kept would depend on the walk
+		if config.CompareOrder == compareOrderWalk {
+			config.CompareOrder = compareOrderPath
+		}
+	}
+	if config.Format == formatJSON {
+		config.H = &pairWriter{w: os.Stdout}
+	}
+	if config.SkipLinked {
+		config.H = skipHardlinked(config.H)
+	}
+	if len(config.ApplyReasons) > 0 {
+		config.H = applyReasons(config.H, config.ApplyReasons)
+	}
+	if config.IntoArchive && (config.Execute || config.Format == formatScript) {
+		config.H = skipArchived(config.H)
+	}
+
+	var freeCheck *freeSpaceCheck
+	if config.CheckFreed {
+		var err error
+		if freeCheck, err = startFreeSpaceCheck(config.Dirs); err != nil {
+			return fmt.Errorf("-check-freed: %w", err)
+		}
+	}
+
+	if config.State != "" {
+		st, err := openHashState(config.State)
+		if err != nil {
+			return err
+		}
+		fileState = st
+	}
+
+	sum := newSummary(config.Dirs)
+	sum.recordClusters = config.Report != ""
+	if config.Hash != "" {
+		sum.hashName, sum.newHash = config.Hash, hashAlgorithms[config.Hash]
+	}
+	var buckets <-chan []fileResult
+	if config.FromJSON != "" {
+		rep, err := readReportFile(config.FromJSON)
+		if err != nil {
+			return err
+		}
+		if config.ReportBase != "" {
+			rep = rep.Resolve(config.ReportBase)
+		}
+		if config.VerifyShare > 0 {
+			var verified int
+			var failed []string
+			rep, verified, failed = verifySample(ctx, rep, config.VerifyShare, rand.New(rand.NewSource(config.Seed)))
+			slog.Info("verified sample of groups", "groups", verified, "failed", len(failed))
+			sum.unverified = len(failed)
+		}
+		buckets = reportBuckets(ctx, rep, sum)
+	} else {
+		if config.Estimate || config.Progress {
+			prog = &progress{}
+			if config.Estimate {
+				files, bytes := countFiles(compileDirResults(ctx, roots))
+				slog.Info("counted files", "files", files, "bytes", bytes)
+				prog.estimate, prog.totalFiles = true, int64(files)
+			}
+			progCtx, stop := context.WithCancel(ctx)
+			defer stop()
+			go prog.report(progCtx, os.Stderr, time.Second)
+		}
+		var abort context.CancelCauseFunc
+		if config.MaxFiles > 0 {
+			ctx, abort = context.WithCancelCause(ctx)
+			defer abort(nil)
+		}
+		fileResults := listFiles(ctx, roots)
+		if config.MaxFiles > 0 {
+			fileResults = capFiles(fileResults, config.MaxFiles, abort)
+		}
+		if kept != nil {
+			fileResults = kept.files(fileResults)
+		}
+		buckets = stageBuckets(ctx, fileResults, sum)
+		if err := context.Cause(ctx); errors.Is(err, errTooManyFiles) {
+			cancel()
+			return err
+		}
+	}
+	if err := handleBuckets(ctx, buckets, compareFn, sum); err != nil {
 		cancel()
-		<-c
-		slog.Error("received second interrupt; forcing exit")
-		os.Exit(1)
-	}()
+		return err
+	}
+	if sum.partial {
+		slog.Info("reached -max-clusters; stopping early", "clusters", sum.clusterCount)
+		cancel()
+	}
+	if fileState != nil {
+		slog.Info("hashed files", "reused", fileState.hits, "hashed", fileState.misses)
+		if err := fileState.close(); err != nil {
+			slog.Error("failed to write state", "file", config.State, "err", err)
+		}
+	}
+
+	if config.Report != "" {
+		write := writeReportFile
+		if config.ReportAppend {
+			write = appendReportFile
+		}
+		rep, err := sum.report(), error(nil)
+		if config.ReportBase != "" {
+			rep, err = rep.Rel(config.ReportBase)
+		}
+		if err == nil {
+			err = write(config.Report, rep)
+		}
+		if err != nil {
+			slog.Error("failed to write report", "file", config.Report, "err", err)
+		}
+	}
+
+	if freeCheck != nil {
+		freed, err := freeCheck.freed()
+		if err != nil {
+			slog.Error("unable to measure freed space", "err", err)
+		} else {
+			sum.freed = &freed
+			warnIfFreedDiverges(sum.duplicateBytes(), freed)
+		}
+	}
+	if kept != nil {
+		kept.print(os.Stdout)
+	}
+	if script != nil {
+		if err := script.write(os.Stdout, sum); err != nil {
+			return err
+		}
+	}
+	if hashes != nil {
+		if err := hashes.write(os.Stdout); err != nil {
+			return err
+		}
+	}
+	if !config.CountOnly {
+		sum.write(os.Stderr)
+	}
+
+	if config.Watch {
+		return watch(ctx, compareFn)
+	}
+	return nil
+}
 
-	fileResults := compileDirResults(ctx, config.Dirs)
-	buckets := stageBuckets(ctx, fileResults)
+// compareOptions returns the options for comparing files set by config.
+func compareOptions() (dup.Options, error) {
+	var keepPattern *regexp.Regexp
+	if config.KeepRegex != "" {
+		var err error
+		if keepPattern, err = regexp.Compile(config.KeepRegex); err != nil {
+			return dup.Options{}, fmt.Errorf("invalid -keep-regex: %w", err)
+		}
+	}
+	return dup.Options{
+		AllowEmpty:       config.AllowEmpty,
+		Tie:              tiePolicies[config.Tie],
+		CompareMode:      config.CompareMode,
+		AssumeEqual:      config.FromJSON != "" && !config.Verify,
+		FirstBytes:       config.FirstBytes,
+		KeepPattern:      keepPattern,
+		Keep:             keepPolicies[config.Keep],
+		ReportDifference: config.DiffOffset,
+		PreferNewest:     config.PreferNewest,
+		PreferCleanName:  config.Keep == keepCleanestName,
+		PreferSmallAlloc: config.SmallAlloc,
+		ModTimeTolerance: config.MtimeWindow,
+		Decompress:       config.Decompress,
+	}, nil
+}
+
+// handleBuckets compares the files in each bucket and passes every duplicate to config.H,
+// recording the clusters found and the handled duplicates in sum.
+// It returns early, with sum marked partial, once config.MaxClusters clusters have been handled;
+// the caller should then cancel ctx to stop the producer of buckets.
+//
+// The duplicates of each bucket are passed from dup.MatchesFunc to a clusterList,
+// and only handled once the whole bucket is compared:
+// a kept file can still turn out to be a duplicate of a later file until then,
+// and the clusters are checked to make sure every set of identical files keeps at least one copy.
+// If not, nothing more is handled and the error is returned.
+func handleBuckets(ctx context.Context, buckets <-chan []fileResult, compareFn dup.CompareFuncContext[string], sum *summary) error {
+	cmp := func(ctx context.Context, left, right fileResult) (dup.Selection, error) {
+		prog.compare()
+		sum.comparisons.Add(1)
+		sel, err := compareFn(ctx, left.path, right.path)
+		return sel, sizeChanged(left, right, err)
+	}
 	for sizeBucket := range buckets {
 		slog.Debug("comparing files",
-			"files", sizeBucket,
+			"files", paths(sizeBucket),
 			"count", len(sizeBucket),
 		)
-		dups := dup.IndexesContext(ctx, sizeBucket, dup.FilenameFn)
-		for _, i := range dups {
-			slog.Debug("handling duplicate", "file", sizeBucket[i])
-			err := config.H.handle(sizeBucket[i])
-			if err != nil {
-				slog.Error("handler error", "file", sizeBucket[i], "err", err)
+		var found clusterList
+		if err := dup.MatchesFunc(ctx, sizeBucket, cmp, found.add); err != nil {
+			slog.Warn("not every pair of files in the bucket was compared", "size", sizeBucket[0].size, "count", len(sizeBucket), "err", err)
+			sum.incomplete++
+		}
+		prog.done(sizeBucket[0].size * int64(len(sizeBucket)))
+		if sum.flushed != nil {
+			sum.flushed.handle(found.clusters)
+		}
+		if err := checkLastCopy(found.clusters); err != nil {
+			return err
+		}
+		for _, c := range found.clusters {
+			handleCluster(ctx, c, sum)
+			if config.MaxClusters > 0 && sum.clusterCount >= config.MaxClusters {
+				sum.partial = true
+				return nil
 			}
 		}
 	}
-
 	return nil
 }
 
-type handlerFunc func(string) error
+// sizeChanged turns a dup.ErrSizeChanged from comparing left and right into a *dup.OpenError
+// for whichever of them no longer has the size it was listed with,
+// so that it is dropped from the rest of its bucket. Other errors are returned as they are.
+func sizeChanged(left, right fileResult, err error) error {
+	if !errors.Is(err, dup.ErrSizeChanged) {
+		return err
+	}
+	item := dup.Right
+	if fi, statErr := os.Stat(left.path); statErr != nil || fi.Size() != left.size {
+		item = dup.Left
+	}
+	return &dup.OpenError{Item: item, Err: err}
+}
 
-func (f handlerFunc) handle(s string) error {
-	return f(s)
+// handleCluster passes every duplicate in c to config.H.
+// Before that, it merges metadata onto the kept file if config.MergeMeta is set;
+// after, it touches the kept file if config.TouchKept is set, tags it if config.TagKept is set,
+// and renames it if config.Promote is set.
+func handleCluster(ctx context.Context, c cluster, sum *summary) {
+	if c.keep.size < config.MinGroup {
+		slog.Debug("hiding group below -group-threshold-bytes", "keep", c.keep, "size", c.keep.size)
+		sum.hidden++
+		return
+	}
+	if config.Invert {
+		c = invertCluster(c)
+	}
+	sum.addCluster(ctx, c)
+	if len(config.MergeMeta) > 0 {
+		if err := mergeMeta(c, config.MergeMeta); err != nil {
+			slog.Error("failed to merge metadata onto kept file", "file", c.keep, "err", err)
+		}
+	}
+	var times map[string]time.Time
+	if config.TouchKept != "" {
+		times = modTimes(c)
+	}
+	var handled []fileResult
+	for i, d := range c.dups {
+		slog.Debug("handling duplicate", "file", d, "keep", c.keep, "rule", c.rules[i])
+		err := handleSelected(config.H, d.path, c.keep.path, c.rules[i])
+		if errors.Is(err, errHardlinked) {
+			slog.Info("skipping duplicate with other hard links", "file", d)
+			sum.linked++
+			continue
+		}
+		if errors.Is(err, errUntrusted) {
+			slog.Info("leaving duplicate for review", "file", d, "keep", c.keep, "err", err)
+			sum.untrusted++
+			continue
+		}
+		if errors.Is(err, errReplaced) {
+			slog.Info("skipping duplicate", "file", d, "keep", c.keep, "err", err)
+			continue
+		}
+		if errors.Is(err, errInArchive) {
+			slog.Info("leaving duplicate in an archive for review", "file", d, "keep", c.keep)
+			sum.archived++
+			continue
+		}
+		if err != nil {
+			slog.Error("handler error", "file", d, "err", err)
+			continue
+		}
+		sum.add(d)
+		handled = append(handled, d)
+	}
+	if config.TouchKept != "" && len(handled) > 0 {
+		if err := touchKept(c.keep, touchTime(config.TouchKept, times, c.keep, handled)); err != nil {
+			slog.Error("failed to touch kept file", "file", c.keep, "err", err)
+		}
+	}
+	if config.TagKept {
+		if err := tagKept(c.keep, len(handled), time.Now()); err != nil {
+			slog.Error("failed to tag kept file", "file", c.keep, "err", err)
+		}
+	}
+	if config.Promote {
+		if err := promoteKeep(c.keep, handled); err != nil {
+			slog.Error("failed to rename kept file", "file", c.keep, "err", err)
+		}
+	}
 }
 
+type handlerFunc func(file, keep string) error
+
+func (f handlerFunc) handle(file, keep string) error {
+	return f(file, keep)
+}
+
+// handler acts on file, which was found to be a duplicate of keep.
 type handler interface {
-	handle(string) error
+	handle(file, keep string) error
 }
 
 type fileResult struct {
 	path string
 	size int64
+	// root is the directory argument that path was found under.
+	root string
+}
+
+// LogValue logs a fileResult as its path.
+func (fr fileResult) LogValue() slog.Value {
+	return slog.StringValue(fr.path)
 }
 
-func stageBuckets(ctx context.Context, fileResults <-chan fileResult) <-chan []string {
-	buckets := make(map[int64][]string)
+func paths(frs []fileResult) []string {
+	p := make([]string, len(frs))
+	for i, fr := range frs {
+		p[i] = fr.path
+	}
+	return p
+}
+
+// stageBuckets groups fileResults by size, recording each file that passes the size filter in sum.
+// Only buckets containing more than one file are sent to the returned channel.
+// With config.FlushAt set, buckets are sent while the walk continues; see stageBucketsEarly.
+func stageBuckets(ctx context.Context, fileResults <-chan fileResult, sum *summary) <-chan []fileResult {
+	if config.FlushAt > 0 {
+		return stageBucketsEarly(ctx, fileResults, sum)
+	}
+	buckets := make(map[int64][]fileResult)
+	var belowMin, aboveMax int
 	for fr := range fileResults {
-		if fr.size < config.MinSize {
-			slog.Debug("skipping file below MinSize", "size", fr.size, "file", fr.path)
-			continue
-		}
-		if slices.Contains(buckets[fr.size], fr.path) {
-			// this shouldn't happen unless a directory was given twice or one of the given directories was a subdir of another
-			// any other cases should be investigated
-			slog.Debug("path appeared twice in file listing", "file", fr.path)
+		prog.walk()
+		if !stageFile(buckets, fr) {
+			if aboveMaxSize(fr) {
+				aboveMax++
+			} else {
+				belowMin++
+			}
 			continue
 		}
-		buckets[fr.size] = append(buckets[fr.size], fr.path)
+		sum.scanned(fr)
 	}
 	slog.Debug("finished listing directories", "bucket_count", len(buckets))
+	if config.Histogram {
+		newHistogram(buckets, belowMin, aboveMax).write(os.Stderr)
+	}
+
+	var compressed [][]fileResult
+	if config.Decompress {
+		compressed = takeCompressed(ctx, buckets)
+	}
+	sizes := orderSizes(buckets)
+	stage := func(v []fileResult) {
+		orderBucket(v)
+		if len(v) > 1 {
+			prog.stage(v[0].size * int64(len(v)))
+		}
+	}
+	for _, v := range buckets {
+		stage(v)
+	}
+	for _, v := range compressed {
+		stage(v)
+	}
+
+	guard := newMemGuard(config.MaxMem)
+	possibleDuplicates := make(chan []fileResult)
+	go func() {
+		defer close(possibleDuplicates)
+		for _, size := range sizes {
+			if _, ok := sendBucket(ctx, buckets[size], guard, possibleDuplicates); !ok {
+				return
+			}
+		}
+		for _, v := range compressed {
+			if _, ok := sendBucket(ctx, v, guard, possibleDuplicates); !ok {
+				return
+			}
+		}
+	}()
+
+	return possibleDuplicates
+}
 
-	possibleDuplicates := make(chan []string)
+// stageBucketsEarly is stageBuckets for config.FlushAt:
+// a bucket is sent as soon as it holds config.FlushAt files, while the walk continues.
+// Files of the same size found later are held until the walk finishes,
+// and then sent together with the files of the early bucket that handleBuckets didn't find to be duplicates,
+// so that every pair of distinct files is still compared.
+// The rest are sent once the walk finishes.
+func stageBucketsEarly(ctx context.Context, fileResults <-chan fileResult, sum *summary) <-chan []fileResult {
+	guard := newMemGuard(config.MaxMem)
+	possibleDuplicates := make(chan []fileResult)
+	log := newFlushLog()
+	sum.flushed = log
 	go func() {
 		defer close(possibleDuplicates)
-		for _, v := range buckets {
+		buckets := make(map[int64][]fileResult)
+		flushed := make(map[int64][]fileResult)
+		var sent int
+		send := func(v []fileResult) bool {
+			orderBucket(v)
 			if len(v) > 1 {
-				select {
-				case <-ctx.Done():
+				prog.stage(v[0].size * int64(len(v)))
+			}
+			n, ok := sendBucket(ctx, v, guard, possibleDuplicates)
+			sent += n
+			return ok
+		}
+		for fr := range fileResults {
+			prog.walk()
+			if !stageFile(buckets, fr) {
+				continue
+			}
+			sum.scanned(fr)
+			if _, ok := flushed[fr.size]; !ok && len(buckets[fr.size]) >= config.FlushAt {
+				slog.Debug("flushing bucket before the walk finished", "size", fr.size, "count", len(buckets[fr.size]))
+				flushed[fr.size] = buckets[fr.size]
+				delete(buckets, fr.size)
+				if !send(flushed[fr.size]) {
 					return
-				case possibleDuplicates <- v:
 				}
 			}
 		}
+		slog.Debug("finished listing directories", "bucket_count", len(buckets))
+		var late []int64
+		for _, size := range orderSizes(buckets) {
+			if _, ok := flushed[size]; ok {
+				late = append(late, size)
+				continue
+			}
+			if !send(buckets[size]) {
+				return
+			}
+		}
+		if len(late) == 0 || !log.wait(ctx, sent) {
+			return
+		}
+		for _, size := range late {
+			slog.Debug("comparing files found after their bucket was flushed", "size", size, "count", len(buckets[size]))
+			if !send(append(log.survivors(flushed[size]), buckets[size]...)) {
+				return
+			}
+		}
 	}()
-
 	return possibleDuplicates
 }
 
+// flushLog records which files handleBuckets found to be duplicates,
+// and how many buckets it has handled, for stageBucketsEarly.
+type flushLog struct {
+	mu      sync.Mutex
+	handled int
+	dups    map[string]bool
+	// changed is closed and replaced whenever a bucket is handled.
+	changed chan struct{}
+}
+
+func newFlushLog() *flushLog {
+	return &flushLog{dups: make(map[string]bool), changed: make(chan struct{})}
+}
+
+// handle records the duplicates in clusters, which were found in one bucket.
+func (l *flushLog) handle(clusters []cluster) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range clusters {
+		if config.Invert {
+			c = invertCluster(c)
+		}
+		for _, d := range c.dups {
+			l.dups[d.path] = true
+		}
+	}
+	l.handled++
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// wait blocks until sent buckets have been handled.
+// It reports false if ctx is done first.
+func (l *flushLog) wait(ctx context.Context, sent int) bool {
+	for {
+		l.mu.Lock()
+		handled, changed := l.handled, l.changed
+		l.mu.Unlock()
+		if handled >= sent {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// survivors returns the files in v that weren't found to be duplicates.
+func (l *flushLog) survivors(v []fileResult) []fileResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.DeleteFunc(slices.Clone(v), func(fr fileResult) bool { return l.dups[fr.path] })
+}
+
+// aboveMaxSize reports whether fr is larger than config.MaxSize, if it is set.
+func aboveMaxSize(fr fileResult) bool {
+	return config.MaxSize > 0 && fr.size > config.MaxSize
+}
+
+// stageFile adds fr to the bucket for its size.
+// It reports false if fr is below config.MinSize or above config.MaxSize, and true if fr is staged or was already.
+func stageFile(buckets map[int64][]fileResult, fr fileResult) bool {
+	if fr.size < config.MinSize && !(fr.size == 0 && config.AllowEmpty) {
+		slog.Debug("skipping file below MinSize", "size", fr.size, "file", fr.path)
+		return false
+	}
+	if aboveMaxSize(fr) {
+		slog.Debug("skipping file above MaxSize", "size", fr.size, "file", fr.path)
+		return false
+	}
+	if slices.ContainsFunc(buckets[fr.size], func(b fileResult) bool { return b.path == fr.path }) {
+		// this shouldn't happen unless a directory was given twice or one of the given directories was a subdir of another
+		// any other cases should be investigated
+		slog.Debug("path appeared twice in file listing", "file", fr.path)
+		return true
+	}
+	buckets[fr.size] = append(buckets[fr.size], fr)
+	return true
+}
+
+// orderSizes returns the sizes of buckets in the order they are compared.
+func orderSizes(buckets map[int64][]fileResult) []int64 {
+	sizes := make([]int64, 0, len(buckets))
+	for size := range buckets {
+		sizes = append(sizes, size)
+	}
+	switch {
+	case config.LargestFirst:
+		slices.Sort(sizes)
+		slices.Reverse(sizes)
+	case config.Seed != 0:
+		// map iteration and concurrent walks are unordered, so sort everything before shuffling
+		slices.Sort(sizes)
+		rng := rand.New(rand.NewSource(config.Seed))
+		rng.Shuffle(len(sizes), func(i, j int) { sizes[i], sizes[j] = sizes[j], sizes[i] })
+	}
+	return sizes
+}
+
+// orderBucket sorts the files of one bucket into the order they are compared,
+// which decides which file of a tie is kept.
+func orderBucket(bucket []fileResult) {
+	if config.Seed != 0 && !config.LargestFirst {
+		slices.SortFunc(bucket, func(a, b fileResult) int { return strings.Compare(a.path, b.path) })
+	}
+	switch config.CompareOrder {
+	case compareOrderPath:
+		slices.SortFunc(bucket, func(a, b fileResult) int { return strings.Compare(a.path, b.path) })
+	case compareOrderMtime:
+		if len(bucket) > 1 {
+			sortByModTime(bucket)
+		}
+	}
+	if config.WalkOrder == walkOrderArgs {
+		// applied after -seed so that the order of the arguments takes precedence
+		slices.SortStableFunc(bucket, func(a, b fileResult) int {
+			return slices.Index(config.Dirs, a.root) - slices.Index(config.Dirs, b.root)
+		})
+	}
+	if config.Baseline != "" {
+		slices.SortStableFunc(bucket, baselineLast)
+	}
+	if config.KeepLinked && len(bucket) > 1 {
+		slices.SortStableFunc(bucket, linkTargetsLast)
+	}
+}
+
+// sendBucket narrows v down to the files that might be duplicates of each other and sends them to out,
+// split into separate buckets by the options that rule out comparisons.
+// It reports how many buckets it sent, and false if ctx was done first.
+func sendBucket(ctx context.Context, v []fileResult, guard *memGuard, out chan<- []fileResult) (sent int, ok bool) {
+	if len(v) < 2 {
+		return 0, true
+	}
+	size := v[0].size
+	// every file in the bucket is either sent below, and counted once compared, or ruled out here
+	ruledOut := int64(len(v))
+	if config.SkipJunk {
+		if v = knownJunk.filter(ctx, v); len(v) < 2 {
+			prog.done(size * ruledOut)
+			return 0, true
+		}
+	}
+	split := [][]fileResult{v}
+	if config.BucketBy == bucketBySizeExt {
+		split = splitBuckets(split, extKey)
+	}
+	if config.WithinDir {
+		split = splitBuckets(split, dirKey)
+	}
+	if config.MatchNames {
+		split = splitBuckets(split, nameKey)
+	}
+	if config.Prefilter > 0 {
+		// the cheaper splits above may leave files with nothing to compare against, which aren't worth reading
+		split = slices.DeleteFunc(split, func(v []fileResult) bool { return len(v) < 2 })
+		split = splitBuckets(split, partialHashKey(ctx, config.Prefilter))
+	}
+	if config.HashAt > 0 || fileState != nil {
+		split = hashSplit(ctx, split, max(config.HashAt, 2))
+	}
+	for _, v := range split {
+		if len(v) > 1 {
+			ruledOut -= int64(len(v))
+		}
+	}
+	prog.done(size * ruledOut)
+	for _, v := range split {
+		if len(v) < 2 {
+			continue
+		}
+		guard.wait(ctx)
+		select {
+		case <-ctx.Done():
+			return sent, false
+		case out <- v:
+			sent++
+		}
+	}
+	return sent, true
+}
+
+// sortByModTime sorts bucket by modification time, oldest first, and then by path.
+// Files that can't be stat'd sort first.
+func sortByModTime(bucket []fileResult) {
+	mtimes := make(map[string]time.Time, len(bucket))
+	for _, fr := range bucket {
+		fi, err := os.Stat(fr.path)
+		if err != nil {
+			slog.Debug("unable to stat file for sorting", "file", fr, "err", err)
+			continue
+		}
+		mtimes[fr.path] = fi.ModTime()
+	}
+	slices.SortFunc(bucket, func(a, b fileResult) int {
+		if c := mtimes[a.path].Compare(mtimes[b.path]); c != 0 {
+			return c
+		}
+		return strings.Compare(a.path, b.path)
+	})
+}
+
+// splitBuckets splits each of buckets by key, keeping the files with the same key together
+// in the order each key first appears.
+func splitBuckets(buckets [][]fileResult, key func(fileResult) string) [][]fileResult {
+	var split [][]fileResult
+	for _, bucket := range buckets {
+		index := make(map[string]int)
+		for _, fr := range bucket {
+			k := key(fr)
+			i, ok := index[k]
+			if !ok {
+				i = len(split)
+				index[k] = i
+				split = append(split, nil)
+			}
+			split[i] = append(split[i], fr)
+		}
+	}
+	return split
+}
+
+// dirKey is a key for splitBuckets to group files by directory, for -within-only.
+func dirKey(fr fileResult) string {
+	return filepath.Dir(fr.path)
+}
+
+// extKey is a key for splitBuckets to group files by extension, for -bucket-by size+ext.
+func extKey(fr fileResult) string {
+	return strings.ToLower(filepath.Ext(fr.path))
+}
+
+// nameKey is a key for splitBuckets to group files by their name without copy suffixes, for -match-names.
+func nameKey(fr fileResult) string {
+	prefix, _, ext := dup.SplitFileBaseName(filepath.Base(fr.path))
+	return prefix + ext
+}
+
 // compileDirResults walks each of dirs in a separate goroutine and combines the result.
 // The returned channel will be closed when there are no more results.
 // The dirs are split into goroutines because the assumption is that some of the directories may be on different physical disks.
@@ -183,17 +1277,84 @@ func compileDirResults(ctx context.Context, dirs []string) <-chan fileResult {
 }
 
 func listDirFiles(ctx context.Context, rootDir string) <-chan fileResult {
+	if config.ScanTimeout > 0 {
+		return listFSFilesTimeout(ctx, os.DirFS(rootDir), rootDir, config.ScanTimeout)
+	}
+	return listFSFiles(ctx, os.DirFS(rootDir), rootDir)
+}
+
+// listFSFilesTimeout is listFSFiles, but gives up on the walk if it hasn't finished within timeout.
+// The returned channel is closed at the deadline even if the walk is stuck in a read that never returns,
+// such as on an unresponsive network mount; the walk itself stops at its next file, if there is one.
+func listFSFilesTimeout(ctx context.Context, fsys fs.FS, rootDir string, timeout time.Duration) <-chan fileResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	files := listFSFiles(ctx, fsys, rootDir)
+	ch := make(chan fileResult)
+	go func() {
+		defer close(ch)
+		defer cancel()
+		defer func() {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				slog.Error("gave up walking directory", "dir", rootDir, "timeout", timeout)
+			}
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case fr, ok := <-files:
+				if !ok {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- fr:
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// listFSFiles walks fsys and sends every regular file to the returned channel,
+// with paths joined to rootDir.
+// The returned channel will be closed when the walk finishes.
+func listFSFiles(ctx context.Context, fsys fs.FS, rootDir string) <-chan fileResult {
 	slog.Debug("walking directory", "dir", rootDir)
 	ch := make(chan fileResult)
 	go func(rootDir string) {
 		defer close(ch)
-		var walkDirFn fs.WalkDirFunc = func(path string, d fs.DirEntry, err error) error {
+		// with config.FollowLinks, dirs holds every directory walked so far,
+		// so that a symlink back up the tree, or to a directory that was already walked, isn't followed again
+		var dirs map[fileid.FileID]bool
+		if config.FollowLinks {
+			dirs = make(map[fileid.FileID]bool)
+		}
+		var walkDirFn fs.WalkDirFunc
+		walkDirFn = func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
-				slog.Error("unable to access file", "path", path, "err", err)
-				return err
+				slog.Error("unable to access file", "path", filepath.Join(rootDir, path), "err", err)
+				if config.OnError == onErrorStop {
+					return err
+				}
+				// returning nil for a directory that failed to be read skips its contents
+				return nil
 			}
 
+			// excluded is checked before d.Info so that excluded trees cost no stat calls
+			if path != "." && excluded(filepath.Join(rootDir, path)) {
+				slog.Debug("skipping excluded path", "path", filepath.Join(rootDir, path))
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
 			if d.IsDir() {
+				if dirs != nil && !firstVisit(dirs, filepath.Join(rootDir, path)) {
+					slog.Debug("skipping directory that was already walked", "path", filepath.Join(rootDir, path))
+					return fs.SkipDir
+				}
 				return nil
 			}
 			fi, err := d.Info()
@@ -203,12 +1364,43 @@ func listDirFiles(ctx context.Context, rootDir string) <-chan fileResult {
 			}
 
 			if isSymlink(fi) {
+				// symlinks to files are never followed: removing one reclaims nothing,
+				// and keeping it in place of its own target would leave it broken
+				if config.FollowLinks {
+					if target, err := fs.Stat(fsys, path); err == nil && target.IsDir() {
+						slog.Debug("following symlink to directory", "path", filepath.Join(rootDir, path))
+						return fs.WalkDir(fsys, path, walkDirFn)
+					}
+				}
+				if config.KeepLinked {
+					symlinkTargets.add(filepath.Join(rootDir, path))
+				}
+				return nil
+			}
+			if config.IntoArchive && isArchive(path) {
+				members, err := archiveMembers(filepath.Join(rootDir, path), rootDir)
+				if err != nil {
+					slog.Error("unable to list archive", "path", filepath.Join(rootDir, path), "err", err)
+				}
+				for _, fr := range members {
+					if !hasExtension(fr.path, config.Extensions) {
+						continue
+					}
+					select {
+					case <-ctx.Done():
+						return fs.SkipAll
+					case ch <- fr:
+					}
+				}
+			}
+			if !hasExtension(path, config.Extensions) {
 				return nil
 			}
 
 			fr := fileResult{
 				path: filepath.Join(rootDir, path),
 				size: fi.Size(),
+				root: rootDir,
 			}
 			select {
 			case <-ctx.Done():
@@ -217,24 +1409,258 @@ func listDirFiles(ctx context.Context, rootDir string) <-chan fileResult {
 			}
 			return nil
 		}
-		dirFS := os.DirFS(rootDir)
-		fs.WalkDir(dirFS, ".", walkDirFn)
+		fs.WalkDir(fsys, ".", walkDirFn)
 	}(rootDir)
 
 	return ch
 }
 
+// firstVisit records the directory at path in dirs, and reports whether it wasn't there yet.
+// A directory that can't be identified is reported as already visited, so that symlinks into it aren't followed.
+func firstVisit(dirs map[fileid.FileID]bool, path string) bool {
+	id, err := fileid.Stat(path)
+	if err != nil {
+		slog.Error("unable to identify directory", "path", path, "err", err)
+		return false
+	}
+	id.Nlink = 0
+	if dirs[id] {
+		return false
+	}
+	dirs[id] = true
+	return true
+}
+
+// parseExtensions splits a comma-separated list of file extensions
+// into lowercase extensions without a leading dot.
+func parseExtensions(list string) []string {
+	var exts []string
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// hasExtension reports whether name ends in one of exts, ignoring case.
+// An extension may have more than one part, such as "tar.gz".
+// Every name matches an empty exts.
+func hasExtension(name string, exts []string) bool {
+	if len(exts) == 0 {
+		return true
+	}
+	name = strings.ToLower(filepath.Base(name))
+	return slices.ContainsFunc(exts, func(ext string) bool { return strings.HasSuffix(name, "."+ext) })
+}
+
 func isSymlink(fi fs.FileInfo) bool {
 	return fi.Mode()&fs.ModeSymlink != 0
 }
 
-var deleteHandler handlerFunc = func(file string) error {
+var deleteHandler handlerFunc = func(file, _ string) error {
 	slog.Info("removing file", "file", file)
-	return os.Remove(file)
+	if err := os.Remove(file); err != nil {
+		return err
+	}
+	return syncParent(file)
+}
+
+// linkHandler replaces file with a hard link to keep.
+//
+// The link is created under a temporary name and renamed over file,
+// so file is never missing if linking fails.
+var linkHandler handlerFunc = func(file, keep string) error {
+	slog.Info("linking file", "file", file, "keep", keep)
+	tmp := file + ".dedup-link"
+	if err := os.Link(keep, tmp); err != nil {
+		if isCrossDevice(err) {
+			// copying keep over file instead would rewrite the data without reclaiming any space
+			return fmt.Errorf("%w: %s is on a different filesystem than %s", errCrossDevice, file, keep)
+		}
+		return err
+	}
+	if config.VerifyLink != verifyLinkOff {
+		if err := verifyLink(tmp, keep); err != nil {
+			if config.VerifyLink == verifyLinkRollback {
+				return errors.Join(err, os.Remove(tmp))
+			}
+			slog.Warn("hard link verification failed", "file", file, "keep", keep, "err", err)
+		}
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return errors.Join(err, os.Remove(tmp))
+	}
+	return syncParent(file)
+}
+
+// symlinkHandler replaces file with a symbolic link to the absolute path of keep,
+// so the link works from anywhere. Like linkHandler, it renames the link over file.
+//
+// A file that is already a symbolic link, e.g. replaced by an earlier pair, is skipped with errReplaced,
+// and so is a link that would point to itself.
+var symlinkHandler handlerFunc = func(file, keep string) error {
+	fi, err := os.Lstat(file)
+	if err != nil {
+		return err
+	}
+	if isSymlink(fi) {
+		return fmt.Errorf("%w: %s is already a symbolic link", errReplaced, file)
+	}
+	target, err := filepath.EvalSymlinks(keep)
+	if err != nil {
+		return err
+	}
+	if target, err = filepath.Abs(target); err != nil {
+		return err
+	}
+	self, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	if self == target {
+		return fmt.Errorf("%w: %s would link to itself", errReplaced, file)
+	}
+	slog.Info("symlinking file", "file", file, "target", target)
+	tmp := file + ".dedup-link"
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return errors.Join(err, os.Remove(tmp))
+	}
+	return syncParent(file)
+}
+
+// errReplaced is returned by symlinkHandler for a duplicate that doesn't need to be replaced. It is left untouched.
+var errReplaced = errors.New("already replaced")
+
+// dangerousRoot reports whether dir is the root of a filesystem or the user's home directory,
+// after making it absolute and resolving symlinks.
+func dangerousRoot(dir string) bool {
+	d := resolvePath(dir)
+	if d == filepath.VolumeName(d)+string(filepath.Separator) {
+		return true
+	}
+	home, err := os.UserHomeDir()
+	return err == nil && d == resolvePath(home)
+}
+
+// resolvePath makes p absolute and resolves symlinks in it.
+// If p doesn't exist yet, its nearest parent that does is resolved instead.
+func resolvePath(p string) string {
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	p = filepath.Clean(p)
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		return resolved
+	}
+	if dir := filepath.Dir(p); dir != p {
+		return filepath.Join(resolvePath(dir), filepath.Base(p))
+	}
+	return p
+}
+
+// errCrossDevice is returned by linkHandler for a duplicate that can't be linked
+// because it is on a different filesystem than the file that was kept. The duplicate is left untouched.
+var errCrossDevice = errors.New("can't hard link across filesystems")
+
+// verifyLink returns an error if link and target are not the same file,
+// which can happen on filesystems that silently copy instead of linking.
+func verifyLink(link, target string) error {
+	li, err := os.Stat(link)
+	if err != nil {
+		return err
+	}
+	ti, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(li, ti) {
+		return fmt.Errorf("%s is not a hard link to %s", link, target)
+	}
+	return nil
+}
+
+// syncParent flushes the directory entry changes for file to disk when config.Fsync is set.
+// Renames, links, and removes only modify the parent directory,
+// so syncing the file itself is not enough to make them durable.
+func syncParent(file string) error {
+	if !config.Fsync {
+		return nil
+	}
+	d, err := os.Open(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("fsync %s: %w", d.Name(), err)
+	}
+	return nil
+}
+
+// countHandler counts duplicates without touching them.
+type countHandler struct {
+	n int
+}
+
+func (c *countHandler) handle(_, _ string) error {
+	c.n++
+	return nil
+}
+
+// countErrorStatus is the exit status for an error with -count-only,
+// which no number of duplicates exits with.
+const countErrorStatus = 255
+
+// countExitCode converts a duplicate count into a process exit status for -count-only.
+// Exit statuses are limited to a single byte, so counts above 254 are capped rather than wrapping around to 0,
+// leaving countErrorStatus for errors.
+func countExitCode(n int) int {
+	return min(n, countErrorStatus-1)
+}
+
+// fatal logs err and exits, with countErrorStatus for -count-only so that the error isn't read as a count.
+func fatal(err error) {
+	log.Print(err)
+	if config.CountOnly {
+		os.Exit(countErrorStatus)
+	}
+	os.Exit(1)
+}
+
+var noopHandler handlerFunc = func(_, _ string) error {
+	return nil
+}
+
+// errHardlinked is returned by skipHardlinked for files with more than one hard link.
+var errHardlinked = errors.New("file has other hard links")
+
+// skipHardlinked wraps h to refuse files that have more than one hard link.
+func skipHardlinked(h handler) ruleFunc {
+	return func(file, keep string, rule dup.Rule) error {
+		id, err := fileid.Stat(file)
+		if err != nil {
+			return err
+		}
+		if id.Nlink > 1 {
+			return errHardlinked
+		}
+		return handleSelected(h, file, keep, rule)
+	}
 }
 
 func dryRun(h handler) handlerFunc {
-	return func(file string) error {
+	if e, ok := h.(execHandler); ok {
+		return func(file, keep string) error {
+			fmt.Println(e.String(file, keep))
+			return nil
+		}
+	}
+	return func(file, _ string) error {
 		fmt.Println(file)
 		return nil
 	}
@@ -247,5 +1673,285 @@ func validConfig() error {
 	if len(config.Dirs) < 1 {
 		return errors.New("no directories given")
 	}
+	if config.Execute && !config.AllowDanger && config.FromJSON == "" {
+		for _, d := range config.Dirs {
+			if dangerousRoot(d) {
+				return fmt.Errorf("refusing to run -x on %s, which is a filesystem root or your home directory; add -allow-dangerous-roots if you really mean it", d)
+			}
+		}
+	}
+	switch config.OnError {
+	case onErrorContinue, onErrorStop:
+	default:
+		return fmt.Errorf("invalid -on-error value %q", config.OnError)
+	}
+	switch config.Action {
+	case actionDelete, actionHardlink, actionSymlink, actionMove:
+	default:
+		return fmt.Errorf("invalid -action value %q", config.Action)
+	}
+	switch config.VerifyLink {
+	case verifyLinkOff, verifyLinkWarn, verifyLinkRollback:
+	default:
+		return fmt.Errorf("invalid -verify-link value %q", config.VerifyLink)
+	}
+	switch config.TouchKept {
+	case "", touchNow, touchOldest, touchNewest:
+	default:
+		return fmt.Errorf("invalid -touch-kept value %q", config.TouchKept)
+	}
+	if config.TouchKept != "" && slices.Contains(config.MergeMeta, mergeMtime) {
+		return errors.New("-touch-kept and -merge-meta mtime both set the modification time and can't be combined")
+	}
+	if slices.Contains(config.MergeMeta, mergeXattrs) && !dup.XattrSupported {
+		return fmt.Errorf("-merge-meta xattrs is not supported on %s", runtime.GOOS)
+	}
+	if len(config.MergeMeta) > 0 && config.CountOnly {
+		return errors.New("-merge-meta can't be combined with -count-only")
+	}
+	if config.TagKept && !dup.XattrSupported {
+		return fmt.Errorf("-tag-kept is not supported on %s", runtime.GOOS)
+	}
+	if config.TagKept && config.CountOnly {
+		return errors.New("-tag-kept can't be combined with -count-only")
+	}
+	if config.TouchKept != "" && config.CountOnly {
+		return errors.New("-touch-kept can't be combined with -count-only")
+	}
+	if config.Decompress && (config.BufferFiles > 0 || config.Prefilter > 0 || config.FirstBytes > 0 || config.FlushAt > 0 || config.IntoArchive) {
+		return errors.New("-compare-decompressed can't be combined with -compare-buffer-reuse, -prefilter-partial-hash-bytes, -first-bytes, -partial-bucket-flush, or -into-archives, which compare the compressed bytes")
+	}
+	if config.MaxFiles < 0 {
+		return errors.New("-max-files must not be negative")
+	}
+	if config.MaxFiles > 0 && config.FlushAt > 0 {
+		return errors.New("-max-files can't be combined with -partial-bucket-flush, which compares files before the walk is over")
+	}
+	if config.Pretty && config.Report == "" {
+		return errors.New("-pretty requires -report")
+	}
+	if config.ReportAppend && config.Report == "" {
+		return errors.New("-report-append requires -report")
+	}
+	if config.HashAt < 0 || config.HashAt == 1 {
+		return errors.New("-hash-buckets must be 0 or at least 2")
+	}
+	if config.HashAt > 0 && (config.FirstBytes > 0 || config.Decompress || config.IntoArchive) {
+		return errors.New("-hash-buckets can't be combined with -first-bytes, -compare-decompressed, or -into-archives, which don't compare whole files")
+	}
+	if config.State != "" && (config.FirstBytes > 0 || config.Decompress || config.IntoArchive) {
+		return errors.New("-state can't be combined with -first-bytes, -compare-decompressed, or -into-archives, which don't compare whole files")
+	}
+	if config.State != "" && (config.Watch || config.FromJSON != "" || config.Inodes || config.ListCompare || config.Mode != modeExact) {
+		return errors.New("-state can't be combined with -watch, -from-json, -inodes, -list-comparisons, or -mode phash")
+	}
+	if config.Prefilter < 0 {
+		return errors.New("-prefilter-partial-hash-bytes must not be negative")
+	}
+	if config.Prefilter > 0 && config.FirstBytes > 0 {
+		return errors.New("-prefilter-partial-hash-bytes can't be combined with -first-bytes, which ignores the end of files")
+	}
+	if config.Exec != nil && (config.Format == formatScript || config.Promote) {
+		return errors.New("-exec replaces -action and can't be combined with -format script or -promote")
+	}
+	if config.Baseline != "" && (config.Watch || config.FromJSON != "" || config.Inodes) {
+		return errors.New("-baseline can't be combined with -watch, -from-json, or -inodes")
+	}
+	for _, d := range config.Dirs {
+		if rel, err := filepath.Rel(d, config.Baseline); config.Baseline != "" && (inBaseline(d) || err == nil && filepath.IsLocal(rel)) {
+			return fmt.Errorf("-baseline %s overlaps directory %s", config.Baseline, d)
+		}
+	}
+	if (config.Action == actionMove) != (config.Trash != "") {
+		return errors.New("-action move and -trash must be given together")
+	}
+	for _, d := range config.Dirs {
+		if config.Trash == "" {
+			break
+		}
+		if rel, err := filepath.Rel(resolvePath(d), resolvePath(config.Trash)); err == nil && filepath.IsLocal(rel) {
+			return fmt.Errorf("-trash %s is inside directory %s", config.Trash, d)
+		}
+	}
+	if config.KeepLinked && (config.Watch || config.FromJSON != "") {
+		return errors.New("-preserve-symlinks-as-originals can't be combined with -watch or -from-json")
+	}
+	if config.MinGroup > 0 && config.Execute {
+		return errors.New("-group-threshold-bytes only filters what is reported and can't be combined with -x")
+	}
+	if config.ScanTimeout < 0 {
+		return errors.New("-scan-timeout-per-dir must not be negative")
+	}
+	if config.MtimeWindow < 0 {
+		return errors.New("-mtime-tolerance must not be negative")
+	}
+	switch config.CompareOrder {
+	case compareOrderWalk, compareOrderPath, compareOrderMtime:
+	default:
+		return fmt.Errorf("invalid -comparison-order value %q", config.CompareOrder)
+	}
+	switch config.Units {
+	case unitsIEC, unitsSI:
+	default:
+		return fmt.Errorf("invalid -units value %q", config.Units)
+	}
+	switch config.BucketBy {
+	case bucketBySize, bucketBySizeExt:
+	default:
+		return fmt.Errorf("invalid -bucket-by value %q", config.BucketBy)
+	}
+	switch config.WalkOrder {
+	case walkOrderParallel, walkOrderArgs:
+	default:
+		return fmt.Errorf("invalid -walk-order value %q", config.WalkOrder)
+	}
+	switch config.Format {
+	case formatText:
+	case formatScript:
+		if config.Execute || config.CountOnly || config.PrintKept || config.Watch || config.Promote {
+			return errors.New("-format script replaces -x and can't be combined with -count-only, -print-kept, -watch, or -promote")
+		}
+	case formatHashes:
+		if config.Execute || config.CountOnly || config.PrintKept || config.Watch || config.Promote || config.Exec != nil {
+			return errors.New("-format hashes replaces -x and can't be combined with -count-only, -print-kept, -watch, -promote, or -exec")
+		}
+	case formatJSON:
+		if config.Execute || config.CountOnly || config.PrintKept || config.Promote || config.Exec != nil {
+			return errors.New("-format json replaces -x and can't be combined with -count-only, -print-kept, -promote, or -exec")
+		}
+	default:
+		return fmt.Errorf("invalid -format value %q", config.Format)
+	}
+	if _, ok := tiePolicies[config.Tie]; !ok {
+		return fmt.Errorf("invalid -tie value %q", config.Tie)
+	}
+	if _, ok := hashAlgorithms[config.Hash]; config.Hash != "" && !ok {
+		return fmt.Errorf("invalid -hash value %q", config.Hash)
+	}
+	if config.FromJSON != "" && (config.Watch || config.PrintKept) {
+		return errors.New("-from-json can't be combined with -watch or -print-kept")
+	}
+	if config.Verify && config.FromJSON == "" {
+		return errors.New("-verify requires -from-json")
+	}
+	if config.Watch && (config.CountOnly || config.PrintKept || config.MaxClusters > 0) {
+		return errors.New("-watch can't be combined with -count-only, -print-kept, or -max-clusters")
+	}
+	if config.FirstBytes < 0 {
+		return errors.New("-first-bytes can't be negative")
+	}
+	if config.FirstBytes > 0 && !config.AcceptRisk {
+		return errors.New("-first-bytes can treat different files as duplicates; add -i-understand-the-risk to use it")
+	}
+	if config.Invert && config.Execute && !config.AcceptRisk {
+		return errors.New("-invert handles the files the rules chose to keep; add -i-understand-the-risk to use it with -x")
+	}
+	if config.Invert && config.Promote {
+		return errors.New("-invert and -promote can't be combined")
+	}
+	if config.Invert && (config.Baseline != "" || config.KeepLinked) {
+		// inverting would handle the very files those options promise never to touch
+		return errors.New("-invert can't be combined with -baseline or -preserve-symlinks-as-originals, which protect the files that are kept")
+	}
+	if config.LargestFirst && config.Seed != 0 {
+		return errors.New("-largest-first and -seed can't be combined")
+	}
+	if config.MaxMem < 0 {
+		return errors.New("-max-mem can't be negative")
+	}
+	if config.MaxClusters < 0 {
+		return errors.New("-max-clusters can't be negative")
+	}
+	if config.Watch && (config.Invert || config.MergeMeta != nil || config.TouchKept != "" || config.TagKept || config.MinGroup > 0) {
+		// these are applied to whole groups of identical files, which -watch never forms
+		return errors.New("-watch can't be combined with -invert, -merge-meta, -touch-kept, -tag-kept, or -group-threshold-bytes")
+	}
+	if config.Watch && config.WatchSettle <= 0 {
+		return errors.New("-watch-settle must be positive")
+	}
+	if config.CheckFreed && !config.Execute {
+		return errors.New("-check-freed requires -x")
+	}
+	if config.CountOnly && config.PrintKept {
+		return errors.New("-count-only and -print-kept can't be combined")
+	}
+	if config.CountOnly && config.Execute {
+		return errors.New("-count-only never deletes and can't be combined with -x")
+	}
+	if config.Inodes && (config.Execute || config.Watch || config.CountOnly || config.PrintKept || config.FromJSON != "") {
+		return errors.New("-inodes only reports and can't be combined with -x, -watch, -count-only, -print-kept, or -from-json")
+	}
+	if config.FlushAt < 0 || config.FlushAt == 1 {
+		return errors.New("-partial-bucket-flush must be 0 or at least 2")
+	}
+	if config.FlushAt > 0 && (config.LargestFirst || config.Histogram || config.MaxClusters > 0 || config.Estimate) {
+		return errors.New("-partial-bucket-flush can't be combined with -largest-first, -histogram, -max-clusters, or -estimate, which need the whole walk first")
+	}
+	if config.FlushAt > 0 && config.KeepLinked {
+		return errors.New("-partial-bucket-flush can't be combined with -preserve-symlinks-as-originals, which needs every symlink found by the walk first")
+	}
+	if config.FlushAt > 0 && config.ListCompare {
+		return errors.New("-partial-bucket-flush can't be combined with -list-comparisons, which doesn't find the duplicates that files found later are compared without")
+	}
+	if config.ReportBase != "" && config.Report == "" && config.FromJSON == "" {
+		return errors.New("-report-relative-to requires -report or -from-json")
+	}
+	if config.IntoArchive && (config.Watch || config.FromJSON != "" || config.Prefilter > 0 || config.SkipJunk || config.Hash != "" || config.MergeMeta != nil || config.TouchKept != "" || config.TagKept || config.Promote) {
+		return errors.New("-into-archives can't be combined with -watch, -from-json, -prefilter-partial-hash-bytes, -skip-known-junk, -hash, -merge-meta, -touch-kept, -tag-kept, or -promote")
+	}
+	if config.IntoArchive && (config.Format == formatJSON || config.Format == formatHashes) {
+		// both write each duplicate from the file on disk, which an archive member doesn't have
+		return errors.New("-into-archives can't be combined with -format json or hashes")
+	}
+	if config.ShutdownWait < 0 {
+		return errors.New("-shutdown-timeout can't be negative")
+	}
+	if config.VerifyShare > 0 && (config.FromJSON == "" || config.Verify) {
+		return errors.New("-verify-sample requires -from-json and can't be combined with -verify, which compares every group")
+	}
+	if config.Estimate && (config.Watch || config.FromJSON != "" || config.ListCompare) {
+		return errors.New("-estimate can't be combined with -watch, -from-json, or -list-comparisons")
+	}
+	if config.MaxSize > 0 && config.MaxSize < config.MinSize {
+		return errors.New("-max-size can't be smaller than -min-size")
+	}
+	if config.FromStdin && (config.Watch || config.FromJSON != "" || config.Baseline != "" || config.Estimate || config.ListRoots) {
+		return errors.New("-from-stdin can't be combined with -watch, -from-json, -baseline, -estimate, or -list-roots, which need directories to walk")
+	}
+	if config.FollowLinks && config.Watch {
+		return errors.New("-follow-symlinks can't be combined with -watch, which doesn't watch linked directories")
+	}
+	if config.Progress && (config.Watch || config.FromJSON != "" || config.ListCompare) {
+		return errors.New("-progress can't be combined with -watch, -from-json, or -list-comparisons")
+	}
+	if config.ListCompare && (config.Execute || config.Watch || config.Inodes || config.FromJSON != "" || config.Mode != modeExact) {
+		return errors.New("-list-comparisons only reports and can't be combined with -x, -watch, -inodes, -from-json, or -mode phash")
+	}
+	if p, ok := keepPolicies[config.Keep]; !ok {
+		return fmt.Errorf("invalid -keep value %q", config.Keep)
+	} else if config.PreferNewest && p != dup.KeepHeuristic && p != dup.KeepNewest {
+		return fmt.Errorf("-keep-newest can't be combined with -keep %s", config.Keep)
+	}
+	switch config.Mode {
+	case modeExact:
+	case modePhash:
+		if config.Execute || config.Watch || config.Inodes || config.FromJSON != "" || config.Report != "" {
+			return errors.New("-mode phash only reports and can't be combined with -x, -watch, -inodes, -from-json, or -report")
+		}
+		if config.PhashDist < 0 || config.PhashDist > 64 {
+			return fmt.Errorf("invalid -phash-distance %d", config.PhashDist)
+		}
+	default:
+		return fmt.Errorf("invalid -mode value %q", config.Mode)
+	}
+	if config.Promote && (config.Action != actionDelete || config.CountOnly || config.PrintKept) {
+		return errors.New("-promote requires -action delete and can't be combined with -count-only or -print-kept")
+	}
+	if config.SmallAlloc && runtime.GOOS == "windows" {
+		return errors.New("-keep-smallest-allocation is not supported on windows")
+	}
+	if config.CompareXattr && !dup.XattrSupported {
+		return fmt.Errorf("-compare-xattr is not supported on %s", runtime.GOOS)
+	}
 	return nil
 }
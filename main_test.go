@@ -0,0 +1,3158 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/Travis-Britz/dedup/dup"
+	"github.com/Travis-Britz/dedup/report"
+	"github.com/fsnotify/fsnotify"
+)
+
+// errFS wraps an fs.FS and fails to open any of the names in deny with fs.ErrPermission.
+type errFS struct {
+	fs.FS
+	deny []string
+}
+
+func (e errFS) Open(name string) (fs.File, error) {
+	if slices.Contains(e.deny, name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return e.FS.Open(name)
+}
+
+// blockFS wraps an fs.FS and blocks on opening block until release is closed, like an unresponsive mount.
+type blockFS struct {
+	fs.FS
+	block   string
+	release chan struct{}
+}
+
+func (b blockFS) Open(name string) (fs.File, error) {
+	if name == b.block {
+		<-b.release
+	}
+	return b.FS.Open(name)
+}
+
+func collectPaths(ch <-chan fileResult) []string {
+	var paths []string
+	for fr := range ch {
+		paths = append(paths, fr.path)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+func TestListFSFilesOnError(t *testing.T) {
+	fsys := errFS{
+		FS: fstest.MapFS{
+			"a/1.txt":      {Data: []byte("1")},
+			"locked/2.txt": {Data: []byte("2")},
+			"z/3.txt":      {Data: []byte("3")},
+		},
+		deny: []string{"locked"},
+	}
+
+	tt := map[string][]string{
+		onErrorContinue: {filepath.Join("root", "a", "1.txt"), filepath.Join("root", "z", "3.txt")},
+		onErrorStop:     {filepath.Join("root", "a", "1.txt")},
+	}
+	defer func(policy string) { config.OnError = policy }(config.OnError)
+	for policy, want := range tt {
+		config.OnError = policy
+		got := collectPaths(listFSFiles(context.Background(), fsys, "root"))
+		if !slices.Equal(got, want) {
+			t.Errorf("-on-error=%s: expected %q; got %q", policy, want, got)
+		}
+	}
+}
+
+func TestStageBucketsLargestFirst(t *testing.T) {
+	defer func(b bool) { config.LargestFirst = b }(config.LargestFirst)
+	config.LargestFirst = true
+
+	sizes := []int64{4096, 1 << 20, 8192, 1 << 30, 1 << 16}
+	fr := make(chan fileResult, len(sizes)*2)
+	for _, size := range sizes {
+		fr <- fileResult{path: fmt.Sprintf("a/%d", size), size: size}
+		fr <- fileResult{path: fmt.Sprintf("b/%d", size), size: size}
+	}
+	close(fr)
+
+	var got []string
+	for bucket := range stageBuckets(context.Background(), fr, newSummary(nil)) {
+		got = append(got, bucket[0].path)
+	}
+	want := []string{"a/1073741824", "a/1048576", "a/65536", "a/8192", "a/4096"}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected buckets in order %q; got %q", want, got)
+	}
+}
+
+func TestCountExitCode(t *testing.T) {
+	tt := map[int]int{
+		0:    0,
+		1:    1,
+		42:   42,
+		254:  254,
+		255:  254,
+		1000: 254,
+	}
+	for count, want := range tt {
+		if got := countExitCode(count); got != want {
+			t.Errorf("%d duplicates: expected exit code %d; got %d", count, want, got)
+		}
+	}
+}
+
+func TestCountOnlyError(t *testing.T) {
+	if os.Getenv("DEDUP_TEST_COUNT_ONLY_ERROR") == "1" {
+		// rejected by validConfig
+		config.CountOnly, config.Execute = true, true
+		config.H = &countHandler{}
+		if err := run(); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCountOnlyError$")
+	cmd.Env = append(os.Environ(), "DEDUP_TEST_COUNT_ONLY_ERROR=1")
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != countErrorStatus {
+		t.Errorf("expected an error with -count-only to exit %d; got %v", countErrorStatus, err)
+	}
+}
+
+// writeFiles creates each file in files under dir with the given content.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSummaryByRoot(t *testing.T) {
+	defer func(h handler, minSize int64) { config.H, config.MinSize = h, minSize }(config.H, config.MinSize)
+	config.H = handlerFunc(func(_, _ string) error { return nil })
+	config.MinSize = 0
+
+	downloads, pictures := t.TempDir(), t.TempDir()
+	writeFiles(t, downloads, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"flowers (2).jpg": "petals",
+		"song.mp3":        "la la",
+	})
+	writeFiles(t, pictures, map[string]string{
+		"song (1).mp3": "la la",
+		"unique.txt":   "unique",
+	})
+
+	ctx := context.Background()
+	roots := []string{downloads, pictures}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+	want := map[string]rootStats{
+		downloads: {Duplicates: 2, Bytes: 12},
+		pictures:  {Duplicates: 1, Bytes: 5},
+	}
+	for root, rs := range want {
+		if got := *sum.byRoot[root]; got != rs {
+			t.Errorf("%s: expected %+v; got %+v", root, rs, got)
+		}
+	}
+}
+
+func TestLinkHandlerVerify(t *testing.T) {
+	defer func(v string) { config.VerifyLink = v }(config.VerifyLink)
+	config.VerifyLink = verifyLinkRollback
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+	})
+	keep, file := filepath.Join(dir, "flowers.jpg"), filepath.Join(dir, "flowers (1).jpg")
+
+	if err := verifyLink(file, keep); err == nil {
+		t.Error("expected verification of two separate files to fail")
+	}
+	if err := linkHandler(file, keep); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyLink(file, keep); err != nil {
+		t.Errorf("expected %s to be linked to %s: %v", file, keep, err)
+	}
+	if _, err := os.Stat(file + ".dedup-link"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected temporary link to be gone; got %v", err)
+	}
+}
+
+func TestMoveHandler(t *testing.T) {
+	defer func(dirs []string, trash string) { config.Dirs, config.Trash = dirs, trash }(config.Dirs, config.Trash)
+	dir, trash := t.TempDir(), t.TempDir()
+	config.Dirs, config.Trash = []string{dir}, trash
+	writeFiles(t, dir, map[string]string{
+		"photos/flowers.jpg":     "petals",
+		"photos/flowers (1).jpg": "petals",
+		"photos/flowers (2).jpg": "petals",
+	})
+	// left over from an earlier run
+	writeFiles(t, trash, map[string]string{"photos/flowers (1).jpg": "thorns"})
+	keep := filepath.Join(dir, "photos/flowers.jpg")
+
+	if err := moveHandler(filepath.Join(dir, "photos/flowers (1).jpg"), keep); err != nil {
+		t.Fatal(err)
+	}
+	// the fallback for a trash directory on another filesystem
+	if err := copyRemove(filepath.Join(dir, "photos/flowers (2).jpg"), filepath.Join(trash, "photos/flowers (2).jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"photos/flowers (1).jpg":   "thorns",
+		"photos/flowers (1).1.jpg": "petals",
+		"photos/flowers (2).jpg":   "petals",
+	} {
+		if b, err := os.ReadFile(filepath.Join(trash, name)); err != nil || string(b) != want {
+			t.Errorf("%s: expected %q in the trash; got %q, %v", name, want, b, err)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "photos"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "flowers.jpg" {
+		t.Errorf("expected only the kept file to be left; got %v", entries)
+	}
+
+	// two moves racing for the same name each claim their own
+	file := filepath.Join(dir, "photos/roses.jpg")
+	var claimed []string
+	for range 2 {
+		dest, err := claimTrashPath(trash, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claimed = append(claimed, filepath.Base(dest))
+	}
+	if want := []string{"roses.jpg", "roses.1.jpg"}; !slices.Equal(claimed, want) {
+		t.Errorf("expected %q to be claimed; got %q", want, claimed)
+	}
+}
+
+func TestFsyncHandlers(t *testing.T) {
+	defer func(dirs []string, trash string, fsync bool) {
+		config.Dirs, config.Trash, config.Fsync = dirs, trash, fsync
+	}(config.Dirs, config.Trash, config.Fsync)
+	dir, trash := t.TempDir(), t.TempDir()
+	config.Dirs, config.Trash, config.Fsync = []string{dir}, trash, true
+	writeFiles(t, dir, map[string]string{
+		"photos/flowers.jpg":     "petals",
+		"photos/flowers (1).jpg": "petals",
+		"photos/flowers (2).jpg": "petals",
+		"photos/flowers (3).jpg": "petals",
+	})
+	keep := filepath.Join(dir, "photos/flowers.jpg")
+
+	if err := linkHandler(filepath.Join(dir, "photos/flowers (1).jpg"), keep); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+	if err := moveHandler(filepath.Join(dir, "photos/flowers (2).jpg"), keep); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if err := deleteHandler(filepath.Join(dir, "photos/flowers (3).jpg"), keep); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if !sameFile(filepath.Join(dir, "photos/flowers (1).jpg"), keep) {
+		t.Error("expected the linked file to be a hard link to the kept file")
+	}
+	if b, err := os.ReadFile(filepath.Join(trash, "photos/flowers (2).jpg")); err != nil || string(b) != "petals" {
+		t.Errorf("expected the moved file in the trash; got %q, %v", b, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "photos/flowers (3).jpg")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the deleted file to be gone; got %v", err)
+	}
+}
+
+func TestTrashInsideDirectory(t *testing.T) {
+	defer func(h handler, dirs []string, action, trash string) {
+		config.H, config.Dirs, config.Action, config.Trash = h, dirs, action, trash
+	}(config.H, config.Dirs, config.Action, config.Trash)
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil {
+		t.Skip(err)
+	}
+	config.H, config.Action = noopHandler, actionMove
+
+	// the trash doesn't exist yet, and is absolute while the directory is relative
+	config.Dirs, config.Trash = []string{rel}, filepath.Join(dir, ".trash")
+	if err := validConfig(); err == nil || !strings.Contains(err.Error(), "inside directory") {
+		t.Errorf("expected a trash inside the directory to be refused; got %v", err)
+	}
+	config.Trash = t.TempDir()
+	if err := validConfig(); err != nil {
+		t.Errorf("expected a trash outside the directory to be allowed; got %v", err)
+	}
+}
+
+func TestPrintKept(t *testing.T) {
+	defer func(h handler, minSize int64) { config.H, config.MinSize = h, minSize }(config.H, config.MinSize)
+	config.MinSize = 4
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":         "petals",
+		"flowers (1).jpg":     "petals",
+		"sub/flowers (2).jpg": "petals",
+		"unique.txt":          "unique",
+		"tiny.txt":            "ab",
+		"tiny (1).txt":        "ab",
+		"song.mp3":            "la la",
+		"song - Copy.mp3":     "la la",
+		"different size.jpg":  "a longer file",
+	})
+
+	var deleted []string
+	kept := newKeptList()
+	config.H = kept.record(handlerFunc(func(file, _ string) error {
+		deleted = append(deleted, file)
+		return nil
+	}))
+
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, kept.files(compileDirResults(ctx, roots)), sum), dup.FilenameFn, sum)
+	var out strings.Builder
+	kept.print(&out)
+
+	seen := make(map[string]int)
+	for _, p := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		seen[p]++
+	}
+	for _, p := range deleted {
+		seen[p]++
+	}
+	var all []string
+	fs.WalkDir(os.DirFS(dir), ".", func(path string, d fs.DirEntry, err error) error {
+		if !d.IsDir() {
+			all = append(all, filepath.Join(dir, path))
+		}
+		return err
+	})
+	if len(seen) != len(all) {
+		t.Errorf("expected %d files between kept and deleted; got %d", len(all), len(seen))
+	}
+	for _, p := range all {
+		if seen[p] != 1 {
+			t.Errorf("%s: expected to be kept or deleted exactly once; seen %d times", p, seen[p])
+		}
+	}
+	if len(deleted) != 3 {
+		t.Errorf("expected 3 deleted files; got %q", deleted)
+	}
+}
+
+func TestWatchExcluded(t *testing.T) {
+	defer func(minSize int64, globs []string) { config.MinSize, config.Exclude = minSize, globs }(config.MinSize, config.Exclude)
+	config.MinSize, config.Exclude = 0, nil
+	if err := addExclude("node_modules"); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"photos/flowers.jpg":              "petals",
+		"node_modules/lib/flowers.jpg":    "petals",
+		"node_modules/lib/sub/thorns.jpg": "thorns",
+	})
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var found []string
+	if err := watchTree(w, dir, dir, func(fr fileResult) { found = append(found, fr.path) }); err != nil {
+		t.Fatal(err)
+	}
+
+	watched := w.WatchList()
+	slices.Sort(watched)
+	if want := []string{dir, filepath.Join(dir, "photos")}; !slices.Equal(watched, want) {
+		t.Errorf("expected the excluded directory not to be watched; watching %q", watched)
+	}
+	if want := []string{filepath.Join(dir, "photos", "flowers.jpg")}; !slices.Equal(found, want) {
+		t.Errorf("expected %q; got %q", want, found)
+	}
+	// e.g. from an event for a directory watched before the exclusion applied
+	if fr := (fileResult{path: filepath.Join(dir, "node_modules", "lib", "sub", "thorns.jpg"), size: 6, root: dir}); watchable(fr) {
+		t.Errorf("expected a file below an excluded directory not to be watchable")
+	}
+	if fr := (fileResult{path: filepath.Join(dir, "photos", "flowers.jpg"), size: 6, root: dir}); !watchable(fr) {
+		t.Errorf("expected a file outside of excluded directories to be watchable")
+	}
+}
+
+func TestWatchNewDirectorySettles(t *testing.T) {
+	defer func(minSize int64, settle time.Duration) { config.MinSize, config.WatchSettle = minSize, settle }(config.MinSize, config.WatchSettle)
+	config.MinSize, config.WatchSettle = 0, time.Second
+
+	dir := t.TempDir()
+	// a directory that was just moved or copied into a watched one
+	writeFiles(t, dir, map[string]string{"new/flowers.jpg": "petals"})
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	pending := make(pendingFiles)
+	now := time.Now()
+	if err := watchTree(w, dir, filepath.Join(dir, "new"), func(fr fileResult) { pending.add(fr, now) }); err != nil {
+		t.Fatal(err)
+	}
+	if frs := pending.settled(now); len(frs) != 0 {
+		t.Errorf("expected files in a new directory to wait to settle; got %v", frs)
+	}
+
+	// still being written
+	writeFiles(t, dir, map[string]string{"new/flowers.jpg": "petals and stems"})
+	if frs := pending.settled(now.Add(config.WatchSettle)); len(frs) != 0 {
+		t.Errorf("expected a file whose size changed to keep waiting; got %v", frs)
+	}
+	frs := pending.settled(now.Add(2 * config.WatchSettle))
+	if want := []fileResult{{path: filepath.Join(dir, "new", "flowers.jpg"), size: 16, root: dir}}; !slices.Equal(frs, want) {
+		t.Errorf("expected %v once settled; got %v", want, frs)
+	}
+	if len(pending) != 0 {
+		t.Errorf("expected settled files to stop waiting; %d left", len(pending))
+	}
+}
+
+func TestWatchRejectsGroupOptions(t *testing.T) {
+	defer func(h handler, dirs []string, watch, invert, tag bool, touch string, merge []string, minGroup int64) {
+		config.H, config.Dirs, config.Watch, config.Invert, config.TagKept, config.TouchKept, config.MergeMeta, config.MinGroup = h, dirs, watch, invert, tag, touch, merge, minGroup
+	}(config.H, config.Dirs, config.Watch, config.Invert, config.TagKept, config.TouchKept, config.MergeMeta, config.MinGroup)
+	config.H, config.Dirs, config.Watch = noopHandler, []string{t.TempDir()}, true
+	if err := validConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, set := range map[string]func(){
+		"-invert":                func() { config.Invert = true },
+		"-merge-meta":            func() { config.MergeMeta = []string{mergeMtime} },
+		"-touch-kept":            func() { config.TouchKept = "now" },
+		"-tag-kept":              func() { config.TagKept = true },
+		"-group-threshold-bytes": func() { config.MinGroup = 1 << 20 },
+	} {
+		config.Invert, config.MergeMeta, config.TouchKept, config.TagKept, config.MinGroup = false, nil, "", false, 0
+		set()
+		if err := validConfig(); err == nil || !strings.Contains(err.Error(), "-watch can't be combined") {
+			t.Errorf("expected -watch with %s to be rejected; got %v", name, err)
+		}
+	}
+}
+
+func TestWatchIndexAdd(t *testing.T) {
+	defer func(minSize int64) { config.MinSize = minSize }(config.MinSize)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers (1).jpg": "petals",
+		"flowers.jpg":     "petals",
+		"flowers (2).jpg": "petals",
+		"weeds.jpg":       "thorns",
+	})
+	fr := func(name string) fileResult {
+		return fileResult{path: filepath.Join(dir, name), size: 6, root: dir}
+	}
+
+	type call struct{ file, keep string }
+	var calls []call
+	index := newWatchIndex(dup.FilenameFn, handlerFunc(func(file, keep string) error {
+		calls = append(calls, call{filepath.Base(file), filepath.Base(keep)})
+		return nil
+	}))
+	ctx := context.Background()
+
+	index.insert(fr("flowers (1).jpg"))
+	index.add(ctx, fr("weeds.jpg"))
+	index.add(ctx, fr("flowers.jpg"))
+	index.add(ctx, fr("flowers (2).jpg"))
+
+	want := []call{
+		{"flowers (1).jpg", "flowers.jpg"},
+		{"flowers (2).jpg", "flowers.jpg"},
+	}
+	if !slices.Equal(calls, want) {
+		t.Errorf("expected handler calls %q; got %q", want, calls)
+	}
+	if got := paths(index.bySize[6]); !slices.Equal(got, []string{fr("flowers.jpg").path, fr("weeds.jpg").path}) {
+		t.Errorf("expected index to hold the kept files; got %q", got)
+	}
+}
+
+func TestSummaryRatio(t *testing.T) {
+	defer func(h handler, minSize int64) { config.H, config.MinSize = h, minSize }(config.H, config.MinSize)
+	config.H = noopHandler
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "0123456789",
+		"flowers (1).jpg": "0123456789",
+		"flowers (2).jpg": "0123456789",
+		"weeds.jpg":       "0123456789abcdefghij",
+	})
+
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+	// 50 bytes scanned, of which two 10 byte copies are duplicates
+	if sum.scannedFiles != 4 || sum.scannedBytes != 50 {
+		t.Errorf("expected 4 files and 50 bytes scanned; got %d files and %d bytes", sum.scannedFiles, sum.scannedBytes)
+	}
+	if got := sum.ratio(); got != 0.6 {
+		t.Errorf("expected ratio 0.6; got %v", got)
+	}
+	if got := sum.reclaimablePercent(); math.Abs(got-40) > 1e-9 {
+		t.Errorf("expected 40%% reclaimable; got %v", got)
+	}
+	if got := newSummary(roots).ratio(); got != 1 {
+		t.Errorf("expected ratio 1 for an empty scan; got %v", got)
+	}
+}
+
+func TestFreedDiverges(t *testing.T) {
+	tt := []struct {
+		predicted, actual int64
+		diverges          bool
+	}{
+		{0, 0, false},
+		{1000, 1000, false},
+		{1000, 950, false},
+		{1000, 1080, false},
+		{1000, 0, true},
+		{1000, 850, true},
+		{1000, 1200, true},
+		{0, 4096, true},
+	}
+	for _, tc := range tt {
+		if got := freedDiverges(tc.predicted, tc.actual); got != tc.diverges {
+			t.Errorf("predicted %d, actual %d: expected %v; got %v", tc.predicted, tc.actual, tc.diverges, got)
+		}
+	}
+}
+
+func TestReportRoundTrip(t *testing.T) {
+	defer func(h handler, minSize int64) { config.H, config.MinSize = h, minSize }(config.H, config.MinSize)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"flowers (2).jpg": "petals",
+		"song.mp3":        "la la",
+		"song - Copy.mp3": "la la",
+		"unique.txt":      "unique",
+	})
+	var handled []string
+	config.H = handlerFunc(func(file, _ string) error {
+		handled = append(handled, file)
+		return nil
+	})
+
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	sum.recordClusters = true
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+	slices.Sort(handled)
+	want := handled
+
+	var buf strings.Builder
+	if err := writeReport(&buf, sum.report()); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := readReport(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Clusters) != 2 {
+		t.Fatalf("expected 2 clusters; got %+v", rep.Clusters)
+	}
+
+	// the grouping is trusted, so a file that changed since the report is still handled
+	writeFiles(t, dir, map[string]string{"flowers (2).jpg": "thorns"})
+	tt := map[string]struct {
+		opts dup.Options
+		want []string
+	}{
+		"trusted":  {dup.Options{AssumeEqual: true}, want},
+		"verified": {dup.Options{}, slices.DeleteFunc(slices.Clone(want), func(p string) bool { return filepath.Base(p) == "flowers (2).jpg" })},
+	}
+	for name, tc := range tt {
+		handled = nil
+		sum := newSummary(roots)
+		handleBuckets(ctx, reportBuckets(ctx, rep, sum), dup.NewFilenameFn(tc.opts), sum)
+		slices.Sort(handled)
+		if !slices.Equal(handled, tc.want) {
+			t.Errorf("%s: expected %q to be handled; got %q", name, tc.want, handled)
+		}
+		if sum.scannedFiles != 5 {
+			t.Errorf("%s: expected 5 files scanned; got %d", name, sum.scannedFiles)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	buckets := map[int64][]fileResult{
+		10:      {{path: "a"}},
+		2048:    {{path: "b"}, {path: "c"}},
+		4096:    {{path: "d"}, {path: "e"}, {path: "f"}, {path: "g"}},
+		1 << 20: {{path: "h"}},
+		5 << 30: {{path: "i"}, {path: "j"}},
+	}
+	h := newHistogram(buckets, 7, 0)
+
+	if want := [3]int{2, 2, 1}; h.byBucketLen != want {
+		t.Errorf("expected buckets by length %v; got %v", want, h.byBucketLen)
+	}
+	want := [len(histogramRanges)]struct{ files, candidates int }{
+		{1, 0}, {6, 6}, {0, 0}, {1, 0}, {0, 0}, {2, 2},
+	}
+	if h.byRange != want {
+		t.Errorf("expected files by size range %v; got %v", want, h.byRange)
+	}
+	if h.belowMin != 7 {
+		t.Errorf("expected 7 files below the minimum size; got %d", h.belowMin)
+	}
+}
+
+func TestPromoteKeep(t *testing.T) {
+	defer func(x bool) { config.Execute = x }(config.Execute)
+	config.Execute = true
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers (3).jpg": "petals",
+		"song (2).mp3":    "la la",
+		"song.mp3":        "unrelated",
+	})
+	fr := func(name string) fileResult { return fileResult{path: filepath.Join(dir, name), size: 6, root: dir} }
+
+	// flowers.jpg and flowers (1).jpg were deleted
+	if err := promoteKeep(fr("flowers (3).jpg"), []fileResult{fr("flowers (1).jpg"), fr("flowers.jpg")}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "flowers.jpg")); err != nil || string(b) != "petals" {
+		t.Errorf("expected kept file to be renamed to flowers.jpg; got %q, %v", b, err)
+	}
+
+	// song.mp3 was deleted from another directory, but the name is taken by an unrelated file in this one
+	other := fileResult{path: filepath.Join(t.TempDir(), "song.mp3"), size: 5}
+	if err := promoteKeep(fr("song (2).mp3"), []fileResult{other}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "song (2).mp3")); err != nil {
+		t.Errorf("expected kept file to keep its name: %v", err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "song.mp3")); string(b) != "unrelated" {
+		t.Errorf("expected unrelated file to be untouched; got %q", b)
+	}
+
+	if got := cleanestName(fr("song (2).mp3"), []fileResult{fr("song (3).mp3"), fr("song (1).mp3")}); got != "song (1).mp3" {
+		t.Errorf("expected cleanest name song (1).mp3; got %s", got)
+	}
+	if got := cleanestName(fr("song (2).mp3"), []fileResult{other}); got != "song (2).mp3" {
+		t.Errorf("expected a name from another directory to be ignored; got %s", got)
+	}
+
+	// notes.txt was handled, but a new file took its name before the kept file was renamed
+	writeFiles(t, dir, map[string]string{
+		"notes (1).txt": "to do",
+		"notes.txt":     "written since",
+	})
+	if err := promoteKeep(fr("notes (1).txt"), []fileResult{fr("notes.txt")}); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "notes.txt")); string(b) != "written since" {
+		t.Errorf("expected the new file to be left in place; got %q", b)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes (1).txt")); err != nil {
+		t.Errorf("expected kept file to keep its name: %v", err)
+	}
+}
+
+func TestInodeGroups(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":  "petals",
+		"song.mp3":     "la la",
+		"song (1).mp3": "la la",
+	})
+	for _, link := range []string{"flowers (1).jpg", "sub/flowers.jpg"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, link)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(filepath.Join(dir, "flowers.jpg"), filepath.Join(dir, link)); err != nil {
+			t.Skipf("hard links unsupported: %v", err)
+		}
+	}
+
+	groups := inodeGroups(compileDirResults(context.Background(), []string{dir}))
+	if len(groups) != 1 {
+		t.Fatalf("expected 1 group; got %d", len(groups))
+	}
+	want := []string{
+		filepath.Join(dir, "flowers (1).jpg"),
+		filepath.Join(dir, "flowers.jpg"),
+		filepath.Join(dir, "sub", "flowers.jpg"),
+	}
+	if got := paths(groups[0]); !slices.Equal(got, want) {
+		t.Errorf("expected group %q; got %q", want, got)
+	}
+
+	var out, sum strings.Builder
+	writeInodeGroups(&out, &sum, groups)
+	if want := "3 files share 1 inodes; 12 bytes already deduplicated\n"; sum.String() != want {
+		t.Errorf("expected summary %q; got %q", want, sum.String())
+	}
+}
+
+func TestMaxClusters(t *testing.T) {
+	defer func(h handler, minSize int64, max int) {
+		config.H, config.MinSize, config.MaxClusters = h, minSize, max
+	}(config.H, config.MinSize, config.MaxClusters)
+	config.MinSize = 0
+	config.MaxClusters = 2
+
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for i := range 5 {
+		// a different size for each cluster puts each one in its own bucket
+		content := strings.Repeat("x", i+1)
+		files[fmt.Sprintf("%d.txt", i)] = content
+		files[fmt.Sprintf("%d (1).txt", i)] = content
+	}
+	writeFiles(t, dir, files)
+	var handled int
+	config.H = handlerFunc(func(_, _ string) error {
+		handled++
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+	if !sum.partial {
+		t.Error("expected results to be marked partial")
+	}
+	if sum.clusterCount != 2 || handled != 2 {
+		t.Errorf("expected to stop after 2 clusters; got %d clusters and %d handled duplicates", sum.clusterCount, handled)
+	}
+}
+
+func TestPrettyReport(t *testing.T) {
+	defer func(pretty bool) { config.Pretty = pretty }(config.Pretty)
+	rep := report.Report{Clusters: []report.Cluster{{Keep: "flowers.jpg", Duplicates: []string{"flowers (1).jpg"}}}}
+
+	for _, pretty := range []bool{false, true} {
+		config.Pretty = pretty
+		var buf strings.Builder
+		if err := writeReport(&buf, rep); err != nil {
+			t.Fatal(err)
+		}
+		out := buf.String()
+		if lines := strings.Count(out, "\n"); pretty && lines < 2 || !pretty && lines != 1 {
+			t.Errorf("pretty %v: unexpected number of lines %d in %q", pretty, lines, out)
+		}
+		if indented := strings.Contains(out, "\n  \""); indented != pretty {
+			t.Errorf("pretty %v: expected indented %v; got %q", pretty, pretty, out)
+		}
+		got, err := readReport(strings.NewReader(out))
+		if err != nil {
+			t.Fatalf("pretty %v: %v", pretty, err)
+		}
+		if !reflect.DeepEqual(got, rep) {
+			t.Errorf("pretty %v: expected %+v; got %+v", pretty, rep, got)
+		}
+	}
+}
+
+func TestReportHashes(t *testing.T) {
+	defer func(h handler, minSize int64) { config.H, config.MinSize = h, minSize }(config.H, config.MinSize)
+	config.H = noopHandler
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"flowers (2).jpg": "petals",
+		"song.mp3":        "la la",
+		"song - Copy.mp3": "la la",
+	})
+
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	sum.recordClusters = true
+	sum.hashName, sum.newHash = "sha256", hashAlgorithms["sha256"]
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+	rep := sum.report()
+	if rep.Hash != "sha256" || len(rep.Clusters) != 2 {
+		t.Fatalf("expected 2 sha256 clusters; got %q with %d", rep.Hash, len(rep.Clusters))
+	}
+	hashes := make(map[string]bool)
+	for _, rc := range rep.Clusters {
+		members := append([]string{rc.Keep}, rc.Duplicates...)
+		if len(rc.Hashes) != len(members) {
+			t.Errorf("expected a hash for each of %q; got %v", members, rc.Hashes)
+		}
+		for _, p := range members {
+			if rc.Hashes[p] != rc.Hashes[rc.Keep] {
+				t.Errorf("%s: expected hash %s; got %s", p, rc.Hashes[rc.Keep], rc.Hashes[p])
+			}
+		}
+		hashes[rc.Hashes[rc.Keep]] = true
+	}
+	if len(hashes) != 2 {
+		t.Errorf("expected clusters to have different hashes; got %v", hashes)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	defer func(exts []string) { config.Extensions = exts }(config.Extensions)
+	config.Extensions = parseExtensions(" .JPG,png,,.Mp4,tar.GZ ")
+
+	if want := []string{"jpg", "png", "mp4", "tar.gz"}; !slices.Equal(config.Extensions, want) {
+		t.Errorf("expected extensions %q; got %q", want, config.Extensions)
+	}
+
+	fsys := fstest.MapFS{
+		"flowers.jpg":   {Data: []byte("1")},
+		"FLOWERS.JPG":   {Data: []byte("2")},
+		"clip.mP4":      {Data: []byte("3")},
+		"notes.txt":     {Data: []byte("4")},
+		"png":           {Data: []byte("5")},
+		"sub/photo.png": {Data: []byte("6")},
+		"backup.tar.gz": {Data: []byte("7")},
+		"notes.gz":      {Data: []byte("8")},
+	}
+	got := collectPaths(listFSFiles(context.Background(), fsys, "root"))
+	want := []string{
+		filepath.Join("root", "FLOWERS.JPG"),
+		filepath.Join("root", "backup.tar.gz"),
+		filepath.Join("root", "clip.mP4"),
+		filepath.Join("root", "flowers.jpg"),
+		filepath.Join("root", "sub", "photo.png"),
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %q; got %q", want, got)
+	}
+}
+
+func TestExclude(t *testing.T) {
+	defer func(globs []string, res []*regexp.Regexp) {
+		config.Exclude, config.ExcludeRegex = globs, res
+	}(config.Exclude, config.ExcludeRegex)
+	config.Exclude, config.ExcludeRegex = nil, nil
+	for _, pattern := range []string{"node_modules", "*.tmp", filepath.Join("root", "cache", "*")} {
+		if err := addExclude(pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := addExcludeRegex(`\.git$`); err != nil {
+		t.Fatal(err)
+	}
+	if err := addExclude("["); err == nil {
+		t.Error("expected an error for a bad glob pattern")
+	}
+	if err := addExcludeRegex("("); err == nil {
+		t.Error("expected an error for a bad regular expression")
+	}
+
+	fsys := fstest.MapFS{
+		"flowers.jpg":                 {Data: []byte("1")},
+		"draft.tmp":                   {Data: []byte("2")},
+		"node_modules/lib/index.js":   {Data: []byte("3")},
+		"app/node_modules/index.js":   {Data: []byte("4")},
+		".git/config":                 {Data: []byte("5")},
+		"cache/thumb.jpg":             {Data: []byte("6")},
+		"sub/cache/thumb.jpg":         {Data: []byte("7")},
+		"sub/my.git.notes/readme.txt": {Data: []byte("8")},
+	}
+	got := collectPaths(listFSFiles(context.Background(), fsys, "root"))
+	want := []string{
+		filepath.Join("root", "flowers.jpg"),
+		filepath.Join("root", "sub", "cache", "thumb.jpg"),
+		filepath.Join("root", "sub", "my.git.notes", "readme.txt"),
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %q; got %q", want, got)
+	}
+}
+
+func TestReadFileList(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"sub/song.mp3":    "la la",
+	})
+	p := func(name string) string { return filepath.Join(dir, name) }
+	collect := func(input string, sep byte) []fileResult {
+		var got []fileResult
+		for fr := range readFileList(context.Background(), strings.NewReader(input), sep) {
+			got = append(got, fr)
+		}
+		return got
+	}
+
+	// plain paths are stat'ed, and paths with a size are trusted
+	input := p("flowers.jpg") + "\n\n" + p("sub") + "\n" + p("missing.jpg") + "\n" +
+		p("flowers (1).jpg") + "\t6\r\n" + p("sub/./song.mp3") + "\t5000"
+	want := []fileResult{
+		{path: p("flowers.jpg"), size: 6, root: dir},
+		{path: p("flowers (1).jpg"), size: 6, root: dir},
+		{path: p("sub/song.mp3"), size: 5000, root: filepath.Join(dir, "sub")},
+	}
+	if got := collect(input, '\n'); !slices.Equal(got, want) {
+		t.Errorf("expected %+v; got %+v", want, got)
+	}
+
+	// a tab and digits are part of the path, not a size, and there is no such file
+	input = p("flowers.jpg") + "\x00" + p("sub/song.mp3") + "\x00" + p("missing.jpg") + "\t6\x00"
+	want = []fileResult{
+		{path: p("flowers.jpg"), size: 6, root: dir},
+		{path: p("sub/song.mp3"), size: 5, root: filepath.Join(dir, "sub")},
+	}
+	if got := collect(input, 0); !slices.Equal(got, want) {
+		t.Errorf("NUL separated: expected %+v; got %+v", want, got)
+	}
+}
+
+func TestStageBucketsSeed(t *testing.T) {
+	defer func(seed int64) { config.Seed = seed }(config.Seed)
+
+	order := func(seed int64) []string {
+		config.Seed = seed
+		fr := make(chan fileResult, 40)
+		for size := range int64(20) {
+			fr <- fileResult{path: fmt.Sprintf("b/%d", size), size: 4096 + size}
+			fr <- fileResult{path: fmt.Sprintf("a/%d", size), size: 4096 + size}
+		}
+		close(fr)
+		var got []string
+		for bucket := range stageBuckets(context.Background(), fr, newSummary(nil)) {
+			got = append(got, paths(bucket)...)
+		}
+		return got
+	}
+
+	first := order(42)
+	for range 5 {
+		if got := order(42); !slices.Equal(got, first) {
+			t.Fatalf("expected the same order for the same seed;\nfirst: %q\ngot:   %q", first, got)
+		}
+	}
+	if got := order(7); slices.Equal(got, first) {
+		t.Errorf("expected a different order for a different seed; got %q", got)
+	}
+}
+
+func TestCheckLastCopy(t *testing.T) {
+	bucket := []fileResult{{path: "flowers.jpg"}, {path: "flowers (1).jpg"}, {path: "flowers (2).jpg"}}
+
+	ok := []dup.Match{{Dup: 1, Keep: 0}, {Dup: 2, Keep: 0}}
+	if err := checkLastCopy(clustersOf(bucket, ok)); err != nil {
+		t.Errorf("expected a valid selection to pass; got %v", err)
+	}
+
+	// a faulty selection where each file is a duplicate of the next, around in a circle
+	faulty := []dup.Match{{Dup: 0, Keep: 1}, {Dup: 1, Keep: 2}, {Dup: 2, Keep: 0}}
+	if err := checkLastCopy(clustersOf(bucket, faulty)); !errors.Is(err, errLastCopy) {
+		t.Errorf("expected %v; got %v", errLastCopy, err)
+	}
+	self := []dup.Match{{Dup: 0, Keep: 0}}
+	if err := checkLastCopy(clustersOf(bucket, self)); !errors.Is(err, errLastCopy) {
+		t.Errorf("expected %v for a file kept in place of itself; got %v", errLastCopy, err)
+	}
+}
+
+func TestMemGuard(t *testing.T) {
+	var heap uint64
+	g := newMemGuard(1000)
+	g.poll = time.Millisecond
+	g.heap = func() uint64 { return heap }
+	ctx := context.Background()
+
+	heap = 1000
+	if g.wait(ctx) {
+		t.Error("expected no throttling at the threshold")
+	}
+
+	// the heap shrinks after a few polls, as if the comparisons in flight finished
+	polls := 0
+	g.heap = func() uint64 {
+		polls++
+		if polls > 4 {
+			return 500
+		}
+		return 2000
+	}
+	if !g.wait(ctx) {
+		t.Error("expected throttling above the threshold")
+	}
+	if polls <= 4 {
+		t.Errorf("expected wait to return after the heap shrank; returned after %d reads", polls)
+	}
+
+	// the heap never shrinks
+	g.heap = func() uint64 { return 2000 }
+	g.tries = 3
+	if !g.wait(ctx) {
+		t.Error("expected throttling above the threshold")
+	}
+
+	var disabled *memGuard
+	if disabled.wait(ctx) || newMemGuard(0).wait(ctx) {
+		t.Error("expected a disabled guard to never throttle")
+	}
+}
+
+func TestPairWriter(t *testing.T) {
+	defer func(h handler, minSize int64) { config.H, config.MinSize = h, minSize }(config.H, config.MinSize)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"song.mp3":        "la la",
+		"song":            "la la",
+		"notes.txt":       "unique",
+	})
+	var out strings.Builder
+	config.H = &pairWriter{w: &out}
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+	got, err := report.UnmarshalLines[report.Pair](strings.NewReader(out.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(got, func(a, b report.Pair) int { return strings.Compare(a.Duplicate, b.Duplicate) })
+	want := []report.Pair{
+		{Duplicate: filepath.Join(dir, "flowers (1).jpg"), Keep: filepath.Join(dir, "flowers.jpg"), Size: 6, Reason: "copy-counter"},
+		{Duplicate: filepath.Join(dir, "song"), Keep: filepath.Join(dir, "song.mp3"), Size: 5, Reason: "extension"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %+v; got %+v", want, got)
+	}
+
+	// the reason describes the pair that was written, not the rule that would keep the other file
+	defer func(invert bool) { config.Invert = invert }(config.Invert)
+	config.Invert = true
+	out.Reset()
+	sum = newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+	got, err = report.UnmarshalLines[report.Pair](strings.NewReader(out.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range got {
+		if p.Reason != "inverted" {
+			t.Errorf("expected inverted pairs to have the reason %q; got %+v", "inverted", p)
+		}
+	}
+}
+
+func TestShellScript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file names with control characters are not allowed on windows")
+	}
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not found")
+	}
+	defer func(h handler, minSize int64) { config.H, config.MinSize = h, minSize }(config.H, config.MinSize)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"flowers.jpg":           "petals",
+		"flowers (1).jpg":       "petals",
+		"it's a copy (1).jpg":   "petals",
+		"line\nbreak (1).jpg":   "petals",
+		"tab\tand \\ (1).jpg":   "petals",
+		"$HOME `echo` (1).jpg":  "petals",
+		"unicode ✿ (1).jpg":     "petals",
+		"song.mp3":              "la la",
+		"song - Copy.mp3":       "la la",
+		"song - Copy (2).mp3":   "la la",
+		"nothing to see.txt":    "unique",
+		"\x01control (1).jpg":   "petals",
+		"ends in newline\n.jpg": "other",
+	}
+	writeFiles(t, dir, files)
+
+	script := &shellScript{}
+	config.H = script
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+	var out strings.Builder
+	if err := script.write(&out, sum); err != nil {
+		t.Fatal(err)
+	}
+	if want := "# 9 duplicates, 52 bytes\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("expected header to contain %q; got:\n%s", want, out.String())
+	}
+
+	cmd := exec.Command(bash, "-c", out.String())
+	if b, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("script failed: %v\n%s", err, b)
+	}
+	var left []string
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	want := []string{"ends in newline\n.jpg", "flowers.jpg", "nothing to see.txt", "song.mp3"}
+	if !slices.Equal(left, want) {
+		t.Errorf("expected %q to remain; got %q", want, left)
+	}
+}
+
+func TestWalkOrderArgs(t *testing.T) {
+	defer func(h handler, minSize int64, order string, dirs []string) {
+		config.H, config.MinSize, config.WalkOrder, config.Dirs = h, minSize, order, dirs
+	}(config.H, config.MinSize, config.WalkOrder, config.Dirs)
+	config.MinSize = 0
+	config.WalkOrder = walkOrderArgs
+
+	library, downloads := t.TempDir(), t.TempDir()
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, dir := range []string{library, downloads} {
+		writeFiles(t, dir, map[string]string{"flowers.jpg": "petals"})
+		// identical names and times leave nothing but the order to decide
+		if err := os.Chtimes(filepath.Join(dir, "flowers.jpg"), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var kept string
+	config.H = handlerFunc(func(_, keep string) error {
+		kept = keep
+		return nil
+	})
+	ctx := context.Background()
+	for _, roots := range [][]string{{library, downloads}, {downloads, library}} {
+		config.Dirs = roots
+		for range 10 {
+			sum := newSummary(roots)
+			handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+			if want := filepath.Join(roots[0], "flowers.jpg"); kept != want {
+				t.Fatalf("expected to keep %s from the first directory given; got %s", want, kept)
+			}
+		}
+	}
+}
+
+func TestTouchKept(t *testing.T) {
+	defer func(h handler, minSize int64, touch string, x bool) {
+		config.H, config.MinSize, config.TouchKept, config.Execute = h, minSize, touch, x
+	}(config.H, config.MinSize, config.TouchKept, config.Execute)
+	config.H = deleteHandler
+	config.MinSize = 0
+	config.Execute = true
+
+	old := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	mid := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tt := map[string]func(time.Time) bool{
+		touchOldest: func(got time.Time) bool { return got.Equal(old) },
+		touchNewest: func(got time.Time) bool { return got.Equal(recent) },
+		touchNow:    func(got time.Time) bool { return time.Since(got) < time.Minute },
+	}
+	for policy, ok := range tt {
+		config.TouchKept = policy
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{
+			"flowers.jpg":     "petals",
+			"flowers (1).jpg": "petals",
+			"flowers (2).jpg": "petals",
+		})
+		for name, mtime := range map[string]time.Time{"flowers.jpg": mid, "flowers (1).jpg": old, "flowers (2).jpg": recent} {
+			if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ctx := context.Background()
+		roots := []string{dir}
+		sum := newSummary(roots)
+		handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+		fi, err := os.Stat(filepath.Join(dir, "flowers.jpg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok(fi.ModTime()) {
+			t.Errorf("-touch-kept %s: unexpected modification time %v", policy, fi.ModTime())
+		}
+	}
+}
+
+func TestListRoots(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a", "b/c.txt": "c"})
+	missing := filepath.Join(dir, "typo")
+
+	var out strings.Builder
+	if listRoots(&out, []string{dir, missing}) {
+		t.Error("expected a missing root to fail the preflight")
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a line for each root; got %q", out.String())
+	}
+	if want := dir + ": ok, "; !strings.HasPrefix(lines[0], want) || !strings.HasSuffix(lines[0], " 2 top-level entries") {
+		t.Errorf("expected %s to be ok with 2 entries; got %q", dir, lines[0])
+	}
+	if want := missing + ": does not exist"; lines[1] != want {
+		t.Errorf("expected %q; got %q", want, lines[1])
+	}
+
+	out.Reset()
+	if !listRoots(&out, []string{dir}) {
+		t.Errorf("expected a readable root to pass the preflight; got %q", out.String())
+	}
+}
+
+func TestRetainNewestInEachDir(t *testing.T) {
+	defer func(h handler, minSize int64, within, newest bool) {
+		config.H, config.MinSize, config.WithinDir, config.PreferNewest = h, minSize, within, newest
+	}(config.H, config.MinSize, config.WithinDir, config.PreferNewest)
+	config.MinSize = 0
+	config.WithinDir, config.PreferNewest = true, true
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"reports/report.csv":     "q1,q2",
+		"reports/report (1).csv": "q1,q2",
+		"reports/report (2).csv": "q1,q2",
+		"reports/other.csv":      "q3,q4",
+		"archive/report.csv":     "q1,q2",
+		"archive/old.csv":        "q1,q2",
+	})
+	mtimes := map[string]int{
+		"reports/report.csv":     2001,
+		"reports/report (1).csv": 2020,
+		"reports/report (2).csv": 2010,
+		"reports/other.csv":      2030,
+		"archive/report.csv":     2001,
+		"archive/old.csv":        1999,
+	}
+	for name, year := range mtimes {
+		mtime := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var deleted []string
+	config.H = handlerFunc(func(file, _ string) error {
+		rel, _ := filepath.Rel(dir, file)
+		deleted = append(deleted, filepath.ToSlash(rel))
+		return nil
+	})
+	ctx := context.Background()
+	roots := []string{dir}
+	compareFn := dup.NewFilenameFn(dup.Options{PreferNewest: true})
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), compareFn, sum)
+
+	// the newest copy survives in each directory, even with a worse name,
+	// and copies in different directories are never compared
+	slices.Sort(deleted)
+	want := []string{"archive/old.csv", "reports/report (2).csv", "reports/report.csv"}
+	if !slices.Equal(deleted, want) {
+		t.Errorf("expected %q to be deleted; got %q", want, deleted)
+	}
+}
+
+func TestMatchNames(t *testing.T) {
+	defer func(h handler, minSize int64, match bool) {
+		config.H, config.MinSize, config.MatchNames = h, minSize, match
+	}(config.H, config.MinSize, config.MatchNames)
+	config.MinSize = 0
+	config.MatchNames = true
+
+	library, imported := t.TempDir(), t.TempDir()
+	writeFiles(t, library, map[string]string{
+		"flowers.jpg": "petals",
+		"beach.jpg":   "sand!!",
+	})
+	writeFiles(t, imported, map[string]string{
+		"flowers (1).jpg": "petals",
+		"IMG_0001.jpg":    "petals", // identical, but unrelated by name
+		"beach.jpg":       "waves!",
+	})
+
+	var deleted []string
+	config.H = handlerFunc(func(file, _ string) error {
+		deleted = append(deleted, file)
+		return nil
+	})
+	ctx := context.Background()
+	roots := []string{library, imported}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+	if want := []string{filepath.Join(imported, "flowers (1).jpg")}; !slices.Equal(deleted, want) {
+		t.Errorf("expected %q to be deleted; got %q", want, deleted)
+	}
+}
+
+func TestWriteExplanation(t *testing.T) {
+	var out strings.Builder
+	writeExplanation(&out, dup.Explanation{
+		Left:      "flowers (1).jpg",
+		Right:     "flowers.jpg",
+		LeftSize:  6,
+		RightSize: 6,
+		LeftName:  dup.Name{Prefix: "flowers", Counter: 1, Ext: ".jpg"},
+		RightName: dup.Name{Prefix: "flowers", Counter: 0, Ext: ".jpg"},
+		Equal:     true,
+		Offset:    -1,
+		Selection: dup.Left,
+		Rule:      dup.RuleCopyCounter,
+	})
+	want := `left: flowers (1).jpg
+  size: 6 bytes
+  name: prefix "flowers", copy counter 1, extension ".jpg"
+right: flowers.jpg
+  size: 6 bytes
+  name: prefix "flowers", copy counter 0, extension ".jpg"
+contents: equal
+result: keep right, left is the duplicate (rule: copy counter)
+`
+	if out.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, out.String())
+	}
+}
+
+func TestSkipHardlinked(t *testing.T) {
+	defer func(h handler, minSize int64) { config.H, config.MinSize = h, minSize }(config.H, config.MinSize)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"flowers (2).jpg": "petals",
+	})
+	// a link outside of the scanned directory, which a backup tool might rely on
+	if err := os.Link(filepath.Join(dir, "flowers (2).jpg"), filepath.Join(t.TempDir(), "backup.jpg")); err != nil {
+		t.Skipf("hard links unsupported: %v", err)
+	}
+
+	var deleted []string
+	config.H = skipHardlinked(handlerFunc(func(file, _ string) error {
+		deleted = append(deleted, file)
+		return nil
+	}))
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+	if want := []string{filepath.Join(dir, "flowers (1).jpg")}; !slices.Equal(deleted, want) {
+		t.Errorf("expected %q to be handled; got %q", want, deleted)
+	}
+	if sum.linked != 1 {
+		t.Errorf("expected 1 skipped hard link; got %d", sum.linked)
+	}
+	if got := sum.byRoot[dir].Duplicates; got != 1 {
+		t.Errorf("expected 1 handled duplicate; got %d", got)
+	}
+}
+
+func TestMergeMeta(t *testing.T) {
+	defer func(x bool) { config.Execute = x }(config.Execute)
+	config.Execute = true
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"flowers (2).jpg": "petals",
+	})
+	fr := func(name string) fileResult { return fileResult{path: filepath.Join(dir, name), size: 6, root: dir} }
+	c := cluster{keep: fr("flowers.jpg"), dups: []fileResult{fr("flowers (1).jpg"), fr("flowers (2).jpg")}}
+
+	oldest := time.Date(1999, 12, 31, 0, 0, 0, 0, time.UTC)
+	for name, mtime := range map[string]time.Time{"flowers.jpg": time.Now(), "flowers (1).jpg": oldest, "flowers (2).jpg": oldest.AddDate(1, 0, 0)} {
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kinds := []string{mergeMtime}
+	xattrs := dup.XattrSupported && dup.SetXattr(c.dups[1].path, "user.dedup.source", []byte("camera")) == nil
+	if xattrs {
+		if err := dup.SetXattr(c.dups[0].path, "user.dedup.rating", []byte("5")); err != nil {
+			t.Fatal(err)
+		}
+		if err := dup.SetXattr(c.keep.path, "user.dedup.rating", []byte("3")); err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, mergeXattrs)
+	}
+
+	if err := mergeMeta(c, kinds); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(c.keep.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(oldest) {
+		t.Errorf("expected the oldest modification time %v; got %v", oldest, fi.ModTime())
+	}
+	if !xattrs {
+		t.Log("extended attributes unsupported; only checked the modification time")
+		return
+	}
+	got, err := dup.ReadXattrs(c.keep.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"user.dedup.rating": "3", "user.dedup.source": "camera"}
+	if len(got) != len(want) {
+		t.Errorf("expected attributes %q; got %q", want, got)
+	}
+	for name, v := range want {
+		if string(got[name]) != v {
+			t.Errorf("%s: expected %q; got %q", name, v, got[name])
+		}
+	}
+}
+
+func TestTagKept(t *testing.T) {
+	defer func(execute bool) { config.Execute = execute }(config.Execute)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"flowers.jpg": "petals"})
+	keep := fileResult{path: filepath.Join(dir, "flowers.jpg"), size: 6, root: dir}
+	if !dup.XattrSupported || dup.SetXattr(keep.path, "user.dedup.probe", nil) != nil {
+		t.Skip("extended attributes unsupported")
+	}
+	when := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	config.Execute = false
+	if err := tagKept(keep, 2, when); err != nil {
+		t.Fatal(err)
+	}
+	got, err := dup.ReadXattrs(keep.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got[tagMergedCount]; ok {
+		t.Errorf("expected no tags without -x; got %q", got)
+	}
+
+	config.Execute = true
+	for _, merged := range []int{2, 0, 3} {
+		if err := tagKept(keep, merged, when); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err = dup.ReadXattrs(keep.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{tagMergedCount: "5", tagTimestamp: "2024-05-01T12:00:00Z"}
+	for name, v := range want {
+		if string(got[name]) != v {
+			t.Errorf("%s: expected %q; got %q", name, v, got[name])
+		}
+	}
+}
+
+func TestBucketBySizeExt(t *testing.T) {
+	defer func(h handler, minSize int64, bucketBy string) {
+		config.H, config.MinSize, config.BucketBy = h, minSize, bucketBy
+	}(config.H, config.MinSize, config.BucketBy)
+	config.MinSize = 0
+	config.BucketBy = bucketBySizeExt
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).JPG": "petals",
+		"flowers.bak":     "petals",
+		"notes.txt":       "petals",
+	})
+
+	config.H = handlerFunc(func(string, string) error { return nil })
+	var compared [][2]string
+	compareFn := func(ctx context.Context, left, right string) (dup.Selection, error) {
+		compared = append(compared, [2]string{filepath.Base(left), filepath.Base(right)})
+		return dup.FilenameFn(ctx, left, right)
+	}
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), compareFn, sum)
+
+	if len(compared) != 1 {
+		t.Fatalf("expected only the two .jpg files to be compared; got %q", compared)
+	}
+	if pair := compared[0]; extKey(fileResult{path: pair[0]}) != ".jpg" || extKey(fileResult{path: pair[1]}) != ".jpg" {
+		t.Errorf("expected the two .jpg files to be compared; got %q", pair)
+	}
+}
+
+func TestPartialBucketFlush(t *testing.T) {
+	defer func(minSize int64, flushAt int) {
+		config.MinSize, config.FlushAt = minSize, flushAt
+	}(config.MinSize, config.FlushAt)
+	config.MinSize = 0
+	config.FlushAt = 2
+
+	fr := func(name string, size int64) fileResult { return fileResult{path: name, size: size, root: "."} }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	files := make(chan fileResult)
+	sum := newSummary([]string{"."})
+	buckets := stageBuckets(ctx, files, sum)
+
+	files <- fr("flowers.jpg", 6)
+	files <- fr("notes.txt", 5)
+	files <- fr("flowers (1).jpg", 6)
+	// the walk isn't over, but the bucket of size 6 is full
+	select {
+	case got := <-buckets:
+		if want := []string{"flowers.jpg", "flowers (1).jpg"}; !slices.Equal(paths(got), want) {
+			t.Errorf("expected %q; got %q", want, paths(got))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a bucket before the walk finished")
+	}
+
+	files <- fr("flowers (2).jpg", 6)
+	files <- fr("notes (1).txt", 5)
+	close(files)
+	got := <-buckets
+	if want := []string{"notes.txt", "notes (1).txt"}; !slices.Equal(paths(got), want) {
+		t.Errorf("expected the bucket that was never flushed next; got %q", paths(got))
+	}
+	// as handleBuckets would, having found no duplicates in either bucket
+	sum.flushed.handle(nil)
+	sum.flushed.handle(nil)
+	var rest [][]string
+	for v := range buckets {
+		rest = append(rest, paths(v))
+	}
+	if want := [][]string{{"flowers.jpg", "flowers (1).jpg", "flowers (2).jpg"}}; !reflect.DeepEqual(rest, want) {
+		t.Errorf("expected the late file to be sent with the early bucket; got %q", rest)
+	}
+	if sum.scannedFiles != 5 {
+		t.Errorf("expected 5 files scanned; got %d", sum.scannedFiles)
+	}
+}
+
+func TestPartialBucketFlushKeepLinked(t *testing.T) {
+	defer func(h handler, flushAt int, keepLinked bool) {
+		config.H, config.FlushAt, config.KeepLinked = h, flushAt, keepLinked
+	}(config.H, config.FlushAt, config.KeepLinked)
+	config.H = noopHandler
+	config.FlushAt, config.KeepLinked = 2, true
+
+	// symlink targets found late in the walk couldn't protect files already compared
+	if err := validConfig(); err == nil || !strings.Contains(err.Error(), "-preserve-symlinks-as-originals") {
+		t.Errorf("expected -partial-bucket-flush to be refused with -preserve-symlinks-as-originals; got %v", err)
+	}
+}
+
+func TestPartialBucketFlushDuplicates(t *testing.T) {
+	defer func(h handler, minSize int64, flushAt int) {
+		config.H, config.MinSize, config.FlushAt = h, minSize, flushAt
+	}(config.H, config.MinSize, config.FlushAt)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"1 (1).jpg": "petals",
+		"1.jpg":     "petals",
+		"2.jpg":     "leaves",
+		"3 (1).jpg": "petals",
+		"4.txt":     "stem",
+		"4 (1).txt": "stem",
+	})
+	run := func(flushAt int) map[string]string {
+		config.FlushAt = flushAt
+		handled := make(map[string]string)
+		config.H = handlerFunc(func(file, keep string) error {
+			handled[filepath.Base(file)] = filepath.Base(keep)
+			return nil
+		})
+		ctx := context.Background()
+		roots := []string{dir}
+		sum := newSummary(roots)
+		if err := handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum); err != nil {
+			t.Fatal(err)
+		}
+		return handled
+	}
+
+	want := run(0)
+	if len(want) != 3 {
+		t.Fatalf("expected 3 duplicates without flushing; got %q", want)
+	}
+	// "1 (1).jpg" and "1.jpg" are flushed before the walk reaches "2.jpg" or "3 (1).jpg"
+	if got := run(2); !maps.Equal(got, want) {
+		t.Errorf("expected the same duplicates as without flushing, %q; got %q", want, got)
+	}
+}
+
+func TestSizeChangedDuringRun(t *testing.T) {
+	defer func(h handler, minSize int64) {
+		config.H, config.MinSize = h, minSize
+	}(config.H, config.MinSize)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"flowers (2).jpg": "petals",
+	})
+	var handled []string
+	config.H = handlerFunc(func(file, keep string) error {
+		handled = append(handled, filepath.Base(file))
+		return nil
+	})
+	growing := filepath.Join(dir, "flowers (1).jpg")
+	var compared int
+	compareFn := func(ctx context.Context, left, right string) (dup.Selection, error) {
+		if compared++; compared == 1 {
+			// written to after the walk put it in the bucket of 6-byte files
+			if err := os.WriteFile(growing, []byte("petals and stems"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dup.FilenameFn(ctx, left, right)
+	}
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	if err := handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), compareFn, sum); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"flowers (2).jpg"}; !slices.Equal(handled, want) {
+		t.Errorf("expected only the unchanged duplicate to be handled; got %q", handled)
+	}
+	if compared != 2 {
+		t.Errorf("expected the changed file to be compared once and then dropped; got %d comparisons", compared)
+	}
+}
+
+func TestCompareDecompressed(t *testing.T) {
+	defer func(h handler, minSize int64, decompress bool) {
+		config.H, config.MinSize, config.Decompress = h, minSize, decompress
+	}(config.H, config.MinSize, config.Decompress)
+	config.MinSize = 0
+	config.Decompress = true
+
+	dir := t.TempDir()
+	contents := strings.Repeat("the same rows of the same backup\n", 1000)
+	for name, level := range map[string]int{"backup.tgz": gzip.NoCompression, "backup.tar.gz": gzip.BestCompression} {
+		var buf bytes.Buffer
+		zw, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(zw, contents)
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		writeFiles(t, dir, map[string]string{name: buf.String()})
+		// the same time for both, so the modification time rule doesn't depend on the order they were written
+		mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFiles(t, dir, map[string]string{"notes.txt": "petals", "notes (1).txt": "petals"})
+
+	var handled []string
+	config.H = handlerFunc(func(file, keep string) error {
+		handled = append(handled, filepath.Base(file))
+		return nil
+	})
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.NewFilenameFn(dup.Options{Decompress: true}), sum)
+
+	slices.Sort(handled)
+	if want := []string{"backup.tgz", "notes (1).txt"}; !slices.Equal(handled, want) {
+		t.Errorf("expected %q; got %q", want, handled)
+	}
+}
+
+func TestMaxFiles(t *testing.T) {
+	defer func(minSize int64) { config.MinSize = minSize }(config.MinSize)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"flowers (2).jpg": "petals",
+	})
+	roots := []string{dir}
+	for max, wantAbort := range map[int]bool{2: true, 3: false} {
+		ctx, abort := context.WithCancelCause(context.Background())
+		sum := newSummary(roots)
+		stageBuckets(ctx, capFiles(compileDirResults(ctx, roots), max, abort), sum)
+		err := context.Cause(ctx)
+		if aborted := errors.Is(err, errTooManyFiles); aborted != wantAbort {
+			t.Errorf("max %d: expected abort %v; got %v", max, wantAbort, err)
+		}
+		if wantAbort && sum.scannedFiles > max {
+			t.Errorf("max %d: expected at most %d files to be staged; got %d", max, max, sum.scannedFiles)
+		}
+		abort(nil)
+	}
+}
+
+func TestSizeRange(t *testing.T) {
+	defer func(h handler, minSize, maxSize int64) {
+		config.H, config.MinSize, config.MaxSize = h, minSize, maxSize
+	}(config.H, config.MinSize, config.MaxSize)
+	config.MinSize = 4
+	config.MaxSize = 6
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt":           "abc",
+		"a (1).txt":       "abc",
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"song.mp3":        "la la la",
+		"song (1).mp3":    "la la la",
+	})
+	var handled []string
+	config.H = handlerFunc(func(file, keep string) error {
+		handled = append(handled, filepath.Base(file))
+		return nil
+	})
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+	if want := []string{"flowers (1).jpg"}; !slices.Equal(handled, want) {
+		t.Errorf("expected %q; got %q", want, handled)
+	}
+}
+
+func TestHashBuckets(t *testing.T) {
+	defer func(h handler, minSize int64, hashAt int) {
+		config.H, config.MinSize, config.HashAt = h, minSize, hashAt
+	}(config.H, config.MinSize, config.HashAt)
+	config.MinSize = 0
+	config.HashAt = 3
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"thorns.jpg":      "thorns",
+		"thorns (1).jpg":  "thorns",
+		"leaves.jpg":      "leaves",
+		"song.mp3":        "la la",
+		"song (1).mp3":    "la la",
+	})
+	var handled []string
+	config.H = handlerFunc(func(file, keep string) error {
+		handled = append(handled, filepath.Base(file))
+		return nil
+	})
+	var compared int
+	compareFn := func(ctx context.Context, left, right string) (dup.Selection, error) {
+		compared++
+		return dup.FilenameFn(ctx, left, right)
+	}
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), compareFn, sum)
+
+	slices.Sort(handled)
+	if want := []string{"flowers (1).jpg", "song (1).mp3", "thorns (1).jpg"}; !slices.Equal(handled, want) {
+		t.Errorf("expected %q; got %q", want, handled)
+	}
+	// one comparison for each group of the hashed bucket, and one for the bucket below the threshold
+	if compared != 3 {
+		t.Errorf("expected 3 comparisons; got %d", compared)
+	}
+}
+
+func TestHashState(t *testing.T) {
+	if sqliteDriver == "" {
+		t.Skip("no SQLite driver on this platform")
+	}
+	defer func(h handler, minSize int64, state *hashState) {
+		config.H, config.MinSize, fileState = h, minSize, state
+	}(config.H, config.MinSize, fileState)
+	config.MinSize = 0
+
+	dir, stateDir := t.TempDir(), t.TempDir()
+	statePath := filepath.Join(stateDir, "state.db")
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg": "petals",
+		"thorns.jpg":  "thorns",
+		"leaves.jpg":  "leaves",
+		"song.mp3":    "la la",
+	})
+	run := func() (handled []string, st *hashState) {
+		st, err := openHashState(statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileState = st
+		config.H = handlerFunc(func(file, _ string) error {
+			handled = append(handled, filepath.Base(file))
+			return nil
+		})
+		ctx := context.Background()
+		roots := []string{dir}
+		sum := newSummary(roots)
+		if err := handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.close(); err != nil {
+			t.Fatal(err)
+		}
+		return handled, st
+	}
+
+	handled, st := run()
+	if len(handled) != 0 || st.hits != 0 || st.misses != 3 {
+		t.Fatalf("expected the 3 files of the same size to be hashed and none handled; got %q, %d reused, %d hashed", handled, st.hits, st.misses)
+	}
+
+	writeFiles(t, dir, map[string]string{"flowers (1).jpg": "petals"})
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "leaves.jpg"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	handled, st = run()
+	if want := []string{"flowers (1).jpg"}; !slices.Equal(handled, want) {
+		t.Errorf("expected the new duplicate to be found, %q; got %q", want, handled)
+	}
+	// only the new file and the one modified since are read to hash them
+	if st.hits != 2 || st.misses != 2 {
+		t.Errorf("expected 2 digests reused and 2 hashed; got %d and %d", st.hits, st.misses)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "thorns.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if _, st = run(); st.hits != 3 || st.misses != 0 {
+		t.Errorf("expected every digest to be reused; got %d reused and %d hashed", st.hits, st.misses)
+	}
+
+	st, err := openHashState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.close()
+	var n int
+	if err := st.db.QueryRow(`SELECT count(*) FROM files`).Scan(&n); err != nil || n != 3 {
+		t.Errorf("expected the digest of the removed file to be dropped; got %d digests, %v", n, err)
+	}
+
+	// a file that isn't a state database is refused rather than written to
+	other := filepath.Join(stateDir, "other.db")
+	db, err := sql.Open(sqliteDriver, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE photos (name TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := openHashState(other); err == nil {
+		t.Error("expected a database of another program to be refused")
+	}
+}
+
+func TestPrefilter(t *testing.T) {
+	defer func(h handler, minSize, prefilter int64) {
+		config.H, config.MinSize, config.Prefilter = h, minSize, prefilter
+	}(config.H, config.MinSize, config.Prefilter)
+	config.MinSize = 0
+	config.Prefilter = 4
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "headpetalstail",
+		"flowers (1).jpg": "headpetalstail",
+		"flowers (2).jpg": "headPETALStail", // differs where the prefilter doesn't look
+		"flowers (3).jpg": "HEADpetalstail",
+		"flowers (4).jpg": "headpetalsTAIL",
+	})
+
+	config.H = handlerFunc(func(string, string) error { return nil })
+	var compared []string
+	compareFn := func(ctx context.Context, left, right string) (dup.Selection, error) {
+		compared = append(compared, filepath.Base(left), filepath.Base(right))
+		return dup.FilenameFn(ctx, left, right)
+	}
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), compareFn, sum)
+
+	slices.Sort(compared)
+	compared = slices.Compact(compared)
+	if want := []string{"flowers (1).jpg", "flowers (2).jpg", "flowers.jpg"}; !slices.Equal(compared, want) {
+		t.Errorf("expected only %q to be compared; got %q", want, compared)
+	}
+}
+
+// BenchmarkPrefilter reports the fraction of comparisons that -prefilter-partial-hash-bytes rules out
+// for files of 1 MiB that each differ from the rest by a single byte somewhere in the file.
+func BenchmarkPrefilter(b *testing.B) {
+	const size, files = 1 << 20, 16
+	dir := b.TempDir()
+	var bucket []fileResult
+	content := make([]byte, size)
+	for i := range files {
+		p := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		content[i*size/files] ^= 0xff
+		if err := os.WriteFile(p, content, 0o644); err != nil {
+			b.Fatal(err)
+		}
+		content[i*size/files] ^= 0xff
+		bucket = append(bucket, fileResult{path: p, size: size, root: dir})
+	}
+	pairs := func(buckets [][]fileResult) (n int) {
+		for _, v := range buckets {
+			n += len(v) * (len(v) - 1) / 2
+		}
+		return n
+	}
+	all := pairs([][]fileResult{bucket})
+
+	for _, n := range []int64{4 << 10, 64 << 10, 256 << 10} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			var split [][]fileResult
+			for range b.N {
+				split = splitBuckets([][]fileResult{bucket}, partialHashKey(context.Background(), n))
+			}
+			b.ReportMetric(1-float64(pairs(split))/float64(all), "eliminated")
+		})
+	}
+}
+
+func TestReportAppend(t *testing.T) {
+	defer func(h handler, minSize int64) { config.H, config.MinSize = h, minSize }(config.H, config.MinSize)
+	config.MinSize = 0
+	config.H = handlerFunc(func(string, string) error { return nil })
+
+	photos, music := t.TempDir(), t.TempDir()
+	writeFiles(t, photos, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+	})
+	writeFiles(t, music, map[string]string{
+		"song.mp3":        "la la",
+		"song - Copy.mp3": "la la",
+	})
+	path := filepath.Join(t.TempDir(), "groups.json")
+
+	ctx := context.Background()
+	scan := func(root string) {
+		t.Helper()
+		roots := []string{root}
+		sum := newSummary(roots)
+		sum.recordClusters = true
+		handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+		if err := appendReportFile(path, sum.report()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scan(photos)
+	scan(music)
+	// scanning a directory again replaces its earlier entries rather than repeating them
+	scan(photos)
+
+	rep, err := readReportFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keep []string
+	for _, c := range rep.Clusters {
+		keep = append(keep, filepath.Base(c.Keep))
+	}
+	if want := []string{"song.mp3", "flowers.jpg"}; !slices.Equal(keep, want) {
+		t.Errorf("expected clusters keeping %q; got %q", want, keep)
+	}
+}
+
+func TestSkipKnownJunk(t *testing.T) {
+	defer func(h handler, minSize int64, skip bool, junk junkSet) {
+		config.H, config.MinSize, config.SkipJunk, knownJunk = h, minSize, skip, junk
+	}(config.H, config.MinSize, config.SkipJunk, knownJunk)
+	config.MinSize = 0
+	config.SkipJunk = true
+	knownJunk = mustParseJunk(builtinJunk)
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a/.gitkeep":      "\n",
+		"b/.gitkeep":      "\n",
+		"a/TODO":          "TODO",
+		"b/TODO":          "TODO",
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"junk.list":       "# placeholders\n4 337e547a950fc8a98592f10d964c1e79a304961790a8da0ce449a1f000cefabb TODO\n",
+	})
+	if err := knownJunk.readFile(filepath.Join(dir, "junk.list")); err != nil {
+		t.Fatal(err)
+	}
+
+	var handled []string
+	config.H = handlerFunc(func(file, _ string) error {
+		handled = append(handled, filepath.Base(file))
+		return nil
+	})
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+	if want := []string{"flowers (1).jpg"}; !slices.Equal(handled, want) {
+		t.Errorf("expected only %q to be handled; got %q", want, handled)
+	}
+}
+
+func TestJunkListInvalid(t *testing.T) {
+	for _, line := range []string{"4", "four 337e547a950fc8a98592f10d964c1e79a304961790a8da0ce449a1f000cefabb", "4 337e54"} {
+		if err := make(junkSet).read(strings.NewReader(line)); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestUnits(t *testing.T) {
+	defer func(units string) { config.Units = units }(config.Units)
+
+	tt := map[string]struct {
+		formatted []string
+		sizes     []int64
+		parsed    map[string]int64
+	}{
+		unitsIEC: {
+			formatted: []string{"512 bytes", "1.5 KiB", "64 MiB", "2.25 GiB"},
+			sizes:     []int64{512, 1536, 64 << 20, 9 << 28},
+			parsed:    map[string]int64{"1M": 1 << 20, "1MB": 1 << 20, "1MiB": 1 << 20, "1kb": 1 << 10, "1.5G": 3 << 29, "2048": 2048},
+		},
+		unitsSI: {
+			formatted: []string{"512 bytes", "1.5 kB", "64 MB", "2.25 GB"},
+			sizes:     []int64{512, 1500, 64e6, 2.25e9},
+			parsed:    map[string]int64{"1M": 1e6, "1MB": 1e6, "1MiB": 1 << 20, "1kb": 1e3, "1.5G": 1.5e9, "2048": 2048},
+		},
+	}
+	for units, tc := range tt {
+		config.Units = units
+		for i, size := range tc.sizes {
+			s := formatSize(size)
+			if s != tc.formatted[i] {
+				t.Errorf("%s: %d: expected %q; got %q", units, size, tc.formatted[i], s)
+			}
+			n, err := parseSize(s)
+			if err != nil {
+				t.Errorf("%s: %q: %v", units, s, err)
+			}
+			if n != size {
+				t.Errorf("%s: %q: expected %d; got %d", units, s, size, n)
+			}
+		}
+		for s, want := range tc.parsed {
+			if n, err := parseSize(s); n != want || err != nil {
+				t.Errorf("%s: %q: expected %d; got %d, %v", units, s, want, n, err)
+			}
+		}
+		for _, s := range []string{"", "M", "-1M", "1Xi", "1.5.1K", "one"} {
+			if _, err := parseSize(s); err == nil {
+				t.Errorf("%s: %q: expected an error", units, s)
+			}
+		}
+	}
+}
+
+func TestDangerousRoots(t *testing.T) {
+	defer func(h handler, dirs []string, execute, allow bool) {
+		config.H, config.Dirs, config.Execute, config.AllowDanger = h, dirs, execute, allow
+	}(config.H, config.Dirs, config.Execute, config.AllowDanger)
+	config.H = handlerFunc(func(string, string) error { return nil })
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	root := string(filepath.Separator)
+	if v := filepath.VolumeName(os.TempDir()); v != "" {
+		root = v + root
+	}
+	tt := []struct {
+		dir            string
+		execute, allow bool
+		wantErr        bool
+	}{
+		{root, true, false, true},
+		{home, true, false, true},
+		{filepath.Join(home, "."), true, false, true},
+		{root, false, false, false}, // dry run
+		{root, true, true, false},
+		{filepath.Join(home, "Pictures"), true, false, false},
+	}
+	for _, tc := range tt {
+		config.Dirs, config.Execute, config.AllowDanger = []string{tc.dir}, tc.execute, tc.allow
+		if err := validConfig(); (err != nil) != tc.wantErr {
+			t.Errorf("%s with -x=%t -allow-dangerous-roots=%t: expected error %t; got %v", tc.dir, tc.execute, tc.allow, tc.wantErr, err)
+		}
+	}
+}
+
+func TestComparisonOrder(t *testing.T) {
+	defer func(h handler, minSize int64, order string) {
+		config.H, config.MinSize, config.CompareOrder = h, minSize, order
+	}(config.H, config.MinSize, config.CompareOrder)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	// identical files that no rule can tell apart
+	writeFiles(t, dir, map[string]string{
+		"a/flowers.jpg": "petals",
+		"b/flowers.jpg": "petals",
+		"c/flowers.jpg": "petals",
+	})
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"a", "b", "c"} {
+		p := filepath.Join(dir, name, "flowers.jpg")
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kept := func(order ...string) string {
+		fr := make(chan fileResult, len(order))
+		for _, name := range order {
+			fr <- fileResult{path: filepath.Join(dir, name, "flowers.jpg"), size: 6, root: dir}
+		}
+		close(fr)
+		var keep string
+		config.H = handlerFunc(func(_, k string) error {
+			keep = filepath.Base(filepath.Dir(k))
+			return nil
+		})
+		ctx := context.Background()
+		sum := newSummary([]string{dir})
+		handleBuckets(ctx, stageBuckets(ctx, fr, sum), dup.FilenameFn, sum)
+		return keep
+	}
+
+	config.CompareOrder = compareOrderWalk
+	if a, c := kept("a", "b", "c"), kept("c", "b", "a"); a == c {
+		t.Fatalf("expected the walk order to decide the tie; kept %s both times", a)
+	}
+	config.CompareOrder = compareOrderPath
+	for _, order := range [][]string{{"a", "b", "c"}, {"c", "b", "a"}, {"b", "c", "a"}} {
+		if got := kept(order...); got != "a" {
+			t.Errorf("%q: expected the first path to be kept; got %s", order, got)
+		}
+	}
+	// the same modification times fall back to the path
+	config.CompareOrder = compareOrderMtime
+	for _, order := range [][]string{{"a", "b", "c"}, {"c", "b", "a"}, {"b", "c", "a"}} {
+		if got := kept(order...); got != "a" {
+			t.Errorf("%q: expected the first path to be kept; got %s", order, got)
+		}
+	}
+}
+
+func TestSortByModTime(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"new.jpg":    "petals",
+		"old.jpg":    "petals",
+		"middle.jpg": "petals",
+		"same.jpg":   "petals",
+	})
+	for name, year := range map[string]int{"new.jpg": 2022, "old.jpg": 2018, "middle.jpg": 2020, "same.jpg": 2020} {
+		mtime := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var bucket []fileResult
+	for _, name := range []string{"new.jpg", "same.jpg", "missing.jpg", "old.jpg", "middle.jpg"} {
+		bucket = append(bucket, fileResult{path: filepath.Join(dir, name), size: 6})
+	}
+
+	sortByModTime(bucket)
+	var got []string
+	for _, fr := range bucket {
+		got = append(got, filepath.Base(fr.path))
+	}
+	// oldest first and then by path, with files that can't be stat'd first
+	if want := []string{"missing.jpg", "old.jpg", "middle.jpg", "same.jpg", "new.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("expected %q; got %q", want, got)
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tt := map[string][]string{
+		`mv -n {dup} /archive/`:                 {"mv", "-n", "{dup}", "/archive/"},
+		`  echo   'a  b'  "c d"  `:              {"echo", "a  b", "c d"},
+		`echo 'it'\''s' "say \"hi\" \n"`:        {"echo", "it's", `say "hi" \n`},
+		`echo a\ b ''`:                          {"echo", "a b", ""},
+		`logger --tag=dedup "{dup}={original}"`: {"logger", "--tag=dedup", "{dup}={original}"},
+	}
+	for s, want := range tt {
+		got, err := splitCommand(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: expected %q; got %q", s, want, got)
+		}
+	}
+	for _, s := range []string{`echo 'a`, `echo "a`, `echo a\`} {
+		if _, err := splitCommand(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestExecHandler(t *testing.T) {
+	if _, err := parseExec("rm -rf /tmp/nothing"); err == nil {
+		t.Error("expected an error for a command without placeholders")
+	}
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell to run commands with")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "args")
+	e, err := parseExec(`sh -c 'printf "%s\n" "$@" > "$0"' ` + shellQuote(out) + ` --dup={dup} {original}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// names that would break naive concatenation
+	file := filepath.Join(dir, "it's a $(dup).jpg")
+	keep := filepath.Join(dir, "flowers; rm -rf ~.jpg")
+
+	if want := "'sh' '-c' " + shellQuote(`printf "%s\n" "$@" > "$0"`) + " " + shellQuote(out) + " " + shellQuote("--dup="+file) + " " + shellQuote(keep); e.String(file, keep) != want {
+		t.Errorf("expected the dry run to print\n%s\ngot\n%s", want, e.String(file, keep))
+	}
+	if err := e.handle(file, keep); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "--dup=" + file + "\n" + keep + "\n"; string(b) != want {
+		t.Errorf("expected the command to get the arguments\n%s\ngot\n%s", want, b)
+	}
+}
+
+func TestReportReasons(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":          "petals",
+		"flowers (1).jpg":      "petals",
+		"flowers":              "petals",
+		"12345.jpg":            "petals",
+		"sunset.jpg":           "petals",
+		"a/beach.jpg":          "petals",
+		"b/beach.jpg":          "petals",
+		"originals/flower.jpg": "petals",
+	})
+	older := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"flowers.jpg", "flowers (1).jpg", "flowers", "12345.jpg", "a/beach.jpg", "b/beach.jpg"} {
+		if err := os.Chtimes(filepath.Join(dir, name), older, older); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fr := func(name string) fileResult { return fileResult{path: filepath.Join(dir, name), size: 6, root: dir} }
+
+	tt := []struct {
+		opts      dup.Options
+		keep, dup string
+		want      string
+	}{
+		{dup.Options{}, "flowers.jpg", "flowers (1).jpg", "copy-counter"},
+		{dup.Options{}, "flowers.jpg", "flowers", "extension"},
+		{dup.Options{}, "sunset.jpg", "12345.jpg", "numeric-name"},
+		{dup.Options{}, "flowers.jpg", "sunset.jpg", "modification-time"},
+		{dup.Options{}, "a/beach.jpg", "b/beach.jpg", "tie"},
+		{dup.Options{PreferNewest: true}, "sunset.jpg", "flowers.jpg", "newest"},
+		{dup.Options{KeepPattern: regexp.MustCompile(`/originals/`)}, "originals/flower.jpg", "flowers.jpg", "keep-pattern"},
+	}
+	compareFn := func(opts dup.Options) dup.CompareFuncContext[fileResult] {
+		fn := dup.NewFilenameFn(opts)
+		return func(ctx context.Context, left, right fileResult) (dup.Selection, error) {
+			return fn(ctx, left.path, right.path)
+		}
+	}
+	for _, tc := range tt {
+		// the kept file comes first, so that a tie keeps it
+		bucket := []fileResult{fr(tc.keep), fr(tc.dup)}
+		matches, err := dup.MatchesContext(context.Background(), bucket, compareFn(tc.opts))
+		if err != nil || len(matches) != 1 || matches[0].Keep != 0 {
+			t.Fatalf("keeping %s over %s: unexpected matches %+v, %v", tc.keep, tc.dup, matches, err)
+		}
+		rc := newReportCluster(context.Background(), clustersOf(bucket, matches)[0], nil)
+		if got := rc.Reasons[fr(tc.dup).path]; got != tc.want {
+			t.Errorf("keeping %s over %s: expected reason %q; got %q", tc.keep, tc.dup, tc.want, got)
+		}
+	}
+
+	// with -invert, the reason is the inversion rather than the rule that kept the other file
+	c := cluster{keep: fr("flowers.jpg"), dups: []fileResult{fr("flowers (1).jpg")}, rules: []dup.Rule{dup.RuleCopyCounter}}
+	rc := newReportCluster(context.Background(), invertCluster(c), nil)
+	if got := rc.Reasons[fr("flowers.jpg").path]; got != "inverted" {
+		t.Errorf("expected the inverted duplicate to be recorded as %q; got %q", "inverted", got)
+	}
+}
+
+func TestApplyReasons(t *testing.T) {
+	defer func(h handler, minSize int64) { config.H, config.MinSize = h, minSize }(config.H, config.MinSize)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"beach.jpg":       "sand",
+		"shore.jpg":       "sand",
+	})
+	older := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(dir, "beach.jpg"), older, older); err != nil {
+		t.Fatal(err)
+	}
+
+	reasons, err := parseReasons("copy-counter, extension")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handled []string
+	config.H = applyReasons(handlerFunc(func(file, _ string) error {
+		handled = append(handled, filepath.Base(file))
+		return nil
+	}), reasons)
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+	if want := []string{"flowers (1).jpg"}; !slices.Equal(handled, want) {
+		t.Errorf("expected only %q to be handled; got %q", want, handled)
+	}
+	if sum.untrusted != 1 {
+		t.Errorf("expected the duplicate chosen by modification time to be left for review; got %d", sum.untrusted)
+	}
+
+	// the copy counter would keep flowers.jpg, but -invert handles it, so the rule that applies is the inversion
+	func() {
+		defer func(invert bool) { config.Invert = invert }(config.Invert)
+		config.Invert = true
+		handled = nil
+		sum := newSummary(roots)
+		handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+		if len(handled) != 0 || sum.untrusted != 2 {
+			t.Errorf("expected inverted duplicates to be left for review; got %q handled and %d left", handled, sum.untrusted)
+		}
+	}()
+
+	// the rule is passed through the wrappers around applyReasons rather than looked up by path,
+	// so the same path handled without a rule is refused
+	h := skipArchived(config.H)
+	file, keep := filepath.Join(dir, "flowers (1).jpg"), filepath.Join(dir, "flowers.jpg")
+	if err := handleSelected(h, file, keep, dup.RuleCopyCounter); err != nil {
+		t.Errorf("expected a duplicate chosen by the copy counter to be handled; got %v", err)
+	}
+	if err := h.handle(file, keep); !errors.Is(err, errUntrusted) {
+		t.Errorf("expected a duplicate without a rule to be refused; got %v", err)
+	}
+
+	if _, err := parseReasons("copy-counter,gut-feeling"); err == nil {
+		t.Error("expected an error for an unknown reason")
+	}
+}
+
+func TestListFSFilesTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	fsys := blockFS{
+		FS: fstest.MapFS{
+			"a/flowers.jpg":   {Data: []byte("petals")},
+			"b/stuck/one.jpg": {Data: []byte("petals")},
+		},
+		block:   "b/stuck",
+		release: release,
+	}
+
+	start := time.Now()
+	var got []string
+	for fr := range listFSFilesTimeout(context.Background(), fsys, "mnt", 50*time.Millisecond) {
+		got = append(got, fr.path)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the walk to be abandoned after the timeout; took %v", elapsed)
+	}
+	if want := []string{filepath.Join("mnt", "a", "flowers.jpg")}; !slices.Equal(got, want) {
+		t.Errorf("expected the files found before the timeout %q; got %q", want, got)
+	}
+
+	// a walk that finishes in time is unaffected
+	got = nil
+	for fr := range listFSFilesTimeout(context.Background(), fstest.MapFS{"flowers.jpg": {Data: []byte("petals")}}, "mnt", time.Minute) {
+		got = append(got, fr.path)
+	}
+	if len(got) != 1 {
+		t.Errorf("expected 1 file; got %q", got)
+	}
+}
+
+func TestGroupThreshold(t *testing.T) {
+	defer func(h handler, minSize, minGroup int64) {
+		config.H, config.MinSize, config.MinGroup = h, minSize, minGroup
+	}(config.H, config.MinSize, config.MinGroup)
+	config.MinSize = 0
+	config.MinGroup = 10
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"movie.mkv":       "a long feature",
+		"movie (1).mkv":   "a long feature",
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"song.mp3":        "la la",
+		"song (1).mp3":    "la la",
+	})
+	var handled []string
+	config.H = handlerFunc(func(file, _ string) error {
+		handled = append(handled, filepath.Base(file))
+		return nil
+	})
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	sum.recordClusters = true
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+	if want := []string{"movie (1).mkv"}; !slices.Equal(handled, want) {
+		t.Errorf("expected only %q to be reported; got %q", want, handled)
+	}
+	if len(sum.report().Clusters) != 1 {
+		t.Errorf("expected only the large group in the report; got %+v", sum.report().Clusters)
+	}
+	var out strings.Builder
+	sum.write(&out)
+	if want := "hid 2 smaller groups of identical files\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("expected the summary to contain %q; got\n%s", want, out.String())
+	}
+}
+
+func TestSummaryTotals(t *testing.T) {
+	defer func(h handler, minSize int64) { config.H, config.MinSize = h, minSize }(config.H, config.MinSize)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"song.mp3":        "la la",
+		"song (1).mp3":    "la la",
+		"notes.txt":       "unique text",
+	})
+	config.H = noopHandler
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+	var out strings.Builder
+	sum.write(&out)
+	if want := "compared 2 pairs and found 2 duplicates in 2 groups; would reclaim 11 bytes in "; !strings.Contains(out.String(), want) {
+		t.Errorf("expected the summary to contain %q; got\n%s", want, out.String())
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	defer func(h handler, minSize int64, baseline string) {
+		config.H, config.MinSize, config.Baseline = h, minSize, baseline
+	}(config.H, config.MinSize, config.Baseline)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	baseline := map[string]string{
+		"master/flowers.jpg":     "petals",
+		"master/flowers (1).jpg": "petals",
+		"master/beach.jpg":       "sand",
+	}
+	writeFiles(t, dir, baseline)
+	writeFiles(t, dir, map[string]string{
+		"phone/flowers.jpg":    "petals",
+		"phone/song.mp3":       "la la",
+		"laptop/song.mp3":      "la la",
+		"laptop/beach (2).jpg": "sand",
+	})
+	config.Baseline = filepath.Join(dir, "master")
+	var handled []string
+	config.H = handlerFunc(func(file, keep string) error {
+		if !inBaseline(keep) {
+			t.Errorf("kept %s instead of a baseline file", keep)
+		}
+		handled = append(handled, file)
+		return os.Remove(file)
+	})
+	ctx := context.Background()
+	roots := []string{filepath.Join(dir, "phone"), filepath.Join(dir, "laptop")}
+	sum := newSummary(roots)
+	buckets := stageBuckets(ctx, compileDirResults(ctx, append(roots, config.Baseline)), sum)
+	handleBuckets(ctx, buckets, baselineFn(dup.FilenameFn), sum)
+
+	slices.Sort(handled)
+	want := []string{filepath.Join(dir, "laptop/beach (2).jpg"), filepath.Join(dir, "phone/flowers.jpg")}
+	if !slices.Equal(handled, want) {
+		t.Errorf("expected %q to be handled; got %q", want, handled)
+	}
+	for name, content := range baseline {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(b) != content {
+			t.Errorf("expected baseline file %s to be untouched; got %q, %v", name, b, err)
+		}
+	}
+	for _, name := range []string{"phone/song.mp3", "laptop/song.mp3"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s outside the baseline to be kept: %v", name, err)
+		}
+	}
+}
+
+func TestSimilarImages(t *testing.T) {
+	// a picture with a few distinct shapes, so that its hash isn't all one value
+	picture := func(w, h int, invert bool) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := range h {
+			for x := range w {
+				fx, fy := float64(x)/float64(w), float64(y)/float64(h)
+				v := uint8(255 * (0.5 + 0.5*math.Sin(7*fx)*math.Cos(5*fy)))
+				if invert {
+					v = 255 - v
+				}
+				img.Set(x, y, color.RGBA{v, v / 2, 255 - v, 255})
+			}
+		}
+		return img
+	}
+	dir := t.TempDir()
+	write := func(name string, img image.Image, encode func(io.Writer, image.Image) error) {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := encode(f, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("beach small.jpg", picture(160, 120, false), func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, nil) })
+	write("beach.png", picture(640, 480, false), png.Encode)
+	write("night.png", picture(640, 480, true), png.Encode)
+	writeFiles(t, dir, map[string]string{"notes.jpg": "not an image"})
+
+	ctx := context.Background()
+	groups := similarImages(ctx, compileDirResults(ctx, []string{dir}), 10)
+	if len(groups) != 1 {
+		t.Fatalf("expected one group of similar images; got %d", len(groups))
+	}
+	var got []string
+	for _, img := range groups[0] {
+		got = append(got, filepath.Base(img.path))
+	}
+	if want := []string{"beach.png", "beach small.jpg"}; !slices.Equal(got, want) {
+		t.Errorf("expected %q with the highest resolution first; got %q", want, got)
+	}
+
+	var out, summary strings.Builder
+	writeSimilarImages(&out, &summary, groups)
+	if want := "640x480\t" + filepath.Join(dir, "beach.png") + "\n"; !strings.HasPrefix(out.String(), want) {
+		t.Errorf("expected output to start with %q; got %q", want, out.String())
+	}
+}
+
+func TestListComparisons(t *testing.T) {
+	defer func(minSize int64) { config.MinSize = minSize }(config.MinSize)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		// once the first comparison finds a duplicate, it is never compared again
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"flowers (2).jpg": "petals",
+		// files that are all different have to be compared with each other
+		"a.txt": "1",
+		"b.txt": "2",
+		"c.txt": "3",
+		"d.txt": "4",
+	})
+	ctx := context.Background()
+	roots := []string{dir}
+	var out strings.Builder
+	counts := listComparisons(ctx, &out, stageBuckets(ctx, compileDirResults(ctx, roots), newSummary(roots)), dup.FilenameFn)
+	slices.SortFunc(counts, func(a, b bucketComparisons) int { return int(a.size - b.size) })
+
+	want := []bucketComparisons{
+		{size: 1, files: 4, compared: 6, duplicates: 0},
+		{size: 6, files: 3, compared: 2, duplicates: 2},
+	}
+	if !slices.Equal(counts, want) {
+		t.Errorf("expected %+v; got %+v", want, counts)
+	}
+	if n := strings.Count(out.String(), "\t"); n != 2*8 {
+		t.Errorf("expected 8 comparisons to be printed; got output\n%s", out.String())
+	}
+	var total strings.Builder
+	writeComparisonTotals(&total, counts)
+	if want := "8 comparisons of 9 possible in 2 buckets of 7 files; 2 duplicates\n"; total.String() != want {
+		t.Errorf("expected %q; got %q", want, total.String())
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	defer func(h handler, minSize int64, p *progress) {
+		config.H, config.MinSize, prog = h, minSize, p
+	}(config.H, config.MinSize, prog)
+	config.MinSize = 0
+	config.H = handlerFunc(func(string, string) error { return nil })
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":          "petals",
+		"flowers (1).jpg":      "petals",
+		"albums/beach.jpg":     "sand",
+		"albums/2024/song.mp3": "la la",
+	})
+	ctx := context.Background()
+	roots := []string{dir}
+	files, bytes := countFiles(compileDirResults(ctx, roots))
+	if files != 4 || bytes != 21 {
+		t.Fatalf("expected 4 files of 21 bytes; got %d files of %d bytes", files, bytes)
+	}
+
+	prog = &progress{estimate: true, totalFiles: int64(files)}
+	if want := "walked 0 of 4 files (0%)"; prog.status(time.Now()) != want {
+		t.Errorf("expected %q; got %q", want, prog.status(time.Now()))
+	}
+	sum := newSummary(roots)
+	buckets := stageBuckets(ctx, compileDirResults(ctx, roots), sum)
+	if walked := prog.walked.Load(); walked != 4 {
+		t.Errorf("expected 4 files to be walked; got %d", walked)
+	}
+	if want := "compared 0 bytes of 12 bytes (0%)"; prog.status(time.Now()) != want {
+		t.Errorf("expected %q; got %q", want, prog.status(time.Now()))
+	}
+	handleBuckets(ctx, buckets, dup.FilenameFn, sum)
+	if want := "compared 12 bytes of 12 bytes (100%)"; prog.status(time.Now()) != want {
+		t.Errorf("expected %q; got %q", want, prog.status(time.Now()))
+	}
+}
+
+func TestProgress(t *testing.T) {
+	defer func(h handler, minSize int64, p *progress) {
+		config.H, config.MinSize, prog = h, minSize, p
+	}(config.H, config.MinSize, prog)
+	config.MinSize = 0
+	config.H = handlerFunc(func(string, string) error { return nil })
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"thorns.jpg":      "thorns",
+		"song.mp3":        "la la",
+		"song (1).mp3":    "la la",
+		"unique.txt":      "unique text",
+	})
+	prog = &progress{}
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+	// flowers (1).jpg is a duplicate of the first file compared, so it isn't compared again
+	if want := "walked 6 files, 2 buckets to compare, 3 comparisons"; prog.status(time.Now()) != want {
+		t.Errorf("expected %q; got %q", want, prog.status(time.Now()))
+	}
+}
+
+func TestInvert(t *testing.T) {
+	defer func(h handler, minSize int64, invert bool) {
+		config.H, config.MinSize, config.Invert = h, minSize, invert
+	}(config.H, config.MinSize, config.Invert)
+	config.MinSize = 0
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+	})
+	for _, invert := range []bool{false, true} {
+		config.Invert = invert
+		var handled, kept string
+		config.H = handlerFunc(func(file, keep string) error {
+			handled, kept = filepath.Base(file), filepath.Base(keep)
+			return nil
+		})
+		ctx := context.Background()
+		roots := []string{dir}
+		sum := newSummary(roots)
+		handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+
+		wantHandled, wantKept := "flowers (1).jpg", "flowers.jpg"
+		if invert {
+			wantHandled, wantKept = wantKept, wantHandled
+		}
+		if handled != wantHandled || kept != wantKept {
+			t.Errorf("invert %v: expected %q to be handled in favor of %q; got %q and %q", invert, wantHandled, wantKept, handled, kept)
+		}
+	}
+
+	defer func(execute, acceptRisk bool) { config.Execute, config.AcceptRisk = execute, acceptRisk }(config.Execute, config.AcceptRisk)
+	config.Invert, config.Execute, config.AcceptRisk = true, true, false
+	if err := validConfig(); err == nil || !strings.Contains(err.Error(), "-i-understand-the-risk") {
+		t.Errorf("expected -invert -x to require confirmation; got %v", err)
+	}
+
+	defer func(baseline string, keepLinked bool) { config.Baseline, config.KeepLinked = baseline, keepLinked }(config.Baseline, config.KeepLinked)
+	config.AcceptRisk = true
+	for _, protect := range []func(){
+		func() { config.Baseline, config.KeepLinked = t.TempDir(), false },
+		func() { config.Baseline, config.KeepLinked = "", true },
+	} {
+		protect()
+		if err := validConfig(); err == nil || !strings.Contains(err.Error(), "-invert can't be combined") {
+			t.Errorf("expected -invert to be refused with -baseline %q and -preserve-symlinks-as-originals %v; got %v", config.Baseline, config.KeepLinked, err)
+		}
+	}
+}
+
+func TestBufferReuse(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+		"roses.jpg":       "thorns",
+		"tulips.jpg":      "petals",
+		"weeds.jpg":       "tangle",
+	})
+	var bucket []fileResult
+	for _, name := range []string{"flowers (1).jpg", "roses.jpg", "flowers.jpg", "weeds.jpg", "tulips.jpg"} {
+		bucket = append(bucket, fileResult{path: filepath.Join(dir, name), size: 6, root: dir})
+	}
+	cmp := func(compareFn dup.CompareFuncContext[string]) dup.CompareFuncContext[fileResult] {
+		return func(ctx context.Context, left, right fileResult) (dup.Selection, error) {
+			return compareFn(ctx, left.path, right.path)
+		}
+	}
+	ctx := context.Background()
+	want, err := dup.MatchesContext(ctx, bucket, cmp(dup.FilenameFn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selectFn := dup.NewFilenameFn(dup.Options{AssumeEqual: true})
+	// the total only fits three of the files, so the rest are streamed
+	for _, cache := range []*bufferCache{newBufferCache(6, 1<<20), newBufferCache(6, 18), newBufferCache(5, 1<<20)} {
+		got, _ := dup.MatchesContext(ctx, bucket, cmp(bufferFn(dup.FilenameFn, selectFn, cache, 0)))
+		if !slices.Equal(got, want) {
+			t.Errorf("max file %d, max total %d: expected %+v; got %+v", cache.maxFile, cache.maxTotal, want, got)
+		}
+		if cache.total > cache.maxTotal {
+			t.Errorf("cached %d bytes, more than the maximum of %d", cache.total, cache.maxTotal)
+		}
+	}
+
+	// with -first-bytes, files that only differ later are duplicates
+	got, _ := dup.MatchesContext(ctx, bucket[:2], cmp(bufferFn(dup.FilenameFn, selectFn, newBufferCache(6, 1<<20), 1)))
+	if len(got) != 0 {
+		t.Errorf("expected \"petals\" and \"thorns\" to differ in the first byte; got %+v", got)
+	}
+	got, _ = dup.MatchesContext(ctx, []fileResult{bucket[1], bucket[3]}, cmp(bufferFn(dup.FilenameFn, selectFn, newBufferCache(6, 1<<20), 1)))
+	if len(got) != 1 {
+		t.Errorf("expected \"thorns\" and \"tangle\" to match in the first byte; got %+v", got)
+	}
+}
+
+func BenchmarkBufferReuse(b *testing.B) {
+	const size, files = 4 << 10, 64
+	dir := b.TempDir()
+	var bucket []fileResult
+	content := make([]byte, size)
+	for i := range files {
+		p := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		content[size-1] = byte(i)
+		if err := os.WriteFile(p, content, 0o644); err != nil {
+			b.Fatal(err)
+		}
+		bucket = append(bucket, fileResult{path: p, size: size, root: dir})
+	}
+	cmp := func(compareFn dup.CompareFuncContext[string]) dup.CompareFuncContext[fileResult] {
+		return func(ctx context.Context, left, right fileResult) (dup.Selection, error) {
+			return compareFn(ctx, left.path, right.path)
+		}
+	}
+	ctx := context.Background()
+	selectFn := dup.NewFilenameFn(dup.Options{AssumeEqual: true})
+
+	b.Run("stream", func(b *testing.B) {
+		for range b.N {
+			dup.MatchesContext(ctx, bucket, cmp(dup.FilenameFn))
+		}
+	})
+	b.Run("buffer", func(b *testing.B) {
+		for range b.N {
+			// a new cache per run, since each run stands for a new bucket
+			dup.MatchesContext(ctx, bucket, cmp(bufferFn(dup.FilenameFn, selectFn, newBufferCache(size, 64<<20), 0)))
+		}
+	})
+}
+
+func TestIntoArchives(t *testing.T) {
+	defer func(h handler, minSize int64, intoArchive bool) {
+		config.H, config.MinSize, config.IntoArchive = h, minSize, intoArchive
+	}(config.H, config.MinSize, config.IntoArchive)
+	config.MinSize = 0
+	config.IntoArchive = true
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"song.mp3":        "la la",
+		"song (1).mp3":    "la la",
+		"notes/beach.txt": "sand!",
+	})
+	zf, err := os.Create(filepath.Join(dir, "backup.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	for name, content := range map[string]string{"photos/flowers.jpg": "petals", "photos/roses.jpg": "thorns"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zf.Close()
+	tf, err := os.Create(filepath.Join(dir, "old.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(tf)
+	tw.WriteHeader(&tar.Header{Name: "beach.txt", Mode: 0o644, Size: 5, Typeflag: tar.TypeReg})
+	io.WriteString(tw, "sand!")
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tf.Close()
+
+	var handled []string
+	config.H = skipArchived(handlerFunc(func(file, _ string) error {
+		handled = append(handled, filepath.Base(file))
+		return nil
+	}))
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	sum.recordClusters = true
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), archiveFn(dup.FilenameFn), sum)
+
+	if want := []string{"song (1).mp3"}; !slices.Equal(handled, want) {
+		t.Errorf("expected only %q to be handled; got %q", want, handled)
+	}
+	if sum.archived != 2 {
+		t.Errorf("expected 2 duplicates involving archives to be left for review; got %d", sum.archived)
+	}
+	kept := make(map[string]string)
+	for _, c := range sum.report().Clusters {
+		for _, d := range c.Duplicates {
+			kept[d] = c.Keep
+		}
+	}
+	for file, keep := range map[string]string{
+		"flowers.jpg":     "backup.zip/photos/flowers.jpg",
+		"notes/beach.txt": "old.tar/beach.txt",
+	} {
+		if got := kept[filepath.Join(dir, file)]; got != filepath.Join(dir, keep) {
+			t.Errorf("expected %s to be reported as a duplicate of %s; got %q", file, keep, got)
+		}
+	}
+
+	func() {
+		defer func(dirs []string, format string) { config.Dirs, config.Format = dirs, format }(config.Dirs, config.Format)
+		config.Dirs = roots
+		for _, format := range []string{formatJSON, formatHashes} {
+			config.Format = format
+			if err := validConfig(); err == nil || !strings.Contains(err.Error(), "-into-archives") {
+				t.Errorf("expected -into-archives to be rejected with -format %s; got %v", format, err)
+			}
+		}
+		config.Format = formatScript
+		if err := validConfig(); err != nil {
+			t.Errorf("expected -into-archives to be allowed with -format %s; got %v", config.Format, err)
+		}
+	}()
+}
+
+func TestWatchInterrupts(t *testing.T) {
+	type result struct {
+		canceled bool
+		exit     int
+	}
+	// start runs watchInterrupts and returns its signal and done channels,
+	// and a function that waits for it to return and reports what it did
+	start := func(t *testing.T, timeout time.Duration) (chan os.Signal, chan struct{}, func() result) {
+		c, done := make(chan os.Signal, 2), make(chan struct{})
+		var r result
+		r.exit = -1
+		returned := make(chan struct{})
+		go func() {
+			defer close(returned)
+			watchInterrupts(c, done, func() { r.canceled = true }, timeout, func(code int) { r.exit = code })
+		}()
+		return c, done, func() result {
+			select {
+			case <-returned:
+			case <-time.After(5 * time.Second):
+				t.Fatal("watchInterrupts didn't return")
+			}
+			return r
+		}
+	}
+
+	t.Run("finishes within the timeout", func(t *testing.T) {
+		c, done, wait := start(t, time.Minute)
+		c <- os.Interrupt
+		time.Sleep(10 * time.Millisecond)
+		close(done)
+		if r := wait(); !r.canceled || r.exit != -1 {
+			t.Errorf("expected the run to be canceled without exiting; got %+v", r)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		c, done, wait := start(t, 10*time.Millisecond)
+		defer close(done)
+		c <- os.Interrupt
+		if r := wait(); !r.canceled || r.exit != 1 {
+			t.Errorf("expected an exit once the timeout passed; got %+v", r)
+		}
+	})
+	t.Run("second interrupt", func(t *testing.T) {
+		c, done, wait := start(t, time.Minute)
+		defer close(done)
+		c <- os.Interrupt
+		c <- os.Interrupt
+		if r := wait(); !r.canceled || r.exit != 1 {
+			t.Errorf("expected an exit on the second interrupt; got %+v", r)
+		}
+	})
+	t.Run("no interrupt", func(t *testing.T) {
+		_, done, wait := start(t, time.Minute)
+		close(done)
+		if r := wait(); r.canceled || r.exit != -1 {
+			t.Errorf("expected nothing to happen; got %+v", r)
+		}
+	})
+}
+
+func TestFormatHashes(t *testing.T) {
+	defer func(h handler, minSize, seed int64, order string) {
+		config.H, config.MinSize, config.Seed, config.CompareOrder = h, minSize, seed, order
+	}(config.H, config.MinSize, config.Seed, config.CompareOrder)
+	config.MinSize = 0
+	config.CompareOrder = compareOrderPath
+
+	dir := t.TempDir()
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]string{
+		// no rule can tell these apart, so only the comparison order decides which is kept
+		"a/song.mp3":        "la la",
+		"b/song.mp3":        "la la",
+		"c/song.mp3":        "la la",
+		"a/flowers.jpg":     "petals",
+		"b/flowers (1).jpg": "petals",
+		"c/beach.jpg":       "sand",
+	}
+	writeFiles(t, dir, files)
+	for name := range files {
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := func(seed int64, roots ...string) string {
+		config.Seed = seed
+		for i, r := range roots {
+			roots[i] = filepath.Join(dir, r)
+		}
+		ctx := context.Background()
+		hashes := &hashList{ctx: ctx, newHash: hashAlgorithms["sha256"]}
+		config.H = hashes
+		sum := newSummary(roots)
+		handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), dup.FilenameFn, sum)
+		var out strings.Builder
+		if err := hashes.write(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+	want := run(0, "a", "b", "c")
+	if n := strings.Count(want, "\n"); n != 3 {
+		t.Fatalf("expected 3 duplicates; got\n%s", want)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(want), "\n") {
+		if fields := strings.Split(line, "\t"); len(fields) != 3 || len(fields[0]) != shortHashLen {
+			t.Errorf("expected a short hash, the duplicate, and the kept file; got %q", line)
+		}
+	}
+	for _, got := range []string{run(0, "c", "b", "a"), run(7, "b", "c", "a"), run(42, "a", "c", "b")} {
+		if got != want {
+			t.Errorf("expected the same output for every order; got\n%s\nand\n%s", want, got)
+		}
+	}
+}
+
+func TestVerifySample(t *testing.T) {
+	dir := t.TempDir()
+	var rep report.Report
+	for i := range 10 {
+		keep, dupe := fmt.Sprintf("file%d.txt", i), fmt.Sprintf("file%d (1).txt", i)
+		content := fmt.Sprintf("contents %d", i)
+		files := map[string]string{keep: content, dupe: content}
+		// the report is wrong about two of the clusters
+		if i == 3 || i == 7 {
+			files[dupe] = fmt.Sprintf("changed! %d", i)
+		}
+		writeFiles(t, dir, files)
+		rep.Clusters = append(rep.Clusters, report.Cluster{
+			Size:       int64(len(content)),
+			Keep:       filepath.Join(dir, keep),
+			Duplicates: []string{filepath.Join(dir, dupe)},
+		})
+	}
+	ctx := context.Background()
+
+	checked, verified, failed := verifySample(ctx, rep, 0.25, rand.New(rand.NewSource(1)))
+	if verified != 3 {
+		t.Errorf("expected 25%% of 10 clusters to round up to 3 verified; got %d", verified)
+	}
+	if len(checked.Clusters) != len(rep.Clusters)-len(failed) {
+		t.Errorf("expected only the %d failed clusters to be removed; got %d of %d clusters", len(failed), len(checked.Clusters), len(rep.Clusters))
+	}
+	again, _, failedAgain := verifySample(ctx, rep, 0.25, rand.New(rand.NewSource(1)))
+	if !reflect.DeepEqual(again, checked) || !slices.Equal(failed, failedAgain) {
+		t.Error("expected the same sample for the same seed")
+	}
+
+	checked, verified, failed = verifySample(ctx, rep, 1, rand.New(rand.NewSource(1)))
+	slices.Sort(failed)
+	if want := []string{filepath.Join(dir, "file3.txt"), filepath.Join(dir, "file7.txt")}; verified != 10 || !slices.Equal(failed, want) {
+		t.Errorf("expected all 10 clusters to be verified and %q to fail; got %d and %q", want, verified, failed)
+	}
+	if len(checked.Clusters) != 8 {
+		t.Errorf("expected the 8 good clusters to remain; got %d", len(checked.Clusters))
+	}
+
+	if _, err := parsePercent("10%"); err != nil {
+		t.Error(err)
+	}
+	if _, err := parsePercent("120%"); err == nil {
+		t.Error("expected an error for more than 100%")
+	}
+}
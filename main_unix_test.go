@@ -0,0 +1,227 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Travis-Britz/dedup/dup"
+	"github.com/Travis-Britz/dedup/internal/fileid"
+	"golang.org/x/sys/unix"
+)
+
+func TestPreserveSymlinksAsOriginals(t *testing.T) {
+	defer func(h handler, minSize int64, keepLinked bool, targets *linkTargets) {
+		config.H, config.MinSize, config.KeepLinked, symlinkTargets = h, minSize, keepLinked, targets
+	}(config.H, config.MinSize, config.KeepLinked, symlinkTargets)
+	config.MinSize = 0
+	config.KeepLinked = true
+	symlinkTargets = &linkTargets{ids: make(map[fileid.FileID]bool)}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"photos/flowers.jpg":     "petals",
+		"photos/flowers (1).jpg": "petals",
+		"photos/flowers (2).jpg": "petals",
+		"music/song.mp3":         "la la",
+		"music/song (1).mp3":     "la la",
+	})
+	// without the links, flowers.jpg would be kept in place of both copies
+	for link, target := range map[string]string{
+		"albums/flowers.jpg":   "../photos/flowers (1).jpg",
+		"albums/wallpaper.jpg": "../photos/flowers (2).jpg",
+		"albums/missing.jpg":   "../photos/missing.jpg",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(link)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var handled []string
+	config.H = handlerFunc(func(file, keep string) error {
+		handled = append(handled, filepath.Base(file))
+		return os.Remove(file)
+	})
+	ctx := context.Background()
+	roots := []string{dir}
+	sum := newSummary(roots)
+	handleBuckets(ctx, stageBuckets(ctx, compileDirResults(ctx, roots), sum), linkTargetFn(dup.FilenameFn, symlinkTargets), sum)
+
+	slices.Sort(handled)
+	if want := []string{"flowers.jpg", "song (1).mp3"}; !slices.Equal(handled, want) {
+		t.Errorf("expected %q to be handled; got %q", want, handled)
+	}
+	for _, link := range []string{"albums/flowers.jpg", "albums/wallpaper.jpg"} {
+		if b, err := os.ReadFile(filepath.Join(dir, link)); err != nil || string(b) != "petals" {
+			t.Errorf("expected symlink %s to still work; got %q, %v", link, b, err)
+		}
+	}
+}
+
+func TestLinkHandlerCrossDevice(t *testing.T) {
+	dir := t.TempDir()
+	other, err := os.MkdirTemp("/dev/shm", "dedup")
+	if err != nil {
+		t.Skip("no second filesystem to link across:", err)
+	}
+	defer os.RemoveAll(other)
+	writeFiles(t, dir, map[string]string{"flowers.jpg": "petals"})
+	writeFiles(t, other, map[string]string{"flowers (1).jpg": "petals"})
+	keep, file := filepath.Join(dir, "flowers.jpg"), filepath.Join(other, "flowers (1).jpg")
+	id1, err1 := fileid.Stat(keep)
+	id2, err2 := fileid.Stat(file)
+	if err := errors.Join(err1, err2); err != nil {
+		t.Fatal(err)
+	}
+	if id1.Dev == id2.Dev {
+		t.Skip("the temporary directories are on the same filesystem")
+	}
+
+	if err := linkHandler(file, keep); !errors.Is(err, errCrossDevice) {
+		t.Fatalf("expected errCrossDevice; got %v", err)
+	}
+	if b, err := os.ReadFile(file); err != nil || string(b) != "petals" {
+		t.Errorf("expected the duplicate to be left as it was; got %q, %v", b, err)
+	}
+}
+
+func TestTrashInsideSymlinkedDirectory(t *testing.T) {
+	defer func(h handler, dirs []string, action, trash string) {
+		config.H, config.Dirs, config.Action, config.Trash = h, dirs, action, trash
+	}(config.H, config.Dirs, config.Action, config.Trash)
+	dir, links := t.TempDir(), t.TempDir()
+	link := filepath.Join(links, "photos")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	config.H, config.Action = noopHandler, actionMove
+
+	config.Dirs, config.Trash = []string{link}, filepath.Join(dir, ".trash")
+	if err := validConfig(); err == nil || !strings.Contains(err.Error(), "inside directory") {
+		t.Errorf("expected a trash inside the directory behind a symlink to be refused; got %v", err)
+	}
+}
+
+func TestSymlinkHandler(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"flowers.jpg":     "petals",
+		"flowers (1).jpg": "petals",
+	})
+	keep, file := filepath.Join(dir, "flowers.jpg"), filepath.Join(dir, "flowers (1).jpg")
+
+	if err := symlinkHandler(file, keep); err != nil {
+		t.Fatal(err)
+	}
+	target, err := os.Readlink(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(target) || filepath.Base(target) != "flowers.jpg" {
+		t.Errorf("expected an absolute link to flowers.jpg; got %s", target)
+	}
+	if b, err := os.ReadFile(file); err != nil || string(b) != "petals" {
+		t.Errorf("expected the link to read the kept file; got %q, %v", b, err)
+	}
+
+	// already replaced by an earlier pair
+	if err := symlinkHandler(file, keep); !errors.Is(err, errReplaced) {
+		t.Errorf("expected errReplaced for a duplicate that is already a link; got %v", err)
+	}
+	if err := symlinkHandler(keep, keep); !errors.Is(err, errReplaced) {
+		t.Errorf("expected errReplaced for a link to itself; got %v", err)
+	}
+	if b, err := os.ReadFile(keep); err != nil || string(b) != "petals" {
+		t.Errorf("expected the kept file to be untouched; got %q, %v", b, err)
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	defer func(follow bool) { config.FollowLinks = follow }(config.FollowLinks)
+
+	dir, other := t.TempDir(), t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"photos/flowers.jpg":    "petals",
+		"photos/2020/beach.jpg": "sand",
+	})
+	writeFiles(t, other, map[string]string{"video.mp4": "frames"})
+	for link, target := range map[string]string{
+		"photos/2020/up":   "../..",              // a loop back to the root
+		"photos/also-2020": "2020",               // a directory that is walked anyway
+		"videos":           other,                // a directory outside the tree
+		"favorite.jpg":     "photos/flowers.jpg", // a file
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{
+		filepath.Join(dir, "photos", "2020", "beach.jpg"),
+		filepath.Join(dir, "photos", "flowers.jpg"),
+	}
+	config.FollowLinks = false
+	if got := collectPaths(listFSFiles(context.Background(), os.DirFS(dir), dir)); !slices.Equal(got, want) {
+		t.Errorf("without following: expected %q; got %q", want, got)
+	}
+	want = append(want, filepath.Join(dir, "videos", "video.mp4"))
+	config.FollowLinks = true
+	if got := collectPaths(listFSFiles(context.Background(), os.DirFS(dir), dir)); !slices.Equal(got, want) {
+		t.Errorf("following: expected %q; got %q", want, got)
+	}
+}
+
+// TestCancelBlockedRead reads named pipes that never receive any data,
+// standing in for a read on a slow disk that doesn't return.
+func TestCancelBlockedRead(t *testing.T) {
+	dir := t.TempDir()
+	left, right := filepath.Join(dir, "flowers.jpg"), filepath.Join(dir, "flowers (1).jpg")
+	for _, name := range []string{left, right} {
+		if err := unix.Mkfifo(name, 0o644); err != nil {
+			t.Skip("named pipes unsupported:", err)
+		}
+		// opening a pipe for reading blocks until there is a writer,
+		// and opening it for reading and writing doesn't
+		w, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+	}
+
+	reads := map[string]func(ctx context.Context) error{
+		"verify": func(ctx context.Context) error {
+			_, err := firstDifference(ctx, left, right)
+			return err
+		},
+		"prefilter": func(ctx context.Context) error {
+			_, err := partialHash(ctx, left, 0, 64)
+			return err
+		},
+	}
+	for name, read := range reads {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- read(ctx) }()
+
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("%s: expected %v; got %v", name, context.Canceled, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: read did not return after cancellation", name)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// memGuard pauses the staging of new buckets while the heap is above max bytes,
+// giving the buckets already being compared a chance to finish and release their memory.
+type memGuard struct {
+	max int64
+	// heap returns the current heap size. It is replaced in tests.
+	heap func() uint64
+	// poll is how often the heap is checked while throttled, up to tries times.
+	poll  time.Duration
+	tries int
+}
+
+func newMemGuard(max int64) *memGuard {
+	return &memGuard{
+		max:   max,
+		heap:  heapAlloc,
+		poll:  100 * time.Millisecond,
+		tries: 50,
+	}
+}
+
+func heapAlloc() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// wait returns once the heap is at or below g.max.
+// If the heap doesn't shrink within g.tries polls, wait gives up and returns anyway,
+// because the memory is held by something other than the comparisons in flight.
+// It reports whether throttling engaged.
+func (g *memGuard) wait(ctx context.Context) bool {
+	if g == nil || g.max <= 0 || g.heap() <= uint64(g.max) {
+		return false
+	}
+	slog.Info("heap above -max-mem; pausing new buckets", "heap", g.heap(), "max", g.max)
+	for range g.tries {
+		runtime.GC()
+		select {
+		case <-ctx.Done():
+			return true
+		case <-time.After(g.poll):
+		}
+		if g.heap() <= uint64(g.max) {
+			slog.Info("heap below -max-mem; resuming", "heap", g.heap(), "max", g.max)
+			return true
+		}
+	}
+	slog.Warn("heap still above -max-mem; continuing anyway", "heap", g.heap(), "max", g.max)
+	return true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// Metadata that -merge-meta can copy onto the kept file.
+const (
+	mergeMtime  = "mtime"
+	mergeXattrs = "xattrs"
+)
+
+// parseMergeMeta splits the comma-separated value of -merge-meta.
+func parseMergeMeta(list string) ([]string, error) {
+	var kinds []string
+	for _, kind := range strings.Split(list, ",") {
+		kind = strings.TrimSpace(kind)
+		switch kind {
+		case "":
+		case mergeMtime, mergeXattrs:
+			kinds = append(kinds, kind)
+		default:
+			return nil, fmt.Errorf("unknown metadata %q", kind)
+		}
+	}
+	return kinds, nil
+}
+
+// mergeMeta copies metadata from the duplicates in c onto the kept file before they are handled:
+// the oldest modification time among all of them,
+// and every extended attribute that the kept file doesn't already have.
+// Without config.Execute the changes are only printed.
+func mergeMeta(c cluster, kinds []string) error {
+	if slices.Contains(kinds, mergeMtime) {
+		if err := mergeModTimeInto(c); err != nil {
+			return err
+		}
+	}
+	if slices.Contains(kinds, mergeXattrs) {
+		if err := mergeXattrsInto(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mergeModTimeInto(c cluster) error {
+	times := modTimes(c)
+	oldest := touchTime(touchOldest, times, c.keep, c.dups)
+	if oldest.IsZero() || !oldest.Before(times[c.keep.path]) {
+		return nil
+	}
+	if !config.Execute {
+		fmt.Fprintf(os.Stderr, "touch %s -> %s\n", c.keep.path, oldest.Format(time.RFC3339Nano))
+		return nil
+	}
+	return os.Chtimes(c.keep.path, time.Time{}, oldest)
+}
+
+func mergeXattrsInto(c cluster) error {
+	have, err := dup.ReadXattrs(c.keep.path)
+	if err != nil {
+		return err
+	}
+	if have == nil {
+		have = make(map[string][]byte)
+	}
+	for _, d := range c.dups {
+		attrs, err := dup.ReadXattrs(d.path)
+		if err != nil {
+			slog.Error("unable to read extended attributes", "file", d, "err", err)
+			continue
+		}
+		for name, value := range attrs {
+			if _, ok := have[name]; ok {
+				continue
+			}
+			if !config.Execute {
+				fmt.Fprintf(os.Stderr, "xattr %s: %s from %s\n", c.keep.path, name, d.path)
+			} else if err := dup.SetXattr(c.keep.path, name, value); err != nil {
+				return fmt.Errorf("setting %s: %w", name, err)
+			}
+			have[name] = value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/Travis-Britz/dedup/dup"
+	"github.com/Travis-Britz/dedup/report"
+)
+
+// pairWriter writes each duplicate as a line of JSON in place of handling it, for -format json.
+// Lines are written as soon as each duplicate is found, so they can be read while the run continues.
+// The reason is the rule that selected the duplicate, when one is known.
+type pairWriter struct {
+	w io.Writer
+}
+
+func (p *pairWriter) handle(file, keep string) error {
+	return p.handleRule(file, keep, "")
+}
+
+func (p *pairWriter) handleRule(file, keep string, rule dup.Rule) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	pair := report.Pair{Duplicate: file, Keep: keep, Size: fi.Size()}
+	if rule != "" {
+		pair.Reason = reportReason(rule)
+	}
+	return report.Marshal(p.w, pair)
+}
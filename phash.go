@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	modeExact = "exact"
+	modePhash = "phash"
+)
+
+// imageExtensions are the files that -mode phash tries to decode.
+var imageExtensions = []string{".jpg", ".jpeg", ".png", ".gif"}
+
+// similarImage is an image found by similarImages.
+type similarImage struct {
+	fileResult
+	width, height int
+	hash          uint64
+}
+
+// similarImages returns the images in fileResults whose perceptual hashes differ in at most maxDistance bits,
+// grouped together, for -mode phash.
+// Images are grouped transitively: two images in a group may differ by more than maxDistance
+// if each is close to a third.
+// Each group starts with the image of the highest resolution, followed by the rest sorted by path,
+// and groups are sorted by their first path.
+// Unlike the comparisons of the default mode, this is a fuzzy match: the images in a group are only similar,
+// not identical, so they are reported and never handled.
+func similarImages(ctx context.Context, fileResults <-chan fileResult, maxDistance int) [][]similarImage {
+	var images []similarImage
+	for fr := range fileResults {
+		if ctx.Err() != nil {
+			break
+		}
+		if !slices.Contains(imageExtensions, strings.ToLower(filepath.Ext(fr.path))) {
+			continue
+		}
+		img, err := hashImage(fr)
+		if err != nil {
+			slog.Error("unable to decode image", "file", fr, "err", err)
+			continue
+		}
+		images = append(images, img)
+	}
+
+	// union-find over every pair, since images of different sizes can't be bucketed
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			if bits.OnesCount64(images[i].hash^images[j].hash) <= maxDistance {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	byRoot := make(map[int][]similarImage)
+	for i, img := range images {
+		byRoot[find(i)] = append(byRoot[find(i)], img)
+	}
+	var groups [][]similarImage
+	for _, g := range byRoot {
+		if len(g) < 2 {
+			continue
+		}
+		slices.SortFunc(g, func(a, b similarImage) int { return strings.Compare(a.path, b.path) })
+		keep := 0
+		for i, img := range g {
+			if pixels, best := img.width*img.height, g[keep].width*g[keep].height; pixels > best || pixels == best && img.size > g[keep].size {
+				keep = i
+			}
+		}
+		g[0], g[keep] = g[keep], g[0]
+		slices.SortFunc(g[1:], func(a, b similarImage) int { return strings.Compare(a.path, b.path) })
+		groups = append(groups, g)
+	}
+	slices.SortFunc(groups, func(a, b []similarImage) int { return strings.Compare(a[0].path, b[0].path) })
+	return groups
+}
+
+func hashImage(fr fileResult) (similarImage, error) {
+	f, err := os.Open(fr.path)
+	if err != nil {
+		return similarImage{}, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return similarImage{}, err
+	}
+	b := img.Bounds()
+	return similarImage{fileResult: fr, width: b.Dx(), height: b.Dy(), hash: differenceHash(img)}, nil
+}
+
+// differenceHash returns a perceptual hash of img:
+// img is shrunk to a 9x8 grid of average brightness,
+// and each bit records whether a cell is darker than the cell to its right.
+// Scaling, recompression, and small changes in brightness leave most of the bits unchanged.
+func differenceHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+	// sampling a few hundred pixels per cell in each direction is plenty for an average
+	stepX, stepY := max(1, b.Dx()/(w*64)), max(1, b.Dy()/(h*64))
+	var sum [h][w]float64
+	var count [h][w]int
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		cy := (y - b.Min.Y) * h / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			cx := (x - b.Min.X) * w / b.Dx()
+			r, g, bl, _ := img.At(x, y).RGBA()
+			sum[cy][cx] += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+			count[cy][cx]++
+		}
+	}
+	avg := func(x, y int) float64 {
+		if count[y][x] == 0 {
+			return 0
+		}
+		return sum[y][x] / float64(count[y][x])
+	}
+	var hash uint64
+	for y := range h {
+		for x := range w - 1 {
+			hash <<= 1
+			if avg(x, y) < avg(x+1, y) {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// writeSimilarImages prints the paths of each group to w, one per line after the resolution of the image,
+// with a blank line between groups, followed by a summary on summaryW.
+func writeSimilarImages(w, summaryW io.Writer, groups [][]similarImage) {
+	var images int
+	for i, g := range groups {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		for _, img := range g {
+			fmt.Fprintf(w, "%dx%d\t%s\n", img.width, img.height, img.path)
+		}
+		images += len(g)
+	}
+	slog.Info("similar images", "images", images, "groups", len(groups))
+	fmt.Fprintf(summaryW, "%d images in %d groups of similar images; the first of each group has the highest resolution\n", images, len(groups))
+}
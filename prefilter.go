@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"hash/maphash"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// prefilterSeed only has to be the same for every file hashed in a run.
+var prefilterSeed = maphash.MakeSeed()
+
+// partialHashKey returns a key for splitBuckets to group files by a hash of their first and last n bytes,
+// for -prefilter-partial-hash-bytes.
+// Files smaller than 2n are hashed whole.
+//
+// Files with different keys can't be identical, so splitting on it only skips comparisons that would fail,
+// at the cost of reading up to 2n bytes of every file once.
+// A file that can't be read gets a key of its own, which leaves it out of every comparison.
+func partialHashKey(ctx context.Context, n int64) func(fileResult) string {
+	return func(fr fileResult) string {
+		sum, err := partialHash(ctx, fr.path, fr.size, n)
+		if err != nil {
+			slog.Error("unable to read file for prefilter", "file", fr, "err", err)
+			return "\x00" + fr.path
+		}
+		return strconv.FormatUint(sum, 16)
+	}
+}
+
+func partialHash(ctx context.Context, path string, size, n int64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// closing the file unblocks a read that is in progress when ctx is done
+	stop := context.AfterFunc(ctx, func() { f.Close() })
+	sum, err := hashEnds(f, size, n)
+	if !stop() {
+		return 0, ctx.Err()
+	}
+	return sum, err
+}
+
+// hashEnds hashes the first and last n bytes of f, which is size bytes long, or all of it if it is smaller than 2n.
+func hashEnds(f *os.File, size, n int64) (uint64, error) {
+	var h maphash.Hash
+	h.SetSeed(prefilterSeed)
+	if size <= 2*n {
+		if _, err := io.Copy(&h, f); err != nil {
+			return 0, err
+		}
+		return h.Sum64(), nil
+	}
+	if _, err := io.Copy(&h, io.NewSectionReader(f, 0, n)); err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(&h, io.NewSectionReader(f, size-n, n)); err != nil {
+		return 0, err
+	}
+	return h.Sum64(), nil
+}
+
+// hashSplit replaces each of buckets that holds at least min files with the groups of identical files
+// that dup.HashIndexes finds in it, for -hash-buckets and -state.
+// Every file of a large bucket is read once to hash it, rather than once for each comparison,
+// unless fileState already knows its digest, and the files in no group are left out of every comparison.
+// With fileState, the groups come from its database instead.
+// The files in a group are still compared byte for byte as usual, which rules out a hash collision.
+func hashSplit(ctx context.Context, buckets [][]fileResult, min int) [][]fileResult {
+	var split [][]fileResult
+	for _, bucket := range buckets {
+		if len(bucket) < min {
+			split = append(split, bucket)
+			continue
+		}
+		var groups [][]int
+		if fileState != nil {
+			var err error
+			if groups, err = fileState.groups(ctx, bucket); err != nil {
+				if ctx.Err() == nil {
+					// the bucket is compared as it would be without -state
+					slog.Error("failed to group files by their recorded digests", "err", err)
+					split = append(split, bucket)
+				}
+				continue
+			}
+		} else {
+			groups = dup.HashIndexes(ctx, paths(bucket))
+		}
+		for _, group := range groups {
+			v := make([]fileResult, len(group))
+			for i, j := range group {
+				v[i] = bucket[j]
+			}
+			split = append(split, v)
+		}
+	}
+	return split
+}
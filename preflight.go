@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/Travis-Britz/dedup/internal/fileid"
+)
+
+// rootInfo describes a directory argument before it is walked, for -list-roots.
+type rootInfo struct {
+	path     string
+	exists   bool
+	readable bool
+	// dev identifies the device or volume, when it could be read.
+	dev   uint64
+	hasID bool
+	// entries is the number of entries at the top level of the directory.
+	entries int
+	err     error
+}
+
+// inspectRoot checks that root is a readable directory and counts its top-level entries.
+func inspectRoot(root string) rootInfo {
+	info := rootInfo{path: root}
+	fi, err := os.Stat(root)
+	if err != nil {
+		info.err = err
+		return info
+	}
+	info.exists = true
+	if !fi.IsDir() {
+		info.err = errors.New("not a directory")
+		return info
+	}
+	if id, err := fileid.Stat(root); err == nil {
+		info.dev, info.hasID = id.Dev, true
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		info.err = err
+		return info
+	}
+	info.readable = true
+	info.entries = len(entries)
+	return info
+}
+
+func (r rootInfo) String() string {
+	switch {
+	case !r.exists && errors.Is(r.err, fs.ErrNotExist):
+		return fmt.Sprintf("%s: does not exist", r.path)
+	case !r.readable:
+		return fmt.Sprintf("%s: not readable: %v", r.path, r.err)
+	}
+	dev := "unknown device"
+	if r.hasID {
+		dev = fmt.Sprintf("device %d", r.dev)
+	}
+	return fmt.Sprintf("%s: ok, %s, %d top-level entries", r.path, dev, r.entries)
+}
+
+// listRoots prints a line describing each of roots to w.
+// It reports whether every root is a readable directory.
+func listRoots(w io.Writer, roots []string) bool {
+	ok := true
+	for _, root := range roots {
+		info := inspectRoot(root)
+		ok = ok && info.readable
+		fmt.Fprintln(w, info)
+	}
+	return ok
+}
+
+// errTooManyFiles is the cause of a run cancelled by capFiles.
+var errTooManyFiles = errors.New("too many files")
+
+// capFiles passes on files until more than max have been found,
+// then cancels the walk with an error wrapping errTooManyFiles and closes the returned channel,
+// so that a run pointed at a much larger tree than intended stops before comparing anything.
+func capFiles(files <-chan fileResult, max int, cancel context.CancelCauseFunc) <-chan fileResult {
+	capped := make(chan fileResult)
+	go func() {
+		defer close(capped)
+		var n int
+		for fr := range files {
+			if n++; n > max {
+				cancel(fmt.Errorf("%w: found more than %d, the limit set by -max-files", errTooManyFiles, max))
+				return
+			}
+			capped <- fr
+		}
+	}()
+	return capped
+}
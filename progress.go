@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// progress counts the work done by a run, for printing a status line while it runs.
+// Its methods do nothing on a nil *progress, so callers don't have to check whether progress is shown.
+type progress struct {
+	// estimate is set for -estimate, and totalFiles is the number of files it counted before the walk.
+	// Without it, the status only counts the work done, for -progress.
+	estimate   bool
+	totalFiles int64
+
+	walked atomic.Int64
+	// buckets is the number of buckets with more than one file to compare,
+	// and comparisons is the number of pairs of files compared.
+	buckets, comparisons atomic.Int64
+	// pending is the number of bytes in buckets that still have to be compared,
+	// and compared is the number of bytes in buckets that are done.
+	pending, compared atomic.Int64
+	// started is when the first bucket was staged, in Unix nanoseconds.
+	started atomic.Int64
+}
+
+// prog is the progress of the current run, or nil if it isn't shown.
+var prog *progress
+
+// countFiles counts the files and bytes in fileResults, for the first pass of -estimate.
+// The walk only reads directory entries and file info, so it is much cheaper than comparing,
+// but on a slow disk or a huge tree it still takes a noticeable time.
+func countFiles(fileResults <-chan fileResult) (files int, bytes int64) {
+	for fr := range fileResults {
+		files++
+		bytes += fr.size
+	}
+	return files, bytes
+}
+
+func (p *progress) walk() {
+	if p != nil {
+		p.walked.Add(1)
+	}
+}
+
+// stage records n bytes of files that will be compared.
+func (p *progress) stage(n int64) {
+	if p != nil {
+		p.started.CompareAndSwap(0, time.Now().UnixNano())
+		p.buckets.Add(1)
+		p.pending.Add(n)
+	}
+}
+
+// compare records a comparison of two files.
+func (p *progress) compare() {
+	if p != nil {
+		p.comparisons.Add(1)
+	}
+}
+
+// done records n bytes of staged files as compared, or as ruled out without comparing.
+func (p *progress) done(n int64) {
+	if p != nil {
+		p.compared.Add(n)
+	}
+}
+
+// status returns a line describing the progress at now.
+// For -estimate, that is the share of files walked while walking,
+// then the share of bytes compared with an estimate of the time left.
+func (p *progress) status(now time.Time) string {
+	if !p.estimate {
+		return fmt.Sprintf("walked %d files, %d buckets to compare, %d comparisons", p.walked.Load(), p.buckets.Load(), p.comparisons.Load())
+	}
+	started, pending, compared := p.started.Load(), p.pending.Load(), p.compared.Load()
+	if started == 0 {
+		walked := p.walked.Load()
+		return fmt.Sprintf("walked %d of %d files (%d%%)", walked, p.totalFiles, percent(walked, p.totalFiles))
+	}
+	s := fmt.Sprintf("compared %s of %s (%d%%)", formatSize(compared), formatSize(pending), percent(compared, pending))
+	if elapsed := now.Sub(time.Unix(0, started)); compared > 0 && compared < pending {
+		left := time.Duration(float64(elapsed) * float64(pending-compared) / float64(compared))
+		s += fmt.Sprintf(", about %s left", left.Round(time.Second))
+	}
+	return s
+}
+
+func percent(n, total int64) int64 {
+	if total <= 0 {
+		return 100
+	}
+	return min(100, n*100/total)
+}
+
+// report writes the status to w every interval until ctx is done.
+func (p *progress) report(ctx context.Context, w io.Writer, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			fmt.Fprintln(w, p.status(now))
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// cleanestName returns the base name with the lowest copy counter among keep and the handled duplicates
+// in keep's directory, preferring the name keep already has.
+// Names from other directories are left alone, since they may belong to unrelated files there.
+func cleanestName(keep fileResult, handled []fileResult) string {
+	best := filepath.Base(keep.path)
+	_, bestCounter, _ := dup.SplitFileBaseName(best)
+	for _, d := range handled {
+		if filepath.Dir(d.path) != filepath.Dir(keep.path) {
+			continue
+		}
+		name := filepath.Base(d.path)
+		if _, counter, _ := dup.SplitFileBaseName(name); counter < bestCounter {
+			best, bestCounter = name, counter
+		}
+	}
+	return best
+}
+
+// promoteKeep renames the kept file of a cluster to the cleanest name that one of its handled duplicates had,
+// within the kept file's directory.
+// The rename is skipped if the new name belongs to a file outside of the cluster,
+// including one created there since the duplicate was handled:
+// the kept file is linked under the new name, which fails rather than replace a file, and then removed.
+// Without config.Execute the rename is only printed.
+func promoteKeep(keep fileResult, handled []fileResult) error {
+	name := cleanestName(keep, handled)
+	if name == filepath.Base(keep.path) {
+		return nil
+	}
+	target := filepath.Join(filepath.Dir(keep.path), name)
+
+	vacated := false
+	for _, d := range handled {
+		vacated = vacated || d.path == target
+	}
+	if !vacated {
+		if _, err := os.Lstat(target); err == nil {
+			slog.Warn("not renaming kept file; name is taken", "file", keep, "name", target)
+			return nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	if !config.Execute {
+		fmt.Fprintf(os.Stderr, "rename %s -> %s\n", keep.path, target)
+		return nil
+	}
+	if err := os.Link(keep.path, target); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			slog.Warn("not renaming kept file; name is taken", "file", keep, "name", target)
+			return nil
+		}
+		return err
+	}
+	if err := os.Remove(keep.path); err != nil {
+		return err
+	}
+	return syncParent(target)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// The rules reported by the wrappers around the comparison function when they override its selection.
+const (
+	ruleBaseline   dup.Rule = "baseline"
+	ruleLinkTarget dup.Rule = "symlink target"
+	ruleArchive    dup.Rule = "archive member"
+	ruleInverted   dup.Rule = "inverted"
+)
+
+// selectionRules are the rules that can decide which of two identical files is kept:
+// the heuristics in the order they are tried, followed by the rules of the wrappers that override them.
+var selectionRules = []dup.Rule{
+	dup.RuleKeepPattern,
+	dup.RuleOldest,
+	dup.RuleNewest,
+	dup.RulePathLength,
+	dup.RuleCleanName,
+	dup.RuleCopyCounter,
+	dup.RuleExtension,
+	dup.RuleDigits,
+	dup.RuleModTime,
+	dup.RuleAllocation,
+	dup.RuleTie,
+	ruleBaseline,
+	ruleLinkTarget,
+	ruleArchive,
+	ruleInverted,
+}
+
+// parseReasons parses a comma-separated list of rules by the names used in reports, for -apply-reasons.
+func parseReasons(list string) ([]string, error) {
+	var reasons []string
+	for _, r := range strings.Split(list, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		if !slices.ContainsFunc(selectionRules, func(rule dup.Rule) bool { return reportReason(rule) == r }) {
+			return nil, fmt.Errorf("unknown reason %q", r)
+		}
+		reasons = append(reasons, r)
+	}
+	return reasons, nil
+}
+
+// ruleHandler is implemented by handlers that depend on the rule that selected each duplicate,
+// such as applyReasons and pairWriter.
+type ruleHandler interface {
+	handleRule(file, keep string, rule dup.Rule) error
+}
+
+// ruleFunc is a handler that takes the rule that selected file as a duplicate of keep.
+// It's called with an empty rule when none is known.
+type ruleFunc func(file, keep string, rule dup.Rule) error
+
+func (f ruleFunc) handle(file, keep string) error {
+	return f(file, keep, "")
+}
+
+func (f ruleFunc) handleRule(file, keep string, rule dup.Rule) error {
+	return f(file, keep, rule)
+}
+
+// handleSelected passes file, which rule selected as a duplicate of keep, to h,
+// along with rule if h depends on it.
+func handleSelected(h handler, file, keep string, rule dup.Rule) error {
+	if rh, ok := h.(ruleHandler); ok {
+		return rh.handleRule(file, keep, rule)
+	}
+	return h.handle(file, keep)
+}
+
+// errUntrusted is returned by applyReasons for duplicates that were chosen by a rule that wasn't trusted.
+var errUntrusted = errors.New("kept file was chosen by an untrusted rule")
+
+// applyReasons wraps h to refuse duplicates unless the rule that chose keep over them is one of reasons.
+// The rule is the one the comparison reported when it selected the duplicate, as passed to handleSelected;
+// a duplicate without one is refused too.
+func applyReasons(h handler, reasons []string) ruleFunc {
+	return func(file, keep string, rule dup.Rule) error {
+		if rule == "" {
+			return fmt.Errorf("%w: no rule was recorded", errUntrusted)
+		}
+		if !slices.Contains(reasons, reportReason(rule)) {
+			return fmt.Errorf("%w: %s", errUntrusted, reportReason(rule))
+		}
+		return handleSelected(h, file, keep, rule)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/Travis-Britz/dedup/dup"
+	"github.com/Travis-Britz/dedup/report"
+)
+
+// cluster is a set of files with identical contents:
+// keep is the file that was selected as the original, and dups are the rest.
+type cluster struct {
+	keep fileResult
+	dups []fileResult
+	// rules holds the rule that selected each of dups as a duplicate, in the same order.
+	rules []dup.Rule
+}
+
+// invertCluster swaps the roles in c for -invert:
+// its first duplicate is kept, and the file that was kept is handled along with the other duplicates.
+// No rule chose any of them, so they are all recorded as selected by ruleInverted.
+func invertCluster(c cluster) cluster {
+	dups := append([]fileResult{c.keep}, c.dups[1:]...)
+	rules := make([]dup.Rule, len(dups))
+	for i := range rules {
+		rules[i] = ruleInverted
+	}
+	return cluster{keep: c.dups[0], dups: dups, rules: rules}
+}
+
+// clusterList groups the duplicates passed to add by the file they keep.
+// Its add method is an OnDuplicate callback for dup.MatchesFunc.
+type clusterList struct {
+	// clusters are in the order their first duplicate was matched.
+	clusters []cluster
+	// byKeep is the index in clusters of each kept file, by its index in the bucket.
+	byKeep map[int]int
+}
+
+func (l *clusterList) add(d dup.DupContext[fileResult]) {
+	if l.byKeep == nil {
+		l.byKeep = make(map[int]int)
+	}
+	i, ok := l.byKeep[d.Match.Keep]
+	if !ok {
+		i = len(l.clusters)
+		l.byKeep[d.Match.Keep] = i
+		l.clusters = append(l.clusters, cluster{keep: d.Keep})
+	}
+	l.clusters[i].dups = append(l.clusters[i].dups, d.Dup)
+	l.clusters[i].rules = append(l.clusters[i].rules, d.Match.Rule)
+}
+
+// clustersOf groups the matches found in bucket by the file they keep, like clusterList.
+func clustersOf(bucket []fileResult, matches []dup.Match) []cluster {
+	var l clusterList
+	for _, m := range matches {
+		l.add(dup.DupContext[fileResult]{Dup: bucket[m.Dup], Keep: bucket[m.Keep], Match: m})
+	}
+	return l.clusters
+}
+
+// hashAlgorithms are the values accepted by -hash.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// errLastCopy means a selection would have handled every copy of a file, leaving none behind.
+var errLastCopy = errors.New("refusing to handle the last copy of a file")
+
+// checkLastCopy makes sure that none of the clusters would handle a file that another one keeps,
+// or its own kept file, so that at least one copy of each file survives.
+// It guards against bugs in selection rather than anything a user could cause.
+func checkLastCopy(clusters []cluster) error {
+	handled := make(map[string]bool)
+	for _, c := range clusters {
+		for _, d := range c.dups {
+			handled[d.path] = true
+		}
+	}
+	for _, c := range clusters {
+		if handled[c.keep.path] {
+			return fmt.Errorf("%w: %s would be kept and handled as a duplicate: %v", errLastCopy, c.keep.path, paths(c.dups))
+		}
+	}
+	return nil
+}
+
+// newReportCluster describes c for the report, along with the rule that selected each duplicate.
+// When newHash is not nil, every file in c is read again to record its digest,
+// which must happen before any of the files are handled.
+func newReportCluster(ctx context.Context, c cluster, newHash func() hash.Hash) report.Cluster {
+	rc := report.Cluster{
+		Size:       c.keep.size,
+		Keep:       c.keep.path,
+		Duplicates: paths(c.dups),
+	}
+	for i, rule := range c.rules {
+		if rule == "" {
+			continue
+		}
+		if rc.Reasons == nil {
+			rc.Reasons = make(map[string]string, len(c.dups))
+		}
+		rc.Reasons[c.dups[i].path] = reportReason(rule)
+	}
+	if newHash == nil {
+		return rc
+	}
+	rc.Hashes = make(map[string]string, len(c.dups)+1)
+	for _, p := range append([]string{rc.Keep}, rc.Duplicates...) {
+		sum, err := dup.HashFile(ctx, p, newHash)
+		if err != nil {
+			slog.Error("unable to hash file for report", "file", p, "err", err)
+			continue
+		}
+		rc.Hashes[p] = hex.EncodeToString(sum)
+	}
+	return rc
+}
+
+// reportReason is the name of rule in reports, e.g. "copy-counter".
+func reportReason(rule dup.Rule) string {
+	return strings.ReplaceAll(string(rule), " ", "-")
+}
+
+// writeReport writes rep to w as JSON, indented if config.Pretty is set.
+func writeReport(w io.Writer, rep report.Report) error {
+	if config.Pretty {
+		return report.MarshalIndent(w, rep)
+	}
+	return report.Marshal(w, rep)
+}
+
+func readReport(r io.Reader) (report.Report, error) {
+	var rep report.Report
+	err := report.Unmarshal(r, &rep)
+	return rep, err
+}
+
+// writeReportFile writes rep to the file at path, replacing it if it exists.
+func writeReportFile(path string, rep report.Report) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeReport(f, rep); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// appendReportFile merges rep into the report at path with report.Append, or writes it if there is none yet.
+// The file is read and then replaced, so concurrent runs appending to the same file would lose each other's results.
+func appendReportFile(path string, rep report.Report) error {
+	prev, err := readReportFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return writeReportFile(path, rep)
+	}
+	if err != nil {
+		return err
+	}
+	merged, err := report.Append(prev, rep)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return writeReportFile(path, merged)
+}
+
+func readReportFile(path string) (report.Report, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return report.Report{}, err
+	}
+	defer f.Close()
+	rep, err := readReport(f)
+	if err != nil {
+		return report.Report{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return rep, nil
+}
+
+// reportBuckets sends each cluster in rep as a bucket of files, in place of walking and staging.
+// Every file is recorded as scanned in sum.
+func reportBuckets(ctx context.Context, rep report.Report, sum *summary) <-chan []fileResult {
+	buckets := make(chan []fileResult)
+	go func() {
+		defer close(buckets)
+		for _, rc := range rep.Clusters {
+			var bucket []fileResult
+			for _, p := range append([]string{rc.Keep}, rc.Duplicates...) {
+				fr := fileResult{path: p, size: rc.Size, root: rootOf(p)}
+				sum.scanned(fr)
+				bucket = append(bucket, fr)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case buckets <- bucket:
+			}
+		}
+	}()
+	return buckets
+}
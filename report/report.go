@@ -0,0 +1,244 @@
+// Package report defines the JSON documents that dedup writes about a run and reads back in later runs,
+// so that every writer and reader shares one schema.
+// Other programs can import it to read those documents.
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Report is the document written by -report and read by -from-json.
+type Report struct {
+	// Hash is the algorithm used for the Hashes of each cluster, if any.
+	Hash     string    `json:"hash,omitempty"`
+	Clusters []Cluster `json:"clusters"`
+	// Summary is the statistics of the run that wrote the report, if known.
+	Summary *RunSummary `json:"summary,omitempty"`
+}
+
+// Cluster is a set of files with identical contents.
+type Cluster struct {
+	Size       int64    `json:"size"`
+	Keep       string   `json:"keep"`
+	Duplicates []string `json:"duplicates"`
+	// Hashes maps each path in the cluster to the hex digest of its contents.
+	Hashes map[string]string `json:"hashes,omitempty"`
+	// Reasons maps each duplicate to the rule that chose Keep over it, e.g. "copy-counter".
+	Reasons map[string]string `json:"reasons,omitempty"`
+}
+
+// Pair is a single duplicate and the file it duplicates.
+type Pair struct {
+	Duplicate string `json:"duplicate"`
+	Keep      string `json:"keep"`
+	Size      int64  `json:"size"`
+	// Reason is the rule that chose Keep over Duplicate, if known.
+	Reason string `json:"reason,omitempty"`
+}
+
+// RunSummary is the statistics of a run.
+type RunSummary struct {
+	ScannedFiles   int    `json:"scanned_files"`
+	ScannedBytes   int64  `json:"scanned_bytes"`
+	Duplicates     int    `json:"duplicates"`
+	DuplicateBytes int64  `json:"duplicate_bytes"`
+	Roots          []Root `json:"roots,omitempty"`
+}
+
+// Root is the statistics of a single directory argument.
+type Root struct {
+	Path       string `json:"path"`
+	Duplicates int    `json:"duplicates"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// Marshal writes v to w as a single line of JSON.
+// Calling it once per record writes JSON lines that UnmarshalLines can read back.
+func Marshal(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// MarshalIndent writes v to w as indented JSON, for reading by people.
+// Unmarshal reads it back the same as the output of Marshal.
+func MarshalIndent(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// Unmarshal reads a single JSON document from r into v.
+// It is an error for anything other than whitespace to follow the document.
+func Unmarshal(r io.Reader, v any) error {
+	dec := json.NewDecoder(r)
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after JSON document")
+	}
+	return nil
+}
+
+// UnmarshalLines reads every JSON value in r, such as JSON lines written by Marshal.
+func UnmarshalLines[T any](r io.Reader) ([]T, error) {
+	var records []T
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var v T
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, fmt.Errorf("record %d: %w", n, err)
+		}
+		records = append(records, v)
+	}
+}
+
+// Rel returns a copy of r with every path made relative to base, so that the report still applies
+// after the files are moved or on another machine, with Resolve and the new location of base.
+// Both base and the paths are made absolute first, so relative paths are relative to the working directory.
+// It is an error for a path to be outside of base.
+func (r Report) Rel(base string) (Report, error) {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return Report{}, err
+	}
+	var relErr error
+	rel := r.mapPaths(func(p string) string {
+		abs, err := filepath.Abs(p)
+		if err == nil {
+			p, err = filepath.Rel(base, abs)
+		}
+		if err == nil && !filepath.IsLocal(p) {
+			err = fmt.Errorf("%s is outside of %s", abs, base)
+		}
+		if err != nil && relErr == nil {
+			relErr = err
+		}
+		return p
+	})
+	if relErr != nil {
+		return Report{}, relErr
+	}
+	return rel, nil
+}
+
+// Resolve returns a copy of r with every relative path joined to base, undoing Rel.
+// Absolute paths are left as they are.
+func (r Report) Resolve(base string) Report {
+	return r.mapPaths(func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(base, p)
+	})
+}
+
+// mapPaths returns a copy of r with fn applied to every path in it.
+func (r Report) mapPaths(fn func(string) string) Report {
+	mapKeys := func(m map[string]string) map[string]string {
+		if m == nil {
+			return nil
+		}
+		mapped := make(map[string]string, len(m))
+		for k, v := range m {
+			mapped[fn(k)] = v
+		}
+		return mapped
+	}
+	mapped := Report{Hash: r.Hash, Clusters: make([]Cluster, len(r.Clusters))}
+	for i, c := range r.Clusters {
+		c.Keep = fn(c.Keep)
+		dups := make([]string, len(c.Duplicates))
+		for j, d := range c.Duplicates {
+			dups[j] = fn(d)
+		}
+		c.Duplicates, c.Hashes, c.Reasons = dups, mapKeys(c.Hashes), mapKeys(c.Reasons)
+		mapped.Clusters[i] = c
+	}
+	if r.Summary != nil {
+		s := *r.Summary
+		s.Roots = make([]Root, len(r.Summary.Roots))
+		for i, root := range r.Summary.Roots {
+			root.Path = fn(root.Path)
+			s.Roots[i] = root
+		}
+		mapped.Summary = &s
+	}
+	return mapped
+}
+
+// Append merges the clusters of next into prev, for accumulating the reports of several runs in one file.
+// The files in next, and every file under the roots of next.Summary if it has one, replace any earlier entries:
+// they are removed from the clusters of prev, and clusters left with fewer than two files are dropped.
+// When the kept file of an earlier cluster is removed, its first remaining duplicate is kept instead,
+// and the cluster's Reasons no longer apply and are dropped.
+//
+// Both reports must use the same Hash. The merged report has no Summary,
+// since the runs may have overlapped.
+func Append(prev, next Report) (Report, error) {
+	if prev.Hash != next.Hash {
+		return Report{}, fmt.Errorf("can't combine reports with hashes %q and %q", prev.Hash, next.Hash)
+	}
+	seen := make(map[string]bool)
+	for _, c := range next.Clusters {
+		seen[c.Keep] = true
+		for _, d := range c.Duplicates {
+			seen[d] = true
+		}
+	}
+
+	rescanned := func(p string) bool {
+		if seen[p] {
+			return true
+		}
+		if next.Summary == nil {
+			return false
+		}
+		for _, root := range next.Summary.Roots {
+			if rel, err := filepath.Rel(root.Path, p); err == nil && filepath.IsLocal(rel) {
+				return true
+			}
+		}
+		return false
+	}
+
+	merged := Report{Hash: next.Hash}
+	for _, c := range prev.Clusters {
+		var files []string
+		for _, p := range append([]string{c.Keep}, c.Duplicates...) {
+			if !rescanned(p) {
+				files = append(files, p)
+			}
+		}
+		if len(files) < 2 {
+			continue
+		}
+		kept := Cluster{Size: c.Size, Keep: files[0], Duplicates: files[1:]}
+		if c.Reasons != nil && files[0] == c.Keep {
+			kept.Reasons = make(map[string]string, len(files)-1)
+			for _, p := range files[1:] {
+				if r, ok := c.Reasons[p]; ok {
+					kept.Reasons[p] = r
+				}
+			}
+		}
+		if c.Hashes != nil {
+			kept.Hashes = make(map[string]string, len(files))
+			for _, p := range files {
+				if h, ok := c.Hashes[p]; ok {
+					kept.Hashes[p] = h
+				}
+			}
+		}
+		merged.Clusters = append(merged.Clusters, kept)
+	}
+	merged.Clusters = append(merged.Clusters, next.Clusters...)
+	return merged, nil
+}
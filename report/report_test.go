@@ -0,0 +1,172 @@
+package report_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Travis-Britz/dedup/report"
+)
+
+func TestReportRoundTrip(t *testing.T) {
+	want := report.Report{
+		Hash: "sha256",
+		Clusters: []report.Cluster{{
+			Size:       6,
+			Keep:       "flowers.jpg",
+			Duplicates: []string{"flowers (1).jpg", "flowers (2).jpg"},
+			Hashes:     map[string]string{"flowers.jpg": "ab", "flowers (1).jpg": "ab", "flowers (2).jpg": "ab"},
+		}},
+		Summary: &report.RunSummary{
+			ScannedFiles:   3,
+			ScannedBytes:   18,
+			Duplicates:     2,
+			DuplicateBytes: 12,
+			Roots:          []report.Root{{Path: ".", Duplicates: 2, Bytes: 12}},
+		},
+	}
+
+	var buf strings.Builder
+	if err := report.Marshal(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 1 {
+		t.Errorf("expected a single line; got %d lines: %s", n, buf.String())
+	}
+	var got report.Report
+	if err := report.Unmarshal(strings.NewReader(buf.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v; got %+v", want, got)
+	}
+
+	if err := report.Unmarshal(strings.NewReader(buf.String()+buf.String()), &got); err == nil {
+		t.Error("expected an error for two documents")
+	}
+}
+
+func TestPairLinesRoundTrip(t *testing.T) {
+	want := []report.Pair{
+		{Duplicate: "flowers (1).jpg", Keep: "flowers.jpg", Size: 6},
+		{Duplicate: "beach (1).jpg", Keep: "beach.jpg", Size: 5},
+	}
+
+	var buf strings.Builder
+	for _, p := range want {
+		if err := report.Marshal(&buf, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := report.UnmarshalLines[report.Pair](strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v; got %+v", want, got)
+	}
+
+	_, err = report.UnmarshalLines[report.Pair](strings.NewReader(buf.String() + "{\"size\": \"six\"}\n"))
+	if err == nil || !strings.Contains(err.Error(), "record 3") {
+		t.Errorf("expected an error for record 3; got %v", err)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	prev := report.Report{
+		Hash: "sha1",
+		Clusters: []report.Cluster{
+			{Size: 6, Keep: "a/flowers.jpg", Duplicates: []string{"b/flowers.jpg", "c/flowers.jpg"}, Hashes: map[string]string{"a/flowers.jpg": "f1", "b/flowers.jpg": "f1", "c/flowers.jpg": "f1"}, Reasons: map[string]string{"b/flowers.jpg": "tie", "c/flowers.jpg": "tie"}},
+			{Size: 5, Keep: "b/beach.jpg", Duplicates: []string{"a/beach.jpg"}, Hashes: map[string]string{"b/beach.jpg": "b1", "a/beach.jpg": "b1"}, Reasons: map[string]string{"a/beach.jpg": "tie"}},
+			{Size: 4, Keep: "d/song.mp3", Duplicates: []string{"d/song (1).mp3"}, Hashes: map[string]string{"d/song.mp3": "s1", "d/song (1).mp3": "s1"}},
+		},
+		Summary: &report.RunSummary{ScannedFiles: 7},
+	}
+	// the second run rescanned b, where the flowers changed
+	next := report.Report{
+		Hash: "sha1",
+		Clusters: []report.Cluster{
+			{Size: 5, Keep: "b/beach.jpg", Duplicates: []string{"b/beach (1).jpg"}, Hashes: map[string]string{"b/beach.jpg": "b1", "b/beach (1).jpg": "b1"}},
+		},
+		Summary: &report.RunSummary{ScannedFiles: 3, Roots: []report.Root{{Path: "b"}}},
+	}
+
+	got, err := report.Append(prev, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := report.Report{
+		Hash: "sha1",
+		Clusters: []report.Cluster{
+			{Size: 6, Keep: "a/flowers.jpg", Duplicates: []string{"c/flowers.jpg"}, Hashes: map[string]string{"a/flowers.jpg": "f1", "c/flowers.jpg": "f1"}, Reasons: map[string]string{"c/flowers.jpg": "tie"}},
+			{Size: 4, Keep: "d/song.mp3", Duplicates: []string{"d/song (1).mp3"}, Hashes: map[string]string{"d/song.mp3": "s1", "d/song (1).mp3": "s1"}},
+			next.Clusters[0],
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v; got %+v", want, got)
+	}
+
+	if _, err := report.Append(prev, report.Report{Hash: "sha256"}); err == nil {
+		t.Error("expected an error for different hashes")
+	}
+}
+
+func TestRelResolve(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "photos")
+	abs := report.Report{
+		Hash: "sha256",
+		Clusters: []report.Cluster{{
+			Size:       6,
+			Keep:       filepath.Join(base, "flowers.jpg"),
+			Duplicates: []string{filepath.Join(base, "2024", "flowers (1).jpg")},
+			Hashes:     map[string]string{filepath.Join(base, "flowers.jpg"): "ab", filepath.Join(base, "2024", "flowers (1).jpg"): "ab"},
+			Reasons:    map[string]string{filepath.Join(base, "2024", "flowers (1).jpg"): "copy-counter"},
+		}},
+		Summary: &report.RunSummary{ScannedFiles: 2, Roots: []report.Root{{Path: base, Duplicates: 1, Bytes: 6}}},
+	}
+
+	rel, err := abs.Rel(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := report.Report{
+		Hash: "sha256",
+		Clusters: []report.Cluster{{
+			Size:       6,
+			Keep:       "flowers.jpg",
+			Duplicates: []string{filepath.Join("2024", "flowers (1).jpg")},
+			Hashes:     map[string]string{"flowers.jpg": "ab", filepath.Join("2024", "flowers (1).jpg"): "ab"},
+			Reasons:    map[string]string{filepath.Join("2024", "flowers (1).jpg"): "copy-counter"},
+		}},
+		Summary: &report.RunSummary{ScannedFiles: 2, Roots: []report.Root{{Path: ".", Duplicates: 1, Bytes: 6}}},
+	}
+	if !reflect.DeepEqual(rel, want) {
+		t.Errorf("expected %+v; got %+v", want, rel)
+	}
+
+	var buf strings.Builder
+	if err := report.Marshal(&buf, rel); err != nil {
+		t.Fatal(err)
+	}
+	var read report.Report
+	if err := report.Unmarshal(strings.NewReader(buf.String()), &read); err != nil {
+		t.Fatal(err)
+	}
+	if got := read.Resolve(base); !reflect.DeepEqual(got, abs) {
+		t.Errorf("expected resolving against the original base to restore %+v; got %+v", abs, got)
+	}
+	moved := filepath.Join(t.TempDir(), "backup", "photos")
+	got := read.Resolve(moved)
+	if p := filepath.Join(moved, "2024", "flowers (1).jpg"); got.Clusters[0].Duplicates[0] != p || got.Clusters[0].Reasons[p] != "copy-counter" {
+		t.Errorf("expected paths under %s; got %+v", moved, got)
+	}
+	if rel.Clusters[0].Keep != "flowers.jpg" {
+		t.Error("Resolve changed the report it was called on")
+	}
+
+	if _, err := abs.Rel(filepath.Join(base, "2024")); err == nil {
+		t.Error("expected an error for paths outside of the base")
+	}
+}
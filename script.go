@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// shellScript collects the commands that would handle each duplicate, for -format script.
+type shellScript struct {
+	commands []string
+}
+
+// handle records the command for file in place of handling it.
+func (s *shellScript) handle(file, keep string) error {
+	switch config.Action {
+	case actionHardlink:
+		s.commands = append(s.commands, "ln -f -- "+shellQuote(keep)+" "+shellQuote(file))
+	case actionMove:
+		dest, err := trashPath(config.Trash, file)
+		if err != nil {
+			return err
+		}
+		s.commands = append(s.commands, "mkdir -p -- "+shellQuote(filepath.Dir(dest))+" && mv -n -- "+shellQuote(file)+" "+shellQuote(dest))
+	case actionSymlink:
+		target, err := filepath.Abs(keep)
+		if err != nil {
+			return err
+		}
+		s.commands = append(s.commands, "ln -sf -- "+shellQuote(target)+" "+shellQuote(file))
+	default:
+		s.commands = append(s.commands, "rm -- "+shellQuote(file))
+	}
+	return nil
+}
+
+// write prints the script to w, with a header summarizing sum.
+// It must not be called until all files have been handled.
+func (s *shellScript) write(w io.Writer, sum *summary) error {
+	var duplicates int
+	for _, rs := range sum.byRoot {
+		duplicates += rs.Duplicates
+	}
+	fmt.Fprintln(w, "#!/usr/bin/env bash")
+	fmt.Fprintln(w, "# generated by dedup; review before running")
+	fmt.Fprintf(w, "# %d duplicates, %s\n", duplicates, formatSize(sum.duplicateBytes()))
+	for _, root := range sum.roots {
+		fmt.Fprintf(w, "# %s: %d duplicates, %s\n", shellComment(root), sum.byRoot[root].Duplicates, formatSize(sum.byRoot[root].Bytes))
+	}
+	for _, c := range s.commands {
+		if _, err := fmt.Fprintln(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shellQuote quotes s as a single shell word.
+// Strings with control characters, such as newlines, use bash's $'...' quoting so the script stays line-based;
+// anything else uses single quotes.
+func shellQuote(s string) string {
+	if !strings.ContainsFunc(s, isControl) {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	}
+	var b strings.Builder
+	b.WriteString("$'")
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' || c == '\'':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			// bytes of multi-byte characters are copied as they are
+			b.WriteByte(c)
+		}
+	}
+	b.WriteString("'")
+	return b.String()
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// shellComment makes s safe to print after a # on a single line.
+func shellComment(s string) string {
+	return strings.Map(func(r rune) rune {
+		if isControl(r) {
+			return '?'
+		}
+		return r
+	}, s)
+}
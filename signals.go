@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// watchInterrupts cancels the run on the first signal from c, so that it can stop after the current operation,
+// and calls exit(1) on a second signal.
+// If timeout is positive, exit(1) is also called once timeout has passed since the first signal
+// without done being closed, so a run that is stuck doesn't need a second signal to stop.
+// It returns once done is closed.
+func watchInterrupts(c <-chan os.Signal, done <-chan struct{}, cancel func(), timeout time.Duration, exit func(int)) {
+	select {
+	case <-done:
+		return
+	case <-c:
+	}
+	slog.Info("received interrupt")
+	cancel()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		fmt.Fprintf(os.Stderr, "finishing the current operation; interrupt again to stop now, or wait %s\n", timeout)
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+	select {
+	case <-done:
+	case <-c:
+		slog.Error("received second interrupt; forcing exit")
+		exit(1)
+	case <-deadline:
+		slog.Error("did not stop within -shutdown-timeout; forcing exit", "timeout", timeout)
+		exit(1)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// stateVersion is the schema version of the -state database, kept in its user_version,
+// which is refused if it doesn't match.
+const stateVersion = 1
+
+// stateSchema creates the tables of an empty -state database.
+// Each file is kept by its absolute path with the size and modification time it had when it was hashed,
+// and the index on size and digest serves the query that groups the files of a bucket.
+const stateSchema = `
+CREATE TABLE IF NOT EXISTS files (
+	path     TEXT PRIMARY KEY,
+	size     INTEGER NOT NULL,
+	mtime_ns INTEGER NOT NULL,
+	sha256   BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS files_size_sha256 ON files (size, sha256);
+`
+
+// fileState is the -state database, or nil without it.
+var fileState *hashState
+
+// hashState keeps the SHA-256 digest of each file hashed between runs in a SQLite database, for -state,
+// so that files that haven't changed since an earlier run aren't read again to hash them,
+// and the groups of identical files in each bucket are found by a query over the digests.
+// A digest is only trusted while its file has the size and modification time it was recorded with.
+type hashState struct {
+	db *sql.DB
+	mu sync.Mutex
+	// hits and misses count the digests that were reused and the ones that were computed.
+	hits, misses int
+}
+
+// openHashState opens the -state database at path, creating it if it doesn't exist.
+func openHashState(path string) (*hashState, error) {
+	if sqliteDriver == "" {
+		return nil, fmt.Errorf("-state: %w", errors.ErrUnsupported)
+	}
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return nil, err
+	}
+	// the bucket table used by groups is temporary, so it only exists on the connection that created it
+	db.SetMaxOpenConns(1)
+	s := &hashState{db: db}
+	if err := s.init(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *hashState) init() error {
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version == 0 {
+		var tables int
+		if err := s.db.QueryRow(`SELECT count(*) FROM sqlite_master`).Scan(&tables); err != nil {
+			return err
+		}
+		if tables > 0 {
+			return errors.New("not a dedup state database")
+		}
+		if _, err := s.db.Exec(stateSchema + fmt.Sprintf(`PRAGMA user_version = %d;`, stateVersion)); err != nil {
+			return err
+		}
+		version = stateVersion
+	}
+	if version != stateVersion {
+		return fmt.Errorf("unsupported state version %d", version)
+	}
+	_, err := s.db.Exec(`CREATE TEMP TABLE IF NOT EXISTS bucket (path TEXT PRIMARY KEY)`)
+	return err
+}
+
+// hash returns the SHA-256 digest of the file at path, reusing the recorded one if the file's size
+// and modification time haven't changed, and recording it otherwise.
+func (s *hashState) hash(ctx context.Context, path string) ([]byte, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	// stat'd before reading, so that a file written to while it is hashed is hashed again next time
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var sum []byte
+	err = s.db.QueryRowContext(ctx, `SELECT sha256 FROM files WHERE path = ? AND size = ? AND mtime_ns = ?`,
+		abs, fi.Size(), fi.ModTime().UnixNano()).Scan(&sum)
+	if err == nil && len(sum) == sha256.Size {
+		s.mu.Lock()
+		s.hits++
+		s.mu.Unlock()
+		return sum, nil
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	sum, err = dup.HashFile(ctx, path, sha256.New)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO files (path, size, mtime_ns, sha256) VALUES (?, ?, ?, ?)
+		ON CONFLICT (path) DO UPDATE SET size = excluded.size, mtime_ns = excluded.mtime_ns, sha256 = excluded.sha256`,
+		abs, fi.Size(), fi.ModTime().UnixNano(), sum)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.misses++
+	s.mu.Unlock()
+	return sum, nil
+}
+
+// groups hashes every file of bucket, whose files all have the same size,
+// and returns the indexes into bucket of each group of files with the same digest, like dup.HashIndexes,
+// by a query over the recorded digests.
+// Files with a digest of their own are in no group, and files that can't be hashed are left out.
+func (s *hashState) groups(ctx context.Context, bucket []fileResult) ([][]int, error) {
+	if len(bucket) == 0 {
+		return nil, nil
+	}
+	index := make(map[string]int, len(bucket))
+	for i, fr := range bucket {
+		_, err := s.hash(ctx, fr.path)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			slog.Error("unable to hash file", "file", fr, "err", err)
+			continue
+		}
+		abs, err := filepath.Abs(fr.path)
+		if err != nil {
+			return nil, err
+		}
+		index[abs] = i
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM bucket`); err != nil {
+		return nil, err
+	}
+	insert, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO bucket (path) VALUES (?)`)
+	if err != nil {
+		return nil, err
+	}
+	defer insert.Close()
+	for p := range index {
+		if _, err := insert.ExecContext(ctx, p); err != nil {
+			return nil, err
+		}
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT f.path, f.sha256 FROM bucket b JOIN files f ON f.path = b.path
+		WHERE f.size = ? AND f.sha256 IN (
+			SELECT f.sha256 FROM bucket b JOIN files f ON f.path = b.path
+			GROUP BY f.sha256 HAVING count(*) > 1
+		)
+		ORDER BY f.sha256`, bucket[0].size)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups [][]int
+	var last []byte
+	for rows.Next() {
+		var p string
+		var sum []byte
+		if err := rows.Scan(&p, &sum); err != nil {
+			return nil, err
+		}
+		if groups == nil || !bytes.Equal(sum, last) {
+			groups = append(groups, nil)
+			last = sum
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], index[p])
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// in the order of bucket, as from dup.HashIndexes
+	for _, g := range groups {
+		slices.Sort(g)
+	}
+	slices.SortFunc(groups, func(a, b []int) int { return a[0] - b[0] })
+	return groups, tx.Commit()
+}
+
+// close drops the digests of files that no longer exist, e.g. duplicates that were deleted,
+// and closes the database. Every digest is written as soon as it is computed,
+// so an interrupted run doesn't lose the ones it already has.
+func (s *hashState) close() error {
+	rows, err := s.db.Query(`SELECT path FROM files`)
+	if err != nil {
+		return errors.Join(err, s.db.Close())
+	}
+	var gone []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			rows.Close()
+			return errors.Join(err, s.db.Close())
+		}
+		if _, err := os.Lstat(p); errors.Is(err, fs.ErrNotExist) {
+			gone = append(gone, p)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Join(err, s.db.Close())
+	}
+	if err := s.remove(gone); err != nil {
+		return errors.Join(err, s.db.Close())
+	}
+	return s.db.Close()
+}
+
+// remove deletes the digests of paths.
+func (s *hashState) remove(paths []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, p := range paths {
+		if _, err := tx.Exec(`DELETE FROM files WHERE path = ?`, p); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,6 @@
+//go:build !(darwin || freebsd || linux || windows)
+
+package main
+
+// sqliteDriver is empty where the SQLite driver isn't available, so -state isn't either.
+const sqliteDriver = ""
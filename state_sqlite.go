@@ -0,0 +1,8 @@
+//go:build darwin || freebsd || linux || windows
+
+package main
+
+import _ "modernc.org/sqlite"
+
+// sqliteDriver is the database/sql driver for the -state database.
+const sqliteDriver = "sqlite"
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/Travis-Britz/dedup/report"
+)
+
+// summary accumulates statistics about the files scanned and duplicates handled during a run.
+type summary struct {
+	roots  []string
+	byRoot map[string]*rootStats
+
+	// scannedFiles and scannedBytes count every file that was large enough to be compared.
+	scannedFiles int
+	scannedBytes int64
+	// comparisons counts the pairs of files compared, which may be compared concurrently.
+	comparisons atomic.Int64
+	// start is when the run began, to report how long it took.
+	start time.Time
+
+	// freed is the free space actually reclaimed, when measured with -check-freed.
+	freed *int64
+
+	// linked counts duplicates skipped by -skip-hardlinked.
+	linked int
+	// untrusted counts duplicates skipped by -apply-reasons.
+	untrusted int
+	// unverified counts clusters left alone because they failed -verify-sample.
+	unverified int
+	// archived counts duplicates involving archive members, which -into-archives only reports.
+	archived int
+	// hidden counts clusters left out by -group-threshold-bytes.
+	hidden int
+	// incomplete counts buckets in which comparing stopped before every pair of files was compared.
+	incomplete int
+
+	// clusterCount is the number of clusters of identical files found.
+	clusterCount int
+	// partial is set when the run stopped early at -max-clusters.
+	partial bool
+	// flushed is set by stageBucketsEarly to learn which of the files it sent early handleBuckets found to be duplicates.
+	flushed *flushLog
+
+	// recordClusters enables keeping every cluster found, for -report.
+	recordClusters bool
+	clusters       []report.Cluster
+	// hashName and newHash set the algorithm used to record file hashes in the report, if any.
+	hashName string
+	newHash  func() hash.Hash
+}
+
+type rootStats struct {
+	Duplicates int
+	Bytes      int64
+}
+
+func newSummary(roots []string) *summary {
+	s := &summary{
+		roots:  roots,
+		byRoot: make(map[string]*rootStats, len(roots)),
+		start:  time.Now(),
+	}
+	for _, r := range roots {
+		s.byRoot[r] = &rootStats{}
+	}
+	return s
+}
+
+// scanned records fr as a file that was considered for comparison.
+func (s *summary) scanned(fr fileResult) {
+	s.scannedFiles++
+	s.scannedBytes += fr.size
+}
+
+// duplicateCount returns the number of handled duplicates.
+func (s *summary) duplicateCount() int {
+	var n int
+	for _, rs := range s.byRoot {
+		n += rs.Duplicates
+	}
+	return n
+}
+
+// duplicateBytes returns the total size of all handled duplicates.
+func (s *summary) duplicateBytes() int64 {
+	var n int64
+	for _, rs := range s.byRoot {
+		n += rs.Bytes
+	}
+	return n
+}
+
+// ratio returns the deduplication ratio: unique bytes divided by scanned bytes.
+// A ratio of 1 means there were no duplicates.
+func (s *summary) ratio() float64 {
+	if s.scannedBytes == 0 {
+		return 1
+	}
+	return float64(s.scannedBytes-s.duplicateBytes()) / float64(s.scannedBytes)
+}
+
+// reclaimablePercent returns the percentage of scanned bytes taken up by duplicates.
+func (s *summary) reclaimablePercent() float64 {
+	return (1 - s.ratio()) * 100
+}
+
+// addCluster counts c as a cluster of identical files,
+// and keeps it for the report if recordClusters is set.
+func (s *summary) addCluster(ctx context.Context, c cluster) {
+	s.clusterCount++
+	if s.recordClusters {
+		s.clusters = append(s.clusters, newReportCluster(ctx, c, s.newHash))
+	}
+}
+
+// report returns the recorded clusters along with the statistics so far.
+func (s *summary) report() report.Report {
+	return report.Report{Hash: s.hashName, Clusters: s.clusters, Summary: s.runSummary()}
+}
+
+// runSummary returns the statistics so far in the form used by reports.
+func (s *summary) runSummary() *report.RunSummary {
+	rs := &report.RunSummary{
+		ScannedFiles:   s.scannedFiles,
+		ScannedBytes:   s.scannedBytes,
+		DuplicateBytes: s.duplicateBytes(),
+	}
+	for _, root := range s.roots {
+		stats := s.byRoot[root]
+		rs.Duplicates += stats.Duplicates
+		rs.Roots = append(rs.Roots, report.Root{Path: root, Duplicates: stats.Duplicates, Bytes: stats.Bytes})
+	}
+	return rs
+}
+
+// add records fr as a handled duplicate.
+func (s *summary) add(fr fileResult) {
+	rs, ok := s.byRoot[fr.root]
+	if !ok {
+		rs = &rootStats{}
+		s.byRoot[fr.root] = rs
+		s.roots = append(s.roots, fr.root)
+	}
+	rs.Duplicates++
+	rs.Bytes += fr.size
+}
+
+// write prints a human-readable summary to w and logs the same statistics as structured info-level records.
+func (s *summary) write(w io.Writer) {
+	for _, root := range s.roots {
+		rs := s.byRoot[root]
+		slog.Info("root summary", "root", root, "duplicates", rs.Duplicates, "bytes", rs.Bytes)
+		fmt.Fprintf(w, "%s: %d duplicates, %s\n", root, rs.Duplicates, formatSize(rs.Bytes))
+	}
+	slog.Info("summary",
+		"scanned_files", s.scannedFiles,
+		"scanned_bytes", s.scannedBytes,
+		"duplicate_bytes", s.duplicateBytes(),
+		"ratio", s.ratio(),
+		"reclaimable_percent", s.reclaimablePercent(),
+	)
+	fmt.Fprintf(w, "scanned %d files, %s; dedup ratio %.3f (%.1f%% reclaimable)\n",
+		s.scannedFiles, formatSize(s.scannedBytes), s.ratio(), s.reclaimablePercent())
+	elapsed := time.Since(s.start).Round(time.Millisecond)
+	slog.Info("totals",
+		"comparisons", s.comparisons.Load(),
+		"groups", s.clusterCount,
+		"duplicates", s.duplicateCount(),
+		"duplicate_bytes", s.duplicateBytes(),
+		"elapsed", elapsed,
+	)
+	reclaim := "would reclaim"
+	if config.Execute {
+		reclaim = "reclaimed"
+	}
+	fmt.Fprintf(w, "compared %d pairs and found %d duplicates in %d groups; %s %s in %s\n",
+		s.comparisons.Load(), s.duplicateCount(), s.clusterCount, reclaim, formatSize(s.duplicateBytes()), elapsed)
+	if s.linked > 0 {
+		slog.Info("skipped hard links", "files", s.linked)
+		fmt.Fprintf(w, "skipped %d duplicates with other hard links\n", s.linked)
+	}
+	if s.untrusted > 0 {
+		slog.Info("left for review", "files", s.untrusted)
+		fmt.Fprintf(w, "left %d duplicates chosen by other rules for review\n", s.untrusted)
+	}
+	if s.unverified > 0 {
+		slog.Info("groups failed verification", "groups", s.unverified)
+		fmt.Fprintf(w, "left %d groups that failed verification alone\n", s.unverified)
+	}
+	if s.archived > 0 {
+		slog.Info("left archive members for review", "files", s.archived)
+		fmt.Fprintf(w, "left %d duplicates involving files in archives for review\n", s.archived)
+	}
+	if s.hidden > 0 {
+		slog.Info("hidden small groups", "groups", s.hidden)
+		fmt.Fprintf(w, "hid %d smaller groups of identical files\n", s.hidden)
+	}
+	if s.incomplete > 0 {
+		slog.Info("incomplete buckets", "buckets", s.incomplete)
+		fmt.Fprintf(w, "stopped comparing %d buckets of same-sized files before every pair was compared\n", s.incomplete)
+	}
+	if s.partial {
+		slog.Info("partial results", "clusters", s.clusterCount)
+		fmt.Fprintf(w, "results are partial: stopped after %d groups of identical files\n", s.clusterCount)
+	}
+	if s.freed != nil {
+		slog.Info("freed space", "predicted_bytes", s.duplicateBytes(), "actual_bytes", *s.freed)
+		fmt.Fprintf(w, "freed %s (predicted %s)\n", formatSize(*s.freed), formatSize(s.duplicateBytes()))
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/Travis-Britz/dedup/dup"
+	"github.com/Travis-Britz/dedup/internal/fileid"
+)
+
+// linkTargets is the set of files that symlinks found by the walk point to, for -preserve-symlinks-as-originals.
+// Files are identified by device and inode, so the set doesn't depend on how a path was spelled.
+type linkTargets struct {
+	mu  sync.Mutex
+	ids map[fileid.FileID]bool
+}
+
+// symlinkTargets is filled in by the walk when config.KeepLinked is set.
+var symlinkTargets = &linkTargets{ids: make(map[fileid.FileID]bool)}
+
+// add records the file that the symlink at link points to.
+// Broken symlinks, and symlinks to directories, point to nothing that can be removed, so they are ignored.
+func (t *linkTargets) add(link string) {
+	id, err := fileid.Stat(link)
+	if err != nil {
+		slog.Debug("unable to follow symlink", "link", link, "err", err)
+		return
+	}
+	id.Nlink = 0
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ids[id] = true
+}
+
+// has reports whether a symlink points to the file at path.
+func (t *linkTargets) has(path string) bool {
+	id, err := fileid.Stat(path)
+	if err != nil {
+		return false
+	}
+	id.Nlink = 0
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ids[id]
+}
+
+// linkTargetFn wraps compareFn so that a file that a symlink points to is never selected as the duplicate:
+// it is kept in place of an identical file that no symlink points to,
+// and two such files are never compared at all, since removing either one would break a link.
+func linkTargetFn(compareFn dup.CompareFuncContext[string], targets *linkTargets) dup.CompareFuncContext[string] {
+	return func(ctx context.Context, left, right string) (dup.Selection, error) {
+		leftLinked, rightLinked := targets.has(left), targets.has(right)
+		if leftLinked && rightLinked {
+			return dup.None, nil
+		}
+		sel, err := compareFn(ctx, left, right)
+		if err != nil || sel == dup.None {
+			return sel, err
+		}
+		switch {
+		case leftLinked:
+			dup.SetRule(ctx, ruleLinkTarget)
+			return dup.Right, nil
+		case rightLinked:
+			dup.SetRule(ctx, ruleLinkTarget)
+			return dup.Left, nil
+		}
+		return sel, nil
+	}
+}
+
+// linkTargetsLast orders a bucket for -preserve-symlinks-as-originals like baselineLast,
+// so that each other file is matched at most once, against the first linked file it duplicates.
+func linkTargetsLast(a, b fileResult) int {
+	switch aLinked, bLinked := symlinkTargets.has(a.path), symlinkTargets.has(b.path); {
+	case aLinked == bLinked:
+		return 0
+	case aLinked:
+		return 1
+	default:
+		return -1
+	}
+}
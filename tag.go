@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Travis-Britz/dedup/dup"
+)
+
+// Extended attributes that -tag-kept writes to the kept file.
+const (
+	tagMergedCount = "user.dedup.merged_count"
+	tagTimestamp   = "user.dedup.timestamp"
+)
+
+// tagKept records on the kept file that merged duplicates were handled at t.
+// The count is added to the one left by earlier runs, so the file's history is kept.
+// Without config.Execute the tags are only printed.
+func tagKept(keep fileResult, merged int, t time.Time) error {
+	if merged == 0 {
+		return nil
+	}
+	attrs, err := dup.ReadXattrs(keep.path)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(string(attrs[tagMergedCount])); err == nil && n > 0 {
+		merged += n
+	}
+	tags := []struct{ name, value string }{
+		{tagMergedCount, strconv.Itoa(merged)},
+		{tagTimestamp, t.UTC().Format(time.RFC3339)},
+	}
+	for _, tag := range tags {
+		if !config.Execute {
+			fmt.Fprintf(os.Stderr, "xattr %s: %s=%s\n", keep.path, tag.name, tag.value)
+			continue
+		}
+		if err := dup.SetXattr(keep.path, tag.name, []byte(tag.value)); err != nil {
+			return fmt.Errorf("setting %s: %w", tag.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	touchNow    = "now"
+	touchOldest = "oldest"
+	touchNewest = "newest"
+)
+
+// modTimes returns the modification time of every file in c that can be read.
+// They have to be read before any duplicates are handled.
+func modTimes(c cluster) map[string]time.Time {
+	times := make(map[string]time.Time, len(c.dups)+1)
+	for _, fr := range append([]fileResult{c.keep}, c.dups...) {
+		fi, err := os.Stat(fr.path)
+		if err != nil {
+			slog.Error("unable to read modification time", "file", fr, "err", err)
+			continue
+		}
+		times[fr.path] = fi.ModTime()
+	}
+	return times
+}
+
+// touchTime picks the new modification time of keep for the -touch-kept policy,
+// from the times of keep and the duplicates that were handled.
+func touchTime(policy string, times map[string]time.Time, keep fileResult, handled []fileResult) time.Time {
+	if policy == touchNow {
+		return time.Now()
+	}
+	t := times[keep.path]
+	for _, d := range handled {
+		dt, ok := times[d.path]
+		switch {
+		case !ok:
+		case t.IsZero(),
+			policy == touchOldest && dt.Before(t),
+			policy == touchNewest && dt.After(t):
+			t = dt
+		}
+	}
+	return t
+}
+
+// touchKept sets the modification time of the kept file, leaving its access time alone.
+// Without config.Execute the change is only printed.
+func touchKept(keep fileResult, t time.Time) error {
+	if t.IsZero() {
+		return nil
+	}
+	if !config.Execute {
+		fmt.Fprintf(os.Stderr, "touch %s -> %s\n", keep.path, t.Format(time.RFC3339Nano))
+		return nil
+	}
+	return os.Chtimes(keep.path, time.Time{}, t)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// moveHandler moves file into config.Trash instead of removing it,
+// at the same path relative to config.Trash as it had relative to its directory argument,
+// so it can be reviewed and restored later.
+// A number is added to the name if the trash already holds a file at that path.
+// Across filesystems, file is copied and then removed.
+var moveHandler handlerFunc = func(file, _ string) error {
+	dest, err := claimTrashPath(config.Trash, file)
+	if err != nil {
+		return err
+	}
+	slog.Info("moving file", "file", file, "dest", dest)
+	err = os.Rename(file, dest)
+	if isCrossDevice(err) {
+		err = copyRemove(file, dest)
+	} else if err != nil {
+		return errors.Join(err, os.Remove(dest))
+	}
+	if err != nil {
+		return err
+	}
+	if err := syncParent(dest); err != nil {
+		return err
+	}
+	return syncParent(file)
+}
+
+// trashPath returns a path in trash for file that isn't taken yet.
+func trashPath(trash, file string) (string, error) {
+	dest, err := trashDest(trash, file)
+	if err != nil {
+		return "", err
+	}
+	for n := 0; ; n++ {
+		p := numberedPath(dest, n)
+		if _, err := os.Lstat(p); errors.Is(err, fs.ErrNotExist) {
+			return p, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+// claimTrashPath is like trashPath, but claims the path by creating an empty file there,
+// so that file can be moved over it without replacing a file that appeared in the meantime.
+func claimTrashPath(trash, file string) (string, error) {
+	dest, err := trashDest(trash, file)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return "", err
+	}
+	for n := 0; ; n++ {
+		p := numberedPath(dest, n)
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return p, f.Close()
+	}
+}
+
+// trashDest returns the path in trash for file before any number is added to its name.
+func trashDest(trash, file string) (string, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(trash, trashRel(abs, config.Dirs)), nil
+}
+
+// numberedPath adds n to the name of path before its extension, e.g. "flowers.1.jpg". 0 leaves path as it is.
+func numberedPath(path string, n int) string {
+	if n == 0 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + strconv.Itoa(n) + ext
+}
+
+// trashRel returns the path of file, which must be absolute, relative to the innermost of dirs that contains it.
+// A file outside all of them, e.g. one read from a -from-json report, keeps its whole path without the volume name.
+func trashRel(file string, dirs []string) string {
+	var rel string
+	for _, dir := range dirs {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			continue
+		}
+		r, err := filepath.Rel(dir, file)
+		if err != nil || !filepath.IsLocal(r) {
+			continue
+		}
+		if rel == "" || len(r) < len(rel) {
+			rel = r
+		}
+	}
+	if rel == "" {
+		rel = strings.TrimPrefix(file, filepath.VolumeName(file))
+	}
+	return rel
+}
+
+// copyRemove copies file to dest, usually the empty file left by claimTrashPath,
+// with the same permissions and modification time, and then removes file.
+func copyRemove(file, dest string) error {
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = dst.Chmod(fi.Mode().Perm())
+	if err == nil {
+		_, err = io.Copy(dst, src)
+	}
+	if err == nil && config.Fsync {
+		err = dst.Sync()
+	}
+	if err = errors.Join(err, dst.Close()); err != nil {
+		return errors.Join(fmt.Errorf("copying %s: %w", file, err), os.Remove(dest))
+	}
+	if err := os.Chtimes(dest, fi.ModTime(), fi.ModTime()); err != nil {
+		slog.Warn("unable to keep modification time of moved file", "file", dest, "err", err)
+	}
+	return os.Remove(file)
+}
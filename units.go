@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	unitsSI  = "si"
+	unitsIEC = "iec"
+)
+
+// unitPrefixes are the prefixes for each power of the base, starting at 1.
+const unitPrefixes = "kMGTPE"
+
+// unitBase returns the base of the prefixes in config.Units: 1000 for SI, 1024 for IEC.
+func unitBase() float64 {
+	if config.Units == unitsSI {
+		return 1000
+	}
+	return 1024
+}
+
+// formatSize formats n bytes for people with the prefixes of config.Units, e.g. "1.5 MiB" or "1.5 MB".
+// Sizes below one kilobyte are printed as an exact number of bytes.
+// Larger sizes are rounded to two decimal places.
+func formatSize(n int64) string {
+	base := unitBase()
+	v := float64(n)
+	if math.Abs(v) < base {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	i := -1
+	for math.Abs(v) >= base && i+1 < len(unitPrefixes) {
+		v /= base
+		i++
+	}
+	prefix := string(unitPrefixes[i])
+	if config.Units == unitsIEC {
+		prefix = strings.ToUpper(prefix) + "i"
+	}
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64) + " " + prefix + "B"
+}
+
+// parseSize parses a size in bytes with an optional unit, e.g. "1048576", "1M", "1.5GB", or "64 KiB",
+// so it accepts anything printed by formatSize.
+// Binary prefixes such as "Mi" always mean powers of 1024;
+// plain prefixes such as "M" are powers of 1000 or 1024, depending on config.Units.
+// Prefixes and the trailing "B" are case-insensitive.
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSpace(s), "bytes")
+	num = strings.TrimSuffix(strings.TrimSuffix(num, "B"), "b")
+	base, binary := unitBase(), strings.HasSuffix(num, "i")
+	if binary {
+		num, base = strings.TrimSuffix(num, "i"), 1024
+	}
+	mult := 1.0
+	if num != "" {
+		last := unicode.ToLower(rune(num[len(num)-1]))
+		if i := strings.IndexRune(strings.ToLower(unitPrefixes), last); i >= 0 {
+			num, mult = num[:len(num)-1], math.Pow(base, float64(i+1))
+		} else if binary {
+			return 0, fmt.Errorf("invalid size %q", s)
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n := math.Round(v * mult)
+	if n >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return int64(n), nil
+}
+
+// sizeFlag is a flag.Value for a size parsed with parseSize.
+// The size is parsed again by resolveSizes once all flags are set,
+// so that -units applies no matter where it appears on the command line.
+type sizeFlag struct {
+	n *int64
+	s string
+}
+
+// sizeFlags are all of the flags registered with sizeVar.
+var sizeFlags []*sizeFlag
+
+// sizeVar defines a size flag like flag.Int64Var that also accepts units.
+func sizeVar(p *int64, name, usage string) {
+	f := &sizeFlag{n: p}
+	sizeFlags = append(sizeFlags, f)
+	flag.Var(f, name, usage)
+}
+
+func (f *sizeFlag) String() string {
+	if f.n == nil {
+		return "0"
+	}
+	return strconv.FormatInt(*f.n, 10)
+}
+
+func (f *sizeFlag) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*f.n, f.s = n, s
+	return nil
+}
+
+// resolveSizes parses every size flag that was set again with the final value of config.Units.
+func resolveSizes() error {
+	for _, f := range sizeFlags {
+		if f.s == "" {
+			continue
+		}
+		if err := f.Set(f.s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Travis-Britz/dedup/dup"
+	"github.com/Travis-Britz/dedup/report"
+)
+
+// parsePercent parses a percentage such as "10%" or "2.5" into a fraction between 0 and 1.
+func parsePercent(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || v < 0 || v > 100 {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	return v / 100, nil
+}
+
+// verifySample compares the contents of a random fraction of the clusters in rep, for -verify-sample,
+// and returns rep without the clusters that failed.
+// At least one cluster is checked for any fraction above zero, and the sample is the same for the same rng seed.
+// verified is the number of clusters checked; failed are the kept files of the clusters that failed,
+// none of which are handled, while the clusters that weren't checked are trusted as they are.
+func verifySample(ctx context.Context, rep report.Report, fraction float64, rng *rand.Rand) (checked report.Report, verified int, failed []string) {
+	n := int(math.Ceil(fraction * float64(len(rep.Clusters))))
+	sample := make(map[int]bool, n)
+	for _, i := range rng.Perm(len(rep.Clusters))[:n] {
+		sample[i] = true
+	}
+	checked = rep
+	checked.Clusters = nil
+	for i, c := range rep.Clusters {
+		if sample[i] {
+			verified++
+			if err := verifyCluster(ctx, c); err != nil {
+				slog.Error("cluster failed verification; leaving it alone", "keep", c.Keep, "err", err)
+				failed = append(failed, c.Keep)
+				continue
+			}
+		}
+		checked.Clusters = append(checked.Clusters, c)
+	}
+	return checked, verified, failed
+}
+
+// verifyCluster returns an error unless every duplicate in c has the same contents as its kept file.
+func verifyCluster(ctx context.Context, c report.Cluster) error {
+	for _, d := range c.Duplicates {
+		offset, err := firstDifference(ctx, c.Keep, d)
+		if err != nil {
+			return err
+		}
+		if offset >= 0 {
+			return fmt.Errorf("%s differs from %s at byte %d", d, c.Keep, offset)
+		}
+	}
+	return nil
+}
+
+func firstDifference(ctx context.Context, a, b string) (int64, error) {
+	f1, err := os.Open(a)
+	if err != nil {
+		return 0, err
+	}
+	defer f1.Close()
+	f2, err := os.Open(b)
+	if err != nil {
+		return 0, err
+	}
+	defer f2.Close()
+	// closing the files unblocks a read that is in progress when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		f1.Close()
+		f2.Close()
+	})
+	offset, err := dup.FirstDifference(ctx, f1, f2)
+	if !stop() {
+		return 0, ctx.Err()
+	}
+	return offset, err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/Travis-Britz/dedup/dup"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchIndex holds every known file by size so that new files can be compared against the existing set.
+type watchIndex struct {
+	compareFn dup.CompareFuncContext[string]
+	h         handler
+	bySize    map[int64][]fileResult
+}
+
+func newWatchIndex(compareFn dup.CompareFuncContext[string], h handler) *watchIndex {
+	return &watchIndex{
+		compareFn: compareFn,
+		h:         h,
+		bySize:    make(map[int64][]fileResult),
+	}
+}
+
+// add compares fr against the known files of the same size and handles the first duplicate found.
+// If fr is not a duplicate, it becomes part of the known set.
+func (w *watchIndex) add(ctx context.Context, fr fileResult) {
+	w.remove(fr.path)
+	if !watchable(fr) {
+		return
+	}
+
+	for i, known := range w.bySize[fr.size] {
+		if sameFile(known.path, fr.path) {
+			// e.g. the result of a previous hardlink
+			slog.Debug("file is already linked", "file", fr, "known", known)
+			return
+		}
+		var rule dup.Rule
+		sel, err := w.compareFn(dup.WithRule(ctx, &rule), known.path, fr.path)
+		var openErr *dup.OpenError
+		if errors.As(err, &openErr) && openErr.Item == dup.Right {
+			// fr would fail against every other known file too
+			slog.Error("unable to open new file", "file", fr, "err", openErr.Err)
+			return
+		}
+		if err != nil {
+			slog.Error("comparison failure", "left", known, "right", fr, "err", err)
+			continue
+		}
+		switch sel {
+		case dup.None:
+			continue
+		case dup.Right:
+			if err := handleSelected(w.h, fr.path, known.path, rule); err != nil {
+				slog.Error("handler error", "file", fr, "err", err)
+			}
+			return
+		case dup.Left:
+			if err := handleSelected(w.h, known.path, fr.path, rule); err != nil {
+				slog.Error("handler error", "file", known, "err", err)
+				return
+			}
+			w.bySize[fr.size][i] = fr
+			return
+		}
+	}
+	w.bySize[fr.size] = append(w.bySize[fr.size], fr)
+}
+
+// insert adds fr to the known set without comparing it.
+func (w *watchIndex) insert(fr fileResult) {
+	w.remove(fr.path)
+	if !watchable(fr) {
+		return
+	}
+	w.bySize[fr.size] = append(w.bySize[fr.size], fr)
+}
+
+// watchable applies the same filters as listFSFiles and stageBuckets,
+// including the exclusions of every directory between fr and its root.
+func watchable(fr fileResult) bool {
+	if !hasExtension(fr.path, config.Extensions) || excludedWithin(fr.root, fr.path) {
+		return false
+	}
+	if aboveMaxSize(fr) {
+		return false
+	}
+	return fr.size >= config.MinSize || (fr.size == 0 && config.AllowEmpty)
+}
+
+// remove forgets the file at path, if it is known.
+func (w *watchIndex) remove(path string) {
+	for size, frs := range w.bySize {
+		if i := slices.IndexFunc(frs, func(fr fileResult) bool { return fr.path == path }); i >= 0 {
+			w.bySize[size] = slices.Delete(frs, i, i+1)
+			return
+		}
+	}
+}
+
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fa, fb)
+}
+
+// pendingFile is a file that changed recently and is waiting to settle before it is compared.
+type pendingFile struct {
+	root    string
+	size    int64
+	changed time.Time
+}
+
+// pendingFiles are the files waiting to settle, by path.
+type pendingFiles map[string]*pendingFile
+
+// add starts or restarts the wait for fr, which changed at now.
+func (p pendingFiles) add(fr fileResult, now time.Time) {
+	p[fr.path] = &pendingFile{root: fr.root, size: fr.size, changed: now}
+}
+
+// settled removes and returns the files whose size hasn't changed for config.WatchSettle as of now.
+// Files that have disappeared are dropped.
+func (p pendingFiles) settled(now time.Time) []fileResult {
+	var frs []fileResult
+	for path, pf := range p {
+		if now.Sub(pf.changed) < config.WatchSettle {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			delete(p, path)
+			continue
+		}
+		if fi.Size() != pf.size {
+			// still being written
+			pf.size, pf.changed = fi.Size(), now
+			continue
+		}
+		delete(p, path)
+		frs = append(frs, fileResult{path: path, size: pf.size, root: pf.root})
+	}
+	return frs
+}
+
+// watch monitors config.Dirs for new or modified files and compares each one against the existing files
+// once its size has stopped changing for config.WatchSettle.
+// It runs until ctx is cancelled.
+func watch(ctx context.Context, compareFn dup.CompareFuncContext[string]) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	// the existing files were already compared against each other before watching started
+	index := newWatchIndex(compareFn, config.H)
+	for _, root := range config.Dirs {
+		if err := watchTree(w, root, root, index.insert); err != nil {
+			return err
+		}
+	}
+	slog.Info("watching for new files", "dirs", config.Dirs)
+
+	pending := make(pendingFiles)
+	tick := time.NewTicker(config.WatchSettle / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-w.Errors:
+			slog.Error("watch error", "err", err)
+		case ev := <-w.Events:
+			root := rootOf(ev.Name)
+			switch {
+			case ev.Has(fsnotify.Create), ev.Has(fsnotify.Write):
+				fi, err := os.Lstat(ev.Name)
+				if err != nil {
+					continue
+				}
+				if fi.IsDir() {
+					// files in a new directory may still be being written, e.g. while it is copied in
+					err := watchTree(w, root, ev.Name, func(fr fileResult) { pending.add(fr, time.Now()) })
+					if err != nil {
+						slog.Error("failed to watch directory", "dir", ev.Name, "err", err)
+					}
+					continue
+				}
+				if !fi.Mode().IsRegular() {
+					continue
+				}
+				pending.add(fileResult{path: ev.Name, size: fi.Size(), root: root}, time.Now())
+			case ev.Has(fsnotify.Remove), ev.Has(fsnotify.Rename):
+				delete(pending, ev.Name)
+				index.remove(ev.Name)
+			}
+		case now := <-tick.C:
+			for _, fr := range pending.settled(now) {
+				index.add(ctx, fr)
+			}
+		}
+	}
+}
+
+// watchTree adds dir and all of its subdirectories that aren't excluded to w,
+// and passes every regular file within them to found.
+func watchTree(w *fsnotify.Watcher, root, dir string, found func(fileResult)) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			slog.Error("unable to access file", "path", path, "err", err)
+			if config.OnError == onErrorStop {
+				return err
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if excludedWithin(root, path) {
+				slog.Debug("not watching excluded directory", "path", path)
+				return fs.SkipDir
+			}
+			if err := w.Add(path); err != nil {
+				return err
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			slog.Error("failed to get file info", "err", err)
+			return nil
+		}
+		found(fileResult{path: path, size: fi.Size(), root: root})
+		return nil
+	})
+}
+
+// rootOf returns the directory argument that contains path.
+func rootOf(path string) string {
+	for _, root := range config.Dirs {
+		if rel, err := filepath.Rel(root, path); err == nil && filepath.IsLocal(rel) {
+			return root
+		}
+	}
+	return filepath.Dir(path)
+}